@@ -4,10 +4,13 @@ package bmc
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
-	"strings"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/m-lab/epoxy-extensions/internal/resolver"
 	"github.com/m-lab/go/host"
 	"github.com/m-lab/reboot-service/creds"
 )
@@ -18,52 +21,227 @@ const (
 
 var (
 	credsNewProvider = creds.NewProvider
-	netLookupHost    = net.LookupHost
+	timeNow          = time.Now
+)
+
+var (
+	// ErrInvalidHostname is returned for machine hostnames that cannot be
+	// parsed.
+	ErrInvalidHostname = errors.New("could not parse hostname")
+	// ErrMapping is returned when the Mapping of a machine cannot be applied,
+	// e.g. because its hostname template fails to render.
+	ErrMapping = errors.New("could not apply BMC mapping")
+	// ErrBMCLookupFailed is returned when the hostname of a BMC cannot be
+	// resolved.
+	ErrBMCLookupFailed = errors.New("could not resolve BMC hostname")
 )
 
 // PasswordStore defines the interface for storing BMC passwords.
 type PasswordStore interface {
-	Put(target string, password string) error
+	// Put stores the BMC password of the target machine.
+	Put(req Request) error
+	// Get returns the stored BMC credentials of the target machine.
+	Get(target string) (*creds.Credentials, error)
+	// List returns the metadata of the current credentials of all BMCs in a
+	// project.
+	List(project string) ([]Metadata, error)
+	// History returns the metadata of all recorded versions of the BMC
+	// credentials of the target machine, oldest first.
+	History(target string) ([]Metadata, error)
+	// Rollback makes a previous version of the BMC credentials of the target
+	// machine current again.
+	Rollback(target string, version int, setBy string, sourceIP string) (Metadata, error)
+}
+
+// Request describes the BMC credentials to store for a machine.
+type Request struct {
+	// Hostname is the hostname of the machine, not of its BMC.
+	Hostname string
+	Password string
+	// Override optionally changes the model and username selected by the
+	// machine's Mapping.
+	Override Override
+	// SetBy and SourceIP are recorded in the history of the credentials.
+	SetBy    string
+	SourceIP string
+}
+
+// Backend returns a Provider holding the BMC credentials of the machines in the
+// given project. The caller closes the provider when done.
+type Backend func(project string) (Provider, error)
+
+// Config holds the settings of a PasswordStore and of all backends. Each
+// backend only uses its own fields.
+type Config struct {
+	// Verifier, if not nil, checks credentials before they are stored.
+	Verifier Verifier
+
+	// FilePath is the path of the encrypted credentials file of the "file"
+	// backend, and FileKeyPath the path of its encryption key.
+	FilePath    string
+	FileKeyPath string
+
+	// VaultAddress, VaultToken, VaultMount and VaultPrefix configure the
+	// "vault" backend.
+	VaultAddress string
+	VaultToken   string
+	VaultMount   string
+	VaultPrefix  string
 }
 
-type gcdPasswordStore struct{}
+// BackendFactory creates a Backend from a Config.
+type BackendFactory func(cfg Config) (Backend, error)
 
-// Put stores a BMC password in GCD.
-func (g *gcdPasswordStore) Put(hostname string, password string) error {
+var (
+	registryMu sync.Mutex
+	registry   = map[string]BackendFactory{}
+)
+
+// Register makes a Backend available to NewStore under the given name. It
+// panics if a backend with that name is already registered.
+func Register(name string, factory BackendFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("bmc: backend registered twice: " + name)
+	}
+	registry[name] = factory
+}
+
+// Backends returns the sorted names of the registered backends.
+func Backends() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register("gcd", func(cfg Config) (Backend, error) {
+		return gcdBackend, nil
+	})
+	Register("memory", func(cfg Config) (Backend, error) {
+		return newMemoryBackend(), nil
+	})
+	Register("file", newFileBackend)
+	Register("vault", newVaultBackend)
+}
+
+// passwordStore implements the PasswordStore interface on top of a Backend.
+type passwordStore struct {
+	backend  Backend
+	mappings *Mappings
+	verifier Verifier
+
+	// mu serializes changes, so that concurrent changes to the same BMC do
+	// not lose versions.
+	mu sync.Mutex
+}
+
+// bmcHostname returns the parsed hostname of the target machine, its Mapping
+// and the hostname of its BMC.
+func (p *passwordStore) bmcHostname(hostname string) (host.Name, *Mapping, string, error) {
 	parts, err := host.Parse(hostname)
 	if err != nil {
-		return fmt.Errorf("could not parse hostname: %s", hostname)
+		return parts, nil, "", fmt.Errorf("%w: %s", ErrInvalidHostname, hostname)
+	}
+	m := p.mappings.Select(hostname)
+	bmcHost, err := m.BMCHostname(hostname, parts)
+	if err != nil {
+		return parts, nil, "", fmt.Errorf("%w: %v", ErrMapping, err)
+	}
+	return parts, m, bmcHost, nil
+}
+
+// Put stores a BMC password in the backend.
+func (p *passwordStore) Put(req Request) error {
+	parts, m, bmcHost, err := p.bmcHostname(req.Hostname)
+	if err != nil {
+		return err
+	}
+	model, username, err := m.Apply(req.Override)
+	if err != nil {
+		return err
+	}
+
+	bmcAddr, err := resolver.LookupHost(bmcHost)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrBMCLookupFailed, bmcHost, err)
+	}
+
+	r := &Record{
+		Credentials: creds.Credentials{
+			Address:  bmcAddr[0],
+			Hostname: bmcHost,
+			Model:    model,
+			Username: username,
+			Password: req.Password,
+		},
+		Action:   ActionPut,
+		SetBy:    req.SetBy,
+		SourceIP: req.SourceIP,
 	}
 
-	bmcHostname := strings.Replace(hostname, parts.Machine, parts.Machine+"d", 1)
+	ctx := context.Background()
+	if p.verifier != nil {
+		if err := p.verifier.Verify(ctx, &r.Credentials); err != nil {
+			return err
+		}
+	}
 
-	bmcAddr, err := netLookupHost(bmcHostname)
+	provider, err := p.backend(parts.Project)
 	if err != nil {
-		return fmt.Errorf("could not resolve BMC hostname: %s", bmcHostname)
+		return err
 	}
+	defer provider.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.commit(ctx, provider, r)
+}
 
-	c := &creds.Credentials{
-		Address:  bmcAddr[0],
-		Hostname: bmcHostname,
-		Model:    "DRAC",
-		Username: "admin",
-		Password: password,
+// Get returns the BMC credentials of a machine from the backend.
+func (p *passwordStore) Get(hostname string) (*creds.Credentials, error) {
+	parts, _, bmcHost, err := p.bmcHostname(hostname)
+	if err != nil {
+		return nil, err
 	}
 
-	provider, err := credsNewProvider(&creds.DatastoreConnector{}, parts.Project, gcdNamespace)
+	provider, err := p.backend(parts.Project)
 	if err != nil {
-		return fmt.Errorf("could not connect to Google Cloud Datastore: %v", err)
+		return nil, err
 	}
+	defer provider.Close()
 
-	err = provider.AddCredentials(context.Background(), bmcHostname, c)
+	c, err := provider.FindCredentials(context.Background(), bmcHost)
 	if err != nil {
-		return fmt.Errorf("error while adding credentials to GCD: %v", err)
+		return nil, fmt.Errorf("error while finding credentials: %v", err)
 	}
+	return c, nil
+}
 
-	return nil
+// NewStore returns a PasswordStore using the named backend. The BMC hostname,
+// model and username of each machine are selected from mappings, which may be
+// nil.
+func NewStore(name string, cfg Config, mappings *Mappings) (PasswordStore, error) {
+	registryMu.Lock()
+	factory, ok := registry[name]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown BMC backend %q, must be one of %v", name, Backends())
+	}
+	backend, err := factory(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create BMC backend %q: %v", name, err)
+	}
+	return &passwordStore{backend: backend, mappings: mappings, verifier: cfg.Verifier}, nil
 }
 
-// New returns a new PasswordStore.
+// New returns a new PasswordStore using Google Cloud Datastore.
 func New() PasswordStore {
-	return &gcdPasswordStore{}
+	return &passwordStore{backend: gcdBackend}
 }
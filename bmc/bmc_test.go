@@ -2,10 +2,21 @@ package bmc
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/datastore"
+	"github.com/m-lab/epoxy-extensions/internal/resolver"
 	"github.com/m-lab/reboot-service/creds"
+	"github.com/m-lab/reboot-service/creds/credstest"
 )
 
 // fakeCredsProviders implemenst the creds.Provider interface.
@@ -90,23 +101,32 @@ func Test_Put(t *testing.T) {
 			fc := fakeCredsProvider{
 				wantErr: tt.wantErr,
 			}
-			ps := &gcdPasswordStore{}
+			ps := &passwordStore{backend: gcdBackend}
+			datastoreNewClient = func(ctx context.Context, project string) (datastoreClient, error) {
+				return newFakeDatastore(), nil
+			}
 			credsNewProvider = func(connector creds.Connector, projectID, namespace string) (creds.Provider, error) {
 				if tt.newCredsErr {
 					return nil, fmt.Errorf("Error!")
 				}
 				return fc, nil
 			}
-			netLookupHost = func(host string) (addrs []string, err error) {
+			resolver.LookupHost = func(host string) (addrs []string, err error) {
 				if tt.dnsErr {
 					return nil, fmt.Errorf("Error!")
 				}
 				return []string{"192.168.0.1"}, nil
 			}
-			err := ps.Put(tt.hostname, tt.password)
+			err := ps.Put(Request{Hostname: tt.hostname, Password: tt.password})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Put(): want err %v, got %v", tt.wantErr, err)
 			}
+			if tt.hostParseErr && !errors.Is(err, ErrInvalidHostname) {
+				t.Errorf("Put(): error = %v, want ErrInvalidHostname", err)
+			}
+			if tt.dnsErr && !errors.Is(err, ErrBMCLookupFailed) {
+				t.Errorf("Put(): error = %v, want ErrBMCLookupFailed", err)
+			}
 		})
 	}
 }
@@ -119,3 +139,286 @@ func Test_New(t *testing.T) {
 		t.Errorf("New(): expected type PasswordStore, but got %T", ps)
 	}
 }
+
+var testTime = time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+
+// lockedProvider makes a credstest.FakeProvider safe for concurrent use.
+type lockedProvider struct {
+	mu *sync.Mutex
+	p  *credstest.FakeProvider
+}
+
+func (l lockedProvider) AddCredentials(ctx context.Context, host string, c *creds.Credentials) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.p.AddCredentials(ctx, host, c)
+}
+
+func (l lockedProvider) Close() error {
+	return nil
+}
+
+func (l lockedProvider) DeleteCredentials(ctx context.Context, host string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.p.DeleteCredentials(ctx, host)
+}
+
+func (l lockedProvider) FindCredentials(ctx context.Context, host string) (*creds.Credentials, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.p.FindCredentials(ctx, host)
+}
+
+func (l lockedProvider) ListCredentials(ctx context.Context) ([]*creds.Credentials, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.p.ListCredentials(ctx)
+}
+
+// fakeDatastore implements datastoreClient with a map.
+type fakeDatastore struct {
+	mu       sync.Mutex
+	entities map[string]historyEntity
+}
+
+func newFakeDatastore() *fakeDatastore {
+	return &fakeDatastore{entities: map[string]historyEntity{}}
+}
+
+func (f *fakeDatastore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entities[key.String()]
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	*dst.(*historyEntity) = e
+	return nil
+}
+
+func (f *fakeDatastore) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entities[key.String()] = *src.(*historyEntity)
+	return key, nil
+}
+
+func (f *fakeDatastore) Close() error {
+	return nil
+}
+
+// fakeGCD replaces credsNewProvider and datastoreNewClient with fakes, one per
+// project.
+func fakeGCD(t *testing.T) {
+	var mu sync.Mutex
+	projects := map[string]*credstest.FakeProvider{}
+	histories := map[string]*fakeDatastore{}
+	orig, origClient := credsNewProvider, datastoreNewClient
+	t.Cleanup(func() { credsNewProvider, datastoreNewClient = orig, origClient })
+	datastoreNewClient = func(ctx context.Context, project string) (datastoreClient, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if histories[project] == nil {
+			histories[project] = newFakeDatastore()
+		}
+		return histories[project], nil
+	}
+	credsNewProvider = func(connector creds.Connector, projectID, namespace string) (creds.Provider, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if namespace != gcdNamespace {
+			return nil, fmt.Errorf("unexpected namespace: %s", namespace)
+		}
+		if projects[projectID] == nil {
+			projects[projectID] = credstest.NewProvider()
+		}
+		return lockedProvider{mu: &mu, p: projects[projectID]}, nil
+	}
+}
+
+// writeKey writes a random base64 encoded file backend key and returns its path.
+func writeKey(t *testing.T, dir string) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	path := filepath.Join(dir, "key")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return path
+}
+
+// conformanceStores returns a PasswordStore for every registered backend.
+func conformanceStores(t *testing.T) map[string]PasswordStore {
+	fakeGCD(t)
+	dir := t.TempDir()
+	vault := newFakeVault(t, "s3cr3t")
+	configs := map[string]Config{
+		"gcd":    {},
+		"memory": {},
+		"file": {
+			FilePath:    filepath.Join(dir, "creds"),
+			FileKeyPath: writeKey(t, dir),
+		},
+		"vault": {
+			VaultAddress: vault.URL,
+			VaultToken:   "s3cr3t",
+		},
+	}
+	stores := map[string]PasswordStore{}
+	for _, name := range Backends() {
+		cfg, ok := configs[name]
+		if !ok {
+			t.Fatalf("no conformance configuration for backend %q", name)
+		}
+		ps, err := NewStore(name, cfg, nil)
+		if err != nil {
+			t.Fatalf("NewStore(%q): %v", name, err)
+		}
+		stores[name] = ps
+	}
+	return stores
+}
+
+// Test_Conformance runs the same checks against every backend.
+func Test_Conformance(t *testing.T) {
+	timeNow = func() time.Time { return testTime }
+	defer func() { timeNow = time.Now }()
+	resolver.LookupHost = func(host string) (addrs []string, err error) {
+		if host == "mlab1d-not01.mlab-oti.measurement-lab.org" {
+			return nil, fmt.Errorf("Error!")
+		}
+		return []string{"192.168.0.1"}, nil
+	}
+	const (
+		hostname = "mlab1-foo01.mlab-oti.measurement-lab.org"
+		bmcHost  = "mlab1d-foo01.mlab-oti.measurement-lab.org"
+	)
+
+	for name, ps := range conformanceStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ps.Get(hostname); err == nil {
+				t.Errorf("Get(): expected error for unknown host")
+			}
+
+			put := Request{
+				Hostname: hostname,
+				Password: "password",
+				SetBy:    hostname,
+				SourceIP: "192.168.1.1",
+			}
+			if err := ps.Put(put); err != nil {
+				t.Fatalf("Put(): %v", err)
+			}
+			want := &creds.Credentials{
+				Hostname: bmcHost,
+				Username: "admin",
+				Password: "password",
+				Model:    "DRAC",
+				Address:  "192.168.0.1",
+			}
+			got, err := ps.Get(hostname)
+			if err != nil {
+				t.Fatalf("Get(): %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Get() = %v, want %v", got, want)
+			}
+
+			if err := ps.Put(Request{Hostname: hostname, Password: "changed"}); err != nil {
+				t.Fatalf("Put(): %v", err)
+			}
+			got, err = ps.Get(hostname)
+			if err != nil || got.Password != "changed" {
+				t.Errorf("Get() after overwrite = %v, %v; want password %q", got, err, "changed")
+			}
+
+			// Every change is recorded, and can be rolled back.
+			history, err := ps.History(hostname)
+			if err != nil || len(history) != 2 {
+				t.Fatalf("History() = %v, %v; want 2 versions", history, err)
+			}
+			if h := history[0]; h.Version != 1 || h.Action != ActionPut || h.SetBy != hostname ||
+				h.SourceIP != "192.168.1.1" || h.Hostname != bmcHost || !h.Time.Equal(testTime) {
+				t.Errorf("History()[0] = %+v, want version 1 set by %s", h, hostname)
+			}
+			m, err := ps.Rollback(hostname, 1, "operator:alice", "10.0.0.1")
+			if err != nil {
+				t.Fatalf("Rollback(): %v", err)
+			}
+			if m.Version != 3 || m.Action != ActionRollback || m.RollbackOf != 1 || m.SetBy != "operator:alice" {
+				t.Errorf("Rollback() = %+v, want version 3 rolling back version 1", m)
+			}
+			got, err = ps.Get(hostname)
+			if err != nil || got.Password != "password" {
+				t.Errorf("Get() after rollback = %v, %v; want password %q", got, err, "password")
+			}
+			if _, err := ps.Rollback(hostname, 42, "operator:alice", "10.0.0.1"); !errors.Is(err, ErrVersionNotFound) {
+				t.Errorf("Rollback() = %v, want ErrVersionNotFound", err)
+			}
+			list, err := ps.List("mlab-oti")
+			if err != nil || len(list) != 1 || list[0].Hostname != bmcHost || list[0].Version != 3 {
+				t.Errorf("List() = %+v, %v; want version 3 of %s", list, err, bmcHost)
+			}
+
+			// The same machine in another project is stored separately.
+			other := "mlab1-foo01.mlab-sandbox.measurement-lab.org"
+			if _, err := ps.Get(other); err == nil {
+				t.Errorf("Get(): credentials leaked across projects")
+			}
+
+			if err := ps.Put(Request{Hostname: "lol-foo01.mlab-oti.measurement-lab.org", Password: "password"}); err == nil {
+				t.Errorf("Put(): expected error for bad hostname")
+			}
+			if _, err := ps.Get("lol-foo01.mlab-oti.measurement-lab.org"); err == nil {
+				t.Errorf("Get(): expected error for bad hostname")
+			}
+			if err := ps.Put(Request{Hostname: "mlab1-not01.mlab-oti.measurement-lab.org", Password: "password"}); err == nil {
+				t.Errorf("Put(): expected error for unresolvable BMC")
+			}
+
+			var wg sync.WaitGroup
+			for i := 1; i <= 4; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					h := fmt.Sprintf("mlab%d-bar01.mlab-oti.measurement-lab.org", i)
+					if err := ps.Put(Request{Hostname: h, Password: h}); err != nil {
+						t.Errorf("Put(%s): %v", h, err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			for i := 1; i <= 4; i++ {
+				h := fmt.Sprintf("mlab%d-bar01.mlab-oti.measurement-lab.org", i)
+				got, err := ps.Get(h)
+				if err != nil || got.Password != h {
+					t.Errorf("Get(%s) = %v, %v", h, got, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_NewStore(t *testing.T) {
+	if _, err := NewStore("lol", Config{}, nil); err == nil {
+		t.Errorf("NewStore(): expected error for unknown backend")
+	}
+	if _, err := NewStore("file", Config{}, nil); err == nil {
+		t.Errorf("NewStore(): expected error for missing file configuration")
+	}
+	if _, err := NewStore("vault", Config{}, nil); err == nil {
+		t.Errorf("NewStore(): expected error for missing vault configuration")
+	}
+}
+
+func Test_Register(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Register(): expected panic for duplicate backend")
+		}
+	}()
+	Register("memory", func(cfg Config) (Backend, error) { return newMemoryBackend(), nil })
+}
@@ -0,0 +1,233 @@
+package bmc
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/m-lab/reboot-service/creds"
+)
+
+// fileAdditionalData is authenticated along with the contents of the
+// credentials file, so that files of another format are never accepted.
+var fileAdditionalData = []byte("epoxy-extensions bmc credentials v1")
+
+// fileData is the decrypted content of a credentials file: the credentials and
+// their history for each project, keyed by BMC hostname.
+type fileData struct {
+	Credentials map[string]map[string]creds.Credentials `json:"credentials"`
+	History     map[string]map[string][]*Record         `json:"history"`
+}
+
+// fileStore keeps BMC credentials in a local file encrypted with AES-256-GCM.
+// The file is rewritten completely on every change.
+type fileStore struct {
+	mu   sync.Mutex
+	path string
+	aead cipher.AEAD
+}
+
+// newFileBackend returns a Backend storing credentials in the encrypted file
+// cfg.FilePath. cfg.FileKeyPath must contain a base64 encoded 32 byte key.
+func newFileBackend(cfg Config) (Backend, error) {
+	if cfg.FilePath == "" || cfg.FileKeyPath == "" {
+		return nil, errors.New("the file backend requires a file path and a key path")
+	}
+	b, err := os.ReadFile(cfg.FileKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes long, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &fileStore{path: cfg.FilePath, aead: aead}
+	// Fail early if the file exists but cannot be decrypted.
+	if _, err := fs.load(); err != nil {
+		return nil, err
+	}
+	return func(project string) (Provider, error) {
+		return &fileProvider{store: fs, project: project}, nil
+	}, nil
+}
+
+func newFileData() *fileData {
+	return &fileData{
+		Credentials: map[string]map[string]creds.Credentials{},
+		History:     map[string]map[string][]*Record{},
+	}
+}
+
+// load reads and decrypts the credentials file. A missing file is empty.
+func (f *fileStore) load() (*fileData, error) {
+	b, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newFileData(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := f.aead.NonceSize()
+	if len(b) < n {
+		return nil, fmt.Errorf("credentials file %s is truncated", f.path)
+	}
+	plain, err := f.aead.Open(nil, b[:n], b[n:], fileAdditionalData)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt credentials file %s: %v", f.path, err)
+	}
+	data := newFileData()
+	if err := json.Unmarshal(plain, data); err != nil {
+		return nil, fmt.Errorf("could not parse credentials file %s: %v", f.path, err)
+	}
+	return data, nil
+}
+
+// save encrypts and atomically replaces the credentials file.
+func (f *fileStore) save(data *fileData) error {
+	plain, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := f.aead.Seal(nonce, nonce, plain, fileAdditionalData)
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(sealed); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// fileProvider implements Provider for one project of a fileStore.
+type fileProvider struct {
+	store   *fileStore
+	project string
+}
+
+// ListCredentials returns all credentials of the project, sorted by hostname.
+func (p *fileProvider) ListCredentials(ctx context.Context) ([]*creds.Credentials, error) {
+	p.store.mu.Lock()
+	defer p.store.mu.Unlock()
+	data, err := p.store.load()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*creds.Credentials, 0, len(data.Credentials[p.project]))
+	for _, c := range data.Credentials[p.project] {
+		c := c
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Hostname < list[j].Hostname })
+	return list, nil
+}
+
+// FindCredentials returns the credentials for host.
+func (p *fileProvider) FindCredentials(ctx context.Context, host string) (*creds.Credentials, error) {
+	p.store.mu.Lock()
+	defer p.store.mu.Unlock()
+	data, err := p.store.load()
+	if err != nil {
+		return nil, err
+	}
+	c, ok := data.Credentials[p.project][host]
+	if !ok {
+		return nil, fmt.Errorf("hostname not found: %s", host)
+	}
+	return &c, nil
+}
+
+// AddCredentials stores c for host, replacing existing credentials.
+func (p *fileProvider) AddCredentials(ctx context.Context, host string, c *creds.Credentials) error {
+	p.store.mu.Lock()
+	defer p.store.mu.Unlock()
+	data, err := p.store.load()
+	if err != nil {
+		return err
+	}
+	if data.Credentials[p.project] == nil {
+		data.Credentials[p.project] = map[string]creds.Credentials{}
+	}
+	data.Credentials[p.project][host] = *c
+	return p.store.save(data)
+}
+
+// DeleteCredentials removes the credentials for host, if any.
+func (p *fileProvider) DeleteCredentials(ctx context.Context, host string) error {
+	p.store.mu.Lock()
+	defer p.store.mu.Unlock()
+	data, err := p.store.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := data.Credentials[p.project][host]; !ok {
+		return nil
+	}
+	delete(data.Credentials[p.project], host)
+	return p.store.save(data)
+}
+
+// History returns the recorded versions of the credentials of host.
+func (p *fileProvider) History(ctx context.Context, host string) ([]*Record, error) {
+	p.store.mu.Lock()
+	defer p.store.mu.Unlock()
+	data, err := p.store.load()
+	if err != nil {
+		return nil, err
+	}
+	return data.History[p.project][host], nil
+}
+
+// SetHistory replaces the recorded versions of the credentials of host.
+func (p *fileProvider) SetHistory(ctx context.Context, host string, records []*Record) error {
+	p.store.mu.Lock()
+	defer p.store.mu.Unlock()
+	data, err := p.store.load()
+	if err != nil {
+		return err
+	}
+	if data.History[p.project] == nil {
+		data.History[p.project] = map[string][]*Record{}
+	}
+	data.History[p.project][host] = records
+	return p.store.save(data)
+}
+
+// Close does nothing, since the file is only open while it is read or written.
+func (p *fileProvider) Close() error {
+	return nil
+}
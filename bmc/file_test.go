@@ -0,0 +1,112 @@
+package bmc
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/reboot-service/creds"
+)
+
+func Test_newFileBackend(t *testing.T) {
+	dir := t.TempDir()
+	key := writeKey(t, dir)
+	shortKey := filepath.Join(dir, "short")
+	os.WriteFile(shortKey, []byte("c2hvcnQ="), 0600)
+	badKey := filepath.Join(dir, "bad")
+	os.WriteFile(badKey, []byte("not base64!"), 0600)
+	garbage := filepath.Join(dir, "garbage")
+	os.WriteFile(garbage, []byte("this is not encrypted"), 0600)
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{
+			name: "success",
+			cfg:  Config{FilePath: filepath.Join(dir, "creds"), FileKeyPath: key},
+		},
+		{
+			name:    "failure-missing-key-file",
+			cfg:     Config{FilePath: filepath.Join(dir, "creds"), FileKeyPath: filepath.Join(dir, "nope")},
+			wantErr: true,
+		},
+		{
+			name:    "failure-short-key",
+			cfg:     Config{FilePath: filepath.Join(dir, "creds"), FileKeyPath: shortKey},
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-key",
+			cfg:     Config{FilePath: filepath.Join(dir, "creds"), FileKeyPath: badKey},
+			wantErr: true,
+		},
+		{
+			name:    "failure-undecryptable-file",
+			cfg:     Config{FilePath: garbage, FileKeyPath: key},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newFileBackend(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newFileBackend(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_fileProvider(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{FilePath: filepath.Join(dir, "creds"), FileKeyPath: writeKey(t, dir)}
+	backend, err := newFileBackend(cfg)
+	if err != nil {
+		t.Fatalf("newFileBackend(): %v", err)
+	}
+	p, _ := backend("mlab-oti")
+	ctx := context.Background()
+	c := &creds.Credentials{Hostname: "mlab1d-foo01", Password: "hunter2"}
+	if err := p.AddCredentials(ctx, c.Hostname, c); err != nil {
+		t.Fatalf("AddCredentials(): %v", err)
+	}
+
+	// The file is private and does not contain the password in clear text.
+	fi, err := os.Stat(cfg.FilePath)
+	if err != nil {
+		t.Fatalf("Stat(): %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v, want 0600", fi.Mode().Perm())
+	}
+	b, _ := os.ReadFile(cfg.FilePath)
+	if bytes.Contains(b, []byte("hunter2")) {
+		t.Errorf("credentials file contains the password in clear text")
+	}
+
+	// Credentials survive a restart.
+	backend, err = newFileBackend(cfg)
+	if err != nil {
+		t.Fatalf("newFileBackend(): %v", err)
+	}
+	p, _ = backend("mlab-oti")
+	list, err := p.ListCredentials(ctx)
+	if err != nil || len(list) != 1 || list[0].Password != "hunter2" {
+		t.Errorf("ListCredentials() = %v, %v; want stored credentials", list, err)
+	}
+	if err := p.DeleteCredentials(ctx, c.Hostname); err != nil {
+		t.Errorf("DeleteCredentials(): %v", err)
+	}
+	if _, err := p.FindCredentials(ctx, c.Hostname); err == nil {
+		t.Errorf("FindCredentials(): expected error after delete")
+	}
+
+	// A different key cannot read the file.
+	cfg.FileKeyPath = writeKey(t, t.TempDir())
+	if _, err := newFileBackend(cfg); err == nil {
+		t.Errorf("newFileBackend(): expected error with the wrong key")
+	}
+}
@@ -0,0 +1,129 @@
+package bmc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/m-lab/epoxy-extensions/metrics"
+	"github.com/m-lab/reboot-service/creds"
+)
+
+// historyKind is the Datastore kind of the history entities. It differs from
+// the kind of the credentials, so the reboot-service never sees them.
+const historyKind = "CredentialsHistory"
+
+// datastoreClient is the subset of *datastore.Client used for the history.
+type datastoreClient interface {
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	Close() error
+}
+
+var datastoreNewClient = func(ctx context.Context, project string) (datastoreClient, error) {
+	return datastore.NewClient(ctx, project)
+}
+
+// historyEntity holds all recorded versions of the credentials of a BMC,
+// encoded as JSON.
+type historyEntity struct {
+	Records string `datastore:"records,noindex"`
+}
+
+// gcdProvider implements Provider with the reboot-service's creds.Provider for
+// the credentials, and its own entities in the same namespace for the history.
+// The latency of all Datastore calls is recorded.
+type gcdProvider struct {
+	creds.Provider
+	client datastoreClient
+}
+
+// gcdBackend returns a Provider backed by Google Cloud Datastore in the given
+// project, in the namespace used by the reboot-service.
+func gcdBackend(project string) (Provider, error) {
+	provider, err := credsNewProvider(&creds.DatastoreConnector{}, project, gcdNamespace)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to Google Cloud Datastore: %v", err)
+	}
+	client, err := datastoreNewClient(context.Background(), project)
+	if err != nil {
+		provider.Close()
+		return nil, fmt.Errorf("could not connect to Google Cloud Datastore: %v", err)
+	}
+	return &gcdProvider{Provider: provider, client: client}, nil
+}
+
+func historyKey(host string) *datastore.Key {
+	key := datastore.NameKey(historyKind, host, nil)
+	key.Namespace = gcdNamespace
+	return key
+}
+
+// ListCredentials lists the credentials of all BMCs.
+func (g *gcdProvider) ListCredentials(ctx context.Context) ([]*creds.Credentials, error) {
+	start := time.Now()
+	c, err := g.Provider.ListCredentials(ctx)
+	metrics.ObserveBackendCall("datastore", "list", start, err)
+	return c, err
+}
+
+// FindCredentials returns the credentials of host.
+func (g *gcdProvider) FindCredentials(ctx context.Context, host string) (*creds.Credentials, error) {
+	start := time.Now()
+	c, err := g.Provider.FindCredentials(ctx, host)
+	metrics.ObserveBackendCall("datastore", "find", start, err)
+	return c, err
+}
+
+// AddCredentials stores the credentials of host.
+func (g *gcdProvider) AddCredentials(ctx context.Context, host string, c *creds.Credentials) error {
+	start := time.Now()
+	err := g.Provider.AddCredentials(ctx, host, c)
+	metrics.ObserveBackendCall("datastore", "add", start, err)
+	return err
+}
+
+// History returns the recorded versions of the credentials of host.
+func (g *gcdProvider) History(ctx context.Context, host string) ([]*Record, error) {
+	var e historyEntity
+	start := time.Now()
+	err := g.client.Get(ctx, historyKey(host), &e)
+	if errors.Is(err, datastore.ErrNoSuchEntity) {
+		// A host without history is not a failed call.
+		metrics.ObserveBackendCall("datastore", "get_history", start, nil)
+		return nil, nil
+	}
+	metrics.ObserveBackendCall("datastore", "get_history", start, err)
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	if err := json.Unmarshal([]byte(e.Records), &records); err != nil {
+		return nil, fmt.Errorf("could not parse history of %s: %v", host, err)
+	}
+	return records, nil
+}
+
+// SetHistory replaces the recorded versions of the credentials of host.
+func (g *gcdProvider) SetHistory(ctx context.Context, host string, records []*Record) error {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	_, err = g.client.Put(ctx, historyKey(host), &historyEntity{Records: string(b)})
+	metrics.ObserveBackendCall("datastore", "set_history", start, err)
+	return err
+}
+
+// Close closes both Datastore clients.
+func (g *gcdProvider) Close() error {
+	err := g.Provider.Close()
+	if cerr := g.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package bmc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/m-lab/reboot-service/creds"
+)
+
+// maxHistory is the number of versions kept for each BMC. Older versions are
+// dropped and can no longer be rolled back to.
+const maxHistory = 20
+
+// Actions recorded in the history of a BMC.
+const (
+	ActionPut      = "put"
+	ActionRollback = "rollback"
+)
+
+// ErrVersionNotFound is returned by PasswordStore.Rollback when the requested
+// version is not in the history of the BMC.
+var ErrVersionNotFound = errors.New("version not found")
+
+// Provider is a creds.Provider that also keeps the history of the credentials
+// of each BMC.
+type Provider interface {
+	creds.Provider
+	// History returns the recorded versions of the credentials of host,
+	// oldest first. A host without history has no versions and no error.
+	History(ctx context.Context, host string) ([]*Record, error)
+	// SetHistory replaces the recorded versions of the credentials of host.
+	SetHistory(ctx context.Context, host string, records []*Record) error
+}
+
+// Record is a version of the credentials of a BMC.
+type Record struct {
+	Version     int               `json:"version"`
+	Credentials creds.Credentials `json:"credentials"`
+	Action      string            `json:"action"`
+	// RollbackOf is the version restored by a rollback.
+	RollbackOf int `json:"rollback_of,omitempty"`
+	// SetBy names the machine or operator that stored the credentials, and
+	// SourceIP the address the request came from.
+	SetBy    string    `json:"set_by"`
+	SourceIP string    `json:"source_ip"`
+	Time     time.Time `json:"time"`
+}
+
+// Metadata describes a Record without revealing the password.
+type Metadata struct {
+	Hostname   string    `json:"hostname"`
+	Version    int       `json:"version"`
+	Username   string    `json:"username"`
+	Model      string    `json:"model"`
+	Address    string    `json:"address"`
+	Action     string    `json:"action,omitempty"`
+	RollbackOf int       `json:"rollback_of,omitempty"`
+	SetBy      string    `json:"set_by,omitempty"`
+	SourceIP   string    `json:"source_ip,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// Metadata returns the metadata of r.
+func (r *Record) Metadata() Metadata {
+	return Metadata{
+		Hostname:   r.Credentials.Hostname,
+		Version:    r.Version,
+		Username:   r.Credentials.Username,
+		Model:      r.Credentials.Model,
+		Address:    r.Credentials.Address,
+		Action:     r.Action,
+		RollbackOf: r.RollbackOf,
+		SetBy:      r.SetBy,
+		SourceIP:   r.SourceIP,
+		Time:       r.Time,
+	}
+}
+
+// commit stores the credentials of r as the current credentials of their BMC
+// and records r as a new version. The caller holds p.mu.
+func (p *passwordStore) commit(ctx context.Context, provider Provider, r *Record) error {
+	bmcHost := r.Credentials.Hostname
+	history, err := provider.History(ctx, bmcHost)
+	if err != nil {
+		return fmt.Errorf("error while reading history: %v", err)
+	}
+	r.Version = 1
+	if len(history) > 0 {
+		r.Version = history[len(history)-1].Version + 1
+	}
+	r.Time = timeNow().UTC()
+
+	err = provider.AddCredentials(ctx, bmcHost, &r.Credentials)
+	if err != nil {
+		return fmt.Errorf("error while adding credentials: %v", err)
+	}
+
+	history = append(history, r)
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+	if err := provider.SetHistory(ctx, bmcHost, history); err != nil {
+		return fmt.Errorf("error while writing history: %v", err)
+	}
+	return nil
+}
+
+// History returns the metadata of the recorded versions of the credentials of
+// the target machine's BMC, oldest first.
+func (p *passwordStore) History(hostname string) ([]Metadata, error) {
+	parts, _, bmcHost, err := p.bmcHostname(hostname)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := p.backend(parts.Project)
+	if err != nil {
+		return nil, err
+	}
+	defer provider.Close()
+
+	history, err := provider.History(context.Background(), bmcHost)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading history: %v", err)
+	}
+	result := make([]Metadata, 0, len(history))
+	for _, r := range history {
+		result = append(result, r.Metadata())
+	}
+	return result, nil
+}
+
+// List returns the metadata of the current credentials of all BMCs in the
+// project. Credentials stored without history have version 0.
+func (p *passwordStore) List(project string) ([]Metadata, error) {
+	provider, err := p.backend(project)
+	if err != nil {
+		return nil, err
+	}
+	defer provider.Close()
+
+	ctx := context.Background()
+	list, err := provider.ListCredentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while listing credentials: %v", err)
+	}
+	result := make([]Metadata, 0, len(list))
+	for _, c := range list {
+		history, err := provider.History(ctx, c.Hostname)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading history: %v", err)
+		}
+		r := &Record{Credentials: *c}
+		if len(history) > 0 {
+			r = history[len(history)-1]
+		}
+		result = append(result, r.Metadata())
+	}
+	return result, nil
+}
+
+// Rollback makes the given version of the credentials of the target machine's
+// BMC current again, recording it as a new version.
+func (p *passwordStore) Rollback(hostname string, version int, setBy string, sourceIP string) (Metadata, error) {
+	parts, _, bmcHost, err := p.bmcHostname(hostname)
+	if err != nil {
+		return Metadata{}, err
+	}
+	provider, err := p.backend(parts.Project)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer provider.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx := context.Background()
+	history, err := provider.History(ctx, bmcHost)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error while reading history: %v", err)
+	}
+	var old *Record
+	for _, r := range history {
+		if r.Version == version {
+			old = r
+		}
+	}
+	if old == nil {
+		return Metadata{}, fmt.Errorf("%w: %s has no version %d", ErrVersionNotFound, bmcHost, version)
+	}
+
+	r := &Record{
+		Credentials: old.Credentials,
+		Action:      ActionRollback,
+		RollbackOf:  version,
+		SetBy:       setBy,
+		SourceIP:    sourceIP,
+	}
+	if err := p.commit(ctx, provider, r); err != nil {
+		return Metadata{}, err
+	}
+	return r.Metadata(), nil
+}
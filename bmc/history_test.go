@@ -0,0 +1,50 @@
+package bmc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/m-lab/epoxy-extensions/internal/resolver"
+	"github.com/m-lab/reboot-service/creds"
+)
+
+func Test_History(t *testing.T) {
+	resolver.LookupHost = func(host string) (addrs []string, err error) {
+		return []string{"192.168.0.1"}, nil
+	}
+	ps, err := NewStore("memory", Config{}, nil)
+	if err != nil {
+		t.Fatalf("NewStore(): %v", err)
+	}
+	hostname := "mlab1-foo01.mlab-oti.measurement-lab.org"
+	for i := 0; i < maxHistory+5; i++ {
+		if err := ps.Put(Request{Hostname: hostname, Password: "password"}); err != nil {
+			t.Fatalf("Put(): %v", err)
+		}
+	}
+
+	// Only the latest versions are kept.
+	history, err := ps.History(hostname)
+	if err != nil {
+		t.Fatalf("History(): %v", err)
+	}
+	if len(history) != maxHistory || history[0].Version != 6 || history[maxHistory-1].Version != maxHistory+5 {
+		t.Errorf("History() = versions %d to %d, want %d to %d",
+			history[0].Version, history[len(history)-1].Version, 6, maxHistory+5)
+	}
+	if _, err := ps.Rollback(hostname, 5, "operator:alice", ""); err == nil {
+		t.Errorf("Rollback(): expected error for dropped version")
+	}
+
+	// Credentials stored by other tools have no history.
+	provider, _ := ps.(*passwordStore).backend("mlab-oti")
+	other := &creds.Credentials{Hostname: "mlab2d-foo01.mlab-oti.measurement-lab.org"}
+	provider.AddCredentials(context.Background(), other.Hostname, other)
+	list, err := ps.List("mlab-oti")
+	if err != nil || len(list) != 2 {
+		t.Fatalf("List() = %v, %v; want 2 BMCs", list, err)
+	}
+	if list[0].Version != maxHistory+5 || list[1].Version != 0 || list[1].Hostname != other.Hostname {
+		t.Errorf("List() = %+v, want latest version and version 0", list)
+	}
+}
@@ -0,0 +1,211 @@
+package bmc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/m-lab/epoxy-extensions/internal/machine"
+	"github.com/m-lab/go/host"
+)
+
+// Supported BMC models.
+const (
+	ModelDRAC       = "DRAC"
+	ModelILO        = "iLO"
+	ModelSupermicro = "Supermicro"
+	ModelRedfish    = "Redfish"
+)
+
+// Models lists the supported BMC models.
+var Models = []string{ModelDRAC, ModelILO, ModelSupermicro, ModelRedfish}
+
+// ErrOverrideNotAllowed is returned by PasswordStore.Put when a requested
+// model or username override is not allowed for the machine.
+var ErrOverrideNotAllowed = errors.New("override not allowed")
+
+// DefaultMapping is used for machines that match no configured rule. It
+// describes the iDRACs of the original M-Lab fleet.
+var DefaultMapping = &Mapping{
+	Name:     "default",
+	Model:    ModelDRAC,
+	Username: "admin",
+}
+
+var bmcHostnameRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+
+// Mapping describes the BMCs of a class of machines.
+type Mapping struct {
+	Name string `json:"name"`
+	// HostnameTemplate is a text/template rendering the BMC hostname from a
+	// TemplateData. If empty, "d" is inserted after the machine name, e.g.
+	// mlab1-foo01.mlab-oti.measurement-lab.org has the BMC
+	// mlab1d-foo01.mlab-oti.measurement-lab.org.
+	HostnameTemplate string `json:"hostname_template,omitempty"`
+	Model            string `json:"model"`
+	Username         string `json:"username"`
+
+	// AllowedModels and AllowedUsernames list the values a request may use
+	// instead of Model and Username.
+	AllowedModels    []string `json:"allowed_models,omitempty"`
+	AllowedUsernames []string `json:"allowed_usernames,omitempty"`
+
+	tmpl *template.Template
+}
+
+// TemplateData is the data available to a Mapping's HostnameTemplate.
+type TemplateData struct {
+	host.Name
+	// Hostname is the full hostname of the machine.
+	Hostname string
+}
+
+// Override holds the model and username requested for a BMC. Empty fields
+// use the values of the machine's Mapping.
+type Override struct {
+	Model    string
+	Username string
+}
+
+// validate checks the mapping and compiles its hostname template.
+func (m *Mapping) validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("mapping has no name")
+	}
+	for _, model := range append([]string{m.Model}, m.AllowedModels...) {
+		if !slices.Contains(Models, model) {
+			return fmt.Errorf("mapping %q: unknown model %q, must be one of %v", m.Name, model, Models)
+		}
+	}
+	for _, u := range append([]string{m.Username}, m.AllowedUsernames...) {
+		if u == "" {
+			return fmt.Errorf("mapping %q: empty username", m.Name)
+		}
+	}
+	if m.HostnameTemplate != "" {
+		t, err := template.New(m.Name).Option("missingkey=error").Parse(m.HostnameTemplate)
+		if err != nil {
+			return fmt.Errorf("mapping %q: bad hostname_template: %v", m.Name, err)
+		}
+		m.tmpl = t
+		// Render an example to catch references to unknown fields.
+		example := "mlab1-foo01.mlab-oti.measurement-lab.org"
+		parts, _ := host.Parse(example)
+		if _, err := m.render(TemplateData{Name: parts, Hostname: example}); err != nil {
+			return fmt.Errorf("mapping %q: %v", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// render executes the hostname template and checks the result.
+func (m *Mapping) render(data TemplateData) (string, error) {
+	var b bytes.Buffer
+	if err := m.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("could not render BMC hostname: %v", err)
+	}
+	if !bmcHostnameRe.MatchString(b.String()) {
+		return "", fmt.Errorf("rendered BMC hostname is invalid: %q", b.String())
+	}
+	return b.String(), nil
+}
+
+// BMCHostname returns the hostname of the BMC of the machine with the given
+// parsed hostname.
+func (m *Mapping) BMCHostname(hostname string, parts host.Name) (string, error) {
+	if m.tmpl == nil {
+		return strings.Replace(hostname, parts.Machine, parts.Machine+"d", 1), nil
+	}
+	return m.render(TemplateData{Name: parts, Hostname: hostname})
+}
+
+// Apply returns the model and username to store for a request with the given
+// override, or ErrOverrideNotAllowed.
+func (m *Mapping) Apply(o Override) (model string, username string, err error) {
+	model, username = m.Model, m.Username
+	if o.Model != "" && o.Model != model {
+		if !slices.Contains(m.AllowedModels, o.Model) {
+			return "", "", fmt.Errorf("%w: model %q for mapping %q", ErrOverrideNotAllowed, o.Model, m.Name)
+		}
+		model = o.Model
+	}
+	if o.Username != "" && o.Username != username {
+		if !slices.Contains(m.AllowedUsernames, o.Username) {
+			return "", "", fmt.Errorf("%w: username %q for mapping %q", ErrOverrideNotAllowed, o.Username, m.Name)
+		}
+		username = o.Username
+	}
+	return model, username, nil
+}
+
+// MappingRule selects a Mapping for machines matching all of its non-empty
+// criteria.
+type MappingRule struct {
+	// Matcher matches machines by their site and hostname.
+	machine.Matcher
+	Mapping *Mapping `json:"mapping"`
+}
+
+// Mappings is the BMC mapping configuration. Rules are evaluated in order, and
+// the first matching rule determines the Mapping of a machine. Mappings must
+// not be modified once in use.
+type Mappings struct {
+	Default *Mapping       `json:"default,omitempty"`
+	Rules   []*MappingRule `json:"rules,omitempty"`
+}
+
+// Select returns the Mapping for the machine with the given hostname. It is
+// safe to call Select on a nil *Mappings, which always returns DefaultMapping.
+func (m *Mappings) Select(hostname string) *Mapping {
+	if m == nil {
+		return DefaultMapping
+	}
+	for _, r := range m.Rules {
+		if r.Matches(hostname) {
+			return r.Mapping
+		}
+	}
+	if m.Default != nil {
+		return m.Default
+	}
+	return DefaultMapping
+}
+
+// LoadMappings reads a JSON BMC mapping configuration from path. An empty path
+// returns a nil *Mappings, which selects DefaultMapping for all machines.
+func LoadMappings(path string) (*Mappings, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mappings{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("could not parse BMC mappings: %v", err)
+	}
+	if m.Default != nil {
+		if err := m.Default.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for i, r := range m.Rules {
+		if r.Mapping == nil {
+			return nil, fmt.Errorf("rule %d has no mapping", i)
+		}
+		if err := r.Mapping.validate(); err != nil {
+			return nil, err
+		}
+		if err := r.Compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,254 @@
+package bmc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/epoxy-extensions/internal/resolver"
+	"github.com/m-lab/go/host"
+)
+
+const testMappings = `{
+  "default": {
+    "name": "drac",
+    "model": "DRAC",
+    "username": "admin",
+    "allowed_models": ["Redfish"]
+  },
+  "rules": [
+    {
+      "sites": ["abc0t"],
+      "mapping": {
+        "name": "supermicro",
+        "hostname_template": "{{.Machine}}-bmc.{{.Site}}.{{.Project}}.{{.Domain}}",
+        "model": "Supermicro",
+        "username": "ADMIN",
+        "allowed_usernames": ["operator"]
+      }
+    },
+    {
+      "machine_pattern": "^mlab4-",
+      "mapping": {
+        "name": "ilo",
+        "hostname_template": "ilo-{{.Hostname}}",
+        "model": "iLO",
+        "username": "Administrator"
+      }
+    }
+  ]
+}`
+
+func writeMappings(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "mappings.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write mappings: %v", err)
+	}
+	return path
+}
+
+func Test_LoadMappings(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			content: testMappings,
+		},
+		{
+			name:    "failure-bad-json",
+			content: `{"rules": [`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-missing-mapping",
+			content: `{"rules": [{"sites": ["abc01"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-no-name",
+			content: `{"default": {"model": "DRAC", "username": "admin"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-unknown-model",
+			content: `{"default": {"name": "d", "model": "Toaster", "username": "admin"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-unknown-allowed-model",
+			content: `{"default": {"name": "d", "model": "DRAC", "username": "admin", "allowed_models": ["Toaster"]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-empty-username",
+			content: `{"default": {"name": "d", "model": "DRAC"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-template",
+			content: `{"default": {"name": "d", "model": "DRAC", "username": "admin", "hostname_template": "{{.Machine"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-unknown-template-field",
+			content: `{"default": {"name": "d", "model": "DRAC", "username": "admin", "hostname_template": "{{.Rack}}"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-machine-pattern",
+			content: `{"rules": [{"machine_pattern": "(", "mapping": {"name": "d", "model": "DRAC", "username": "admin"}}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadMappings(writeMappings(t, tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadMappings(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	m, err := LoadMappings("")
+	if m != nil || err != nil {
+		t.Errorf("LoadMappings(\"\") = %v, %v; want nil, nil", m, err)
+	}
+}
+
+func Test_Mappings(t *testing.T) {
+	m, err := LoadMappings(writeMappings(t, testMappings))
+	if err != nil {
+		t.Fatalf("LoadMappings(): %v", err)
+	}
+	tests := []struct {
+		name     string
+		hostname string
+		override Override
+		mapping  string
+		bmcHost  string
+		model    string
+		username string
+		wantErr  bool
+	}{
+		{
+			name:     "default",
+			hostname: "mlab1-foo01.mlab-oti.measurement-lab.org",
+			mapping:  "drac",
+			bmcHost:  "mlab1d-foo01.mlab-oti.measurement-lab.org",
+			model:    "DRAC",
+			username: "admin",
+		},
+		{
+			name:     "default-allowed-model-override",
+			hostname: "mlab1-foo01.mlab-oti.measurement-lab.org",
+			override: Override{Model: "Redfish"},
+			mapping:  "drac",
+			bmcHost:  "mlab1d-foo01.mlab-oti.measurement-lab.org",
+			model:    "Redfish",
+			username: "admin",
+		},
+		{
+			name:     "default-username-override-not-allowed",
+			hostname: "mlab1-foo01.mlab-oti.measurement-lab.org",
+			override: Override{Username: "root"},
+			mapping:  "drac",
+			bmcHost:  "mlab1d-foo01.mlab-oti.measurement-lab.org",
+			wantErr:  true,
+		},
+		{
+			name:     "site",
+			hostname: "mlab2-abc0t.mlab-sandbox.measurement-lab.org",
+			override: Override{Username: "operator"},
+			mapping:  "supermicro",
+			bmcHost:  "mlab2-bmc.abc0t.mlab-sandbox.measurement-lab.org",
+			model:    "Supermicro",
+			username: "operator",
+		},
+		{
+			name:     "machine-pattern",
+			hostname: "mlab4-foo01.mlab-oti.measurement-lab.org",
+			override: Override{Model: "iLO", Username: "Administrator"},
+			mapping:  "ilo",
+			bmcHost:  "ilo-mlab4-foo01.mlab-oti.measurement-lab.org",
+			model:    "iLO",
+			username: "Administrator",
+		},
+		{
+			name:     "machine-pattern-model-override-not-allowed",
+			hostname: "mlab4-foo01.mlab-oti.measurement-lab.org",
+			override: Override{Model: "DRAC"},
+			mapping:  "ilo",
+			bmcHost:  "ilo-mlab4-foo01.mlab-oti.measurement-lab.org",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, err := host.Parse(tt.hostname)
+			if err != nil {
+				t.Fatalf("host.Parse(): %v", err)
+			}
+			mapping := m.Select(tt.hostname)
+			if mapping.Name != tt.mapping {
+				t.Errorf("Select() = %q, want %q", mapping.Name, tt.mapping)
+			}
+			bmcHost, err := mapping.BMCHostname(tt.hostname, parts)
+			if err != nil || bmcHost != tt.bmcHost {
+				t.Errorf("BMCHostname() = %q, %v; want %q", bmcHost, err, tt.bmcHost)
+			}
+			model, username, err := mapping.Apply(tt.override)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Apply(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrOverrideNotAllowed) {
+					t.Errorf("Apply(): error = %v, want ErrOverrideNotAllowed", err)
+				}
+				return
+			}
+			if model != tt.model || username != tt.username {
+				t.Errorf("Apply() = %q, %q; want %q, %q", model, username, tt.model, tt.username)
+			}
+		})
+	}
+
+	var nilMappings *Mappings
+	if got := nilMappings.Select("mlab1-foo01.mlab-oti.measurement-lab.org"); got != DefaultMapping {
+		t.Errorf("Select() on nil Mappings = %v, want DefaultMapping", got)
+	}
+}
+
+func Test_PutWithMappings(t *testing.T) {
+	m, err := LoadMappings(writeMappings(t, testMappings))
+	if err != nil {
+		t.Fatalf("LoadMappings(): %v", err)
+	}
+	resolver.LookupHost = func(host string) (addrs []string, err error) {
+		return []string{"192.168.0.1"}, nil
+	}
+	ps, err := NewStore("memory", Config{}, m)
+	if err != nil {
+		t.Fatalf("NewStore(): %v", err)
+	}
+
+	hostname := "mlab2-abc0t.mlab-sandbox.measurement-lab.org"
+	if err := ps.Put(Request{Hostname: hostname, Password: "password", Override: Override{Username: "operator"}}); err != nil {
+		t.Fatalf("Put(): %v", err)
+	}
+	c, err := ps.Get(hostname)
+	if err != nil {
+		t.Fatalf("Get(): %v", err)
+	}
+	if c.Hostname != "mlab2-bmc.abc0t.mlab-sandbox.measurement-lab.org" || c.Model != "Supermicro" || c.Username != "operator" {
+		t.Errorf("Get() = %v, want Supermicro credentials for operator", c)
+	}
+
+	err = ps.Put(Request{Hostname: hostname, Password: "password", Override: Override{Model: "DRAC"}})
+	if !errors.Is(err, ErrOverrideNotAllowed) {
+		t.Errorf("Put() = %v, want ErrOverrideNotAllowed", err)
+	}
+}
@@ -0,0 +1,107 @@
+package bmc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/m-lab/reboot-service/creds"
+)
+
+// memoryProvider implements Provider with in-memory maps. It is meant for
+// testing and for environments without persistent storage.
+type memoryProvider struct {
+	mu      sync.Mutex
+	creds   map[string]creds.Credentials
+	history map[string][]Record
+}
+
+// newMemoryBackend returns a Backend keeping credentials in memory, separately
+// for each project.
+func newMemoryBackend() Backend {
+	var mu sync.Mutex
+	projects := map[string]*memoryProvider{}
+	return func(project string) (Provider, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		p, ok := projects[project]
+		if !ok {
+			p = &memoryProvider{
+				creds:   map[string]creds.Credentials{},
+				history: map[string][]Record{},
+			}
+			projects[project] = p
+		}
+		return p, nil
+	}
+}
+
+// ListCredentials returns all credentials, sorted by hostname.
+func (m *memoryProvider) ListCredentials(ctx context.Context) ([]*creds.Credentials, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*creds.Credentials, 0, len(m.creds))
+	for _, c := range m.creds {
+		c := c
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Hostname < list[j].Hostname })
+	return list, nil
+}
+
+// FindCredentials returns a copy of the credentials for host.
+func (m *memoryProvider) FindCredentials(ctx context.Context, host string) (*creds.Credentials, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.creds[host]
+	if !ok {
+		return nil, fmt.Errorf("hostname not found: %s", host)
+	}
+	return &c, nil
+}
+
+// AddCredentials stores a copy of c for host, replacing existing credentials.
+func (m *memoryProvider) AddCredentials(ctx context.Context, host string, c *creds.Credentials) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.creds[host] = *c
+	return nil
+}
+
+// DeleteCredentials removes the credentials for host, if any.
+func (m *memoryProvider) DeleteCredentials(ctx context.Context, host string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.creds, host)
+	return nil
+}
+
+// History returns copies of the recorded versions of the credentials of host.
+func (m *memoryProvider) History(ctx context.Context, host string) ([]*Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := make([]*Record, 0, len(m.history[host]))
+	for _, r := range m.history[host] {
+		r := r
+		records = append(records, &r)
+	}
+	return records, nil
+}
+
+// SetHistory stores copies of records as the history of host.
+func (m *memoryProvider) SetHistory(ctx context.Context, host string, records []*Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	history := make([]Record, 0, len(records))
+	for _, r := range records {
+		history = append(history, *r)
+	}
+	m.history[host] = history
+	return nil
+}
+
+// Close does nothing, since the credentials must outlive the provider.
+func (m *memoryProvider) Close() error {
+	return nil
+}
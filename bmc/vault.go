@@ -0,0 +1,218 @@
+package bmc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/m-lab/reboot-service/creds"
+)
+
+const (
+	defaultVaultMount  = "secret"
+	defaultVaultPrefix = "reboot-api"
+)
+
+// errVaultNotFound is returned by vaultClient.do when Vault answers 404.
+var errVaultNotFound = errors.New("not found in vault")
+
+// vaultClient talks to the HTTP API of a HashiCorp Vault KV version 2 secrets
+// engine.
+type vaultClient struct {
+	address string
+	token   string
+	mount   string
+	prefix  string
+	client  *http.Client
+}
+
+// newVaultBackend returns a Backend storing credentials in Vault, at
+// <mount>/<prefix>/<project>/<bmc hostname>, and their history at
+// <mount>/<prefix>-history/<project>/<bmc hostname>.
+func newVaultBackend(cfg Config) (Backend, error) {
+	if cfg.VaultAddress == "" || cfg.VaultToken == "" {
+		return nil, errors.New("the vault backend requires an address and a token")
+	}
+	if _, err := url.Parse(cfg.VaultAddress); err != nil {
+		return nil, fmt.Errorf("invalid vault address: %v", err)
+	}
+	v := &vaultClient{
+		address: strings.TrimSuffix(cfg.VaultAddress, "/"),
+		token:   cfg.VaultToken,
+		mount:   strings.Trim(cfg.VaultMount, "/"),
+		prefix:  strings.Trim(cfg.VaultPrefix, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if v.mount == "" {
+		v.mount = defaultVaultMount
+	}
+	if v.prefix == "" {
+		v.prefix = defaultVaultPrefix
+	}
+	return func(project string) (Provider, error) {
+		if project == "" || strings.Contains(project, "/") {
+			return nil, fmt.Errorf("invalid project: %q", project)
+		}
+		return &vaultProvider{client: v, project: project}, nil
+	}, nil
+}
+
+// do sends a request for the given KV v2 API (either "data" or "metadata")
+// and path below the mount, and decodes the response into out, when not nil.
+func (v *vaultClient) do(ctx context.Context, method, api, p string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	u := v.address + "/v1/" + path.Join(v.mount, api, p)
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errVaultNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(e.Errors, "; "))
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// vaultProvider implements Provider for one project in Vault.
+type vaultProvider struct {
+	client  *vaultClient
+	project string
+}
+
+// path returns the path of the credentials of host, or of the project if host
+// is empty.
+func (p *vaultProvider) path(host string) string {
+	return path.Join(p.client.prefix, p.project, host)
+}
+
+// historyPath returns the path of the history of host.
+func (p *vaultProvider) historyPath(host string) string {
+	return path.Join(p.client.prefix+"-history", p.project, host)
+}
+
+// ListCredentials returns all credentials of the project.
+func (p *vaultProvider) ListCredentials(ctx context.Context) ([]*creds.Credentials, error) {
+	var list struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	err := p.client.do(ctx, "LIST", "metadata", p.path(""), nil, &list)
+	if errors.Is(err, errVaultNotFound) {
+		return []*creds.Credentials{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*creds.Credentials, 0, len(list.Data.Keys))
+	for _, key := range list.Data.Keys {
+		if strings.HasSuffix(key, "/") {
+			continue
+		}
+		c, err := p.FindCredentials(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// FindCredentials returns the credentials for host.
+func (p *vaultProvider) FindCredentials(ctx context.Context, host string) (*creds.Credentials, error) {
+	var secret struct {
+		Data struct {
+			Data *creds.Credentials `json:"data"`
+		} `json:"data"`
+	}
+	err := p.client.do(ctx, http.MethodGet, "data", p.path(host), nil, &secret)
+	if errors.Is(err, errVaultNotFound) || (err == nil && secret.Data.Data == nil) {
+		return nil, fmt.Errorf("hostname not found: %s", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data.Data, nil
+}
+
+// AddCredentials writes a new version of the credentials for host.
+func (p *vaultProvider) AddCredentials(ctx context.Context, host string, c *creds.Credentials) error {
+	in := map[string]interface{}{"data": c}
+	return p.client.do(ctx, http.MethodPost, "data", p.path(host), in, nil)
+}
+
+// DeleteCredentials removes all versions of the credentials for host.
+func (p *vaultProvider) DeleteCredentials(ctx context.Context, host string) error {
+	err := p.client.do(ctx, http.MethodDelete, "metadata", p.path(host), nil, nil)
+	if errors.Is(err, errVaultNotFound) {
+		return nil
+	}
+	return err
+}
+
+// History returns the recorded versions of the credentials of host.
+func (p *vaultProvider) History(ctx context.Context, host string) ([]*Record, error) {
+	var secret struct {
+		Data struct {
+			Data struct {
+				Records []*Record `json:"records"`
+			} `json:"data"`
+		} `json:"data"`
+	}
+	err := p.client.do(ctx, http.MethodGet, "data", p.historyPath(host), nil, &secret)
+	if errors.Is(err, errVaultNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data.Data.Records, nil
+}
+
+// SetHistory writes a new version of the history of host.
+func (p *vaultProvider) SetHistory(ctx context.Context, host string, records []*Record) error {
+	in := map[string]interface{}{
+		"data": map[string]interface{}{"records": records},
+	}
+	return p.client.do(ctx, http.MethodPost, "data", p.historyPath(host), in, nil)
+}
+
+// Close does nothing, since the HTTP client is shared by all providers.
+func (p *vaultProvider) Close() error {
+	return nil
+}
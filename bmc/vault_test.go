@@ -0,0 +1,141 @@
+package bmc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/m-lab/reboot-service/creds"
+)
+
+// fakeVault implements the subset of the Vault KV v2 HTTP API used by
+// vaultProvider, for the "secret" mount.
+type fakeVault struct {
+	mu      sync.Mutex
+	token   string
+	secrets map[string]json.RawMessage
+}
+
+func newFakeVault(t *testing.T, token string) *httptest.Server {
+	v := &fakeVault{token: token, secrets: map[string]json.RawMessage{}}
+	srv := httptest.NewServer(v)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if r.Header.Get("X-Vault-Token") != v.token {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors": ["permission denied"]}`))
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := v.secrets[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"data": {"data": ` + string(data) + `}}`))
+		case http.MethodPost:
+			var in struct {
+				Data json.RawMessage `json:"data"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			v.secrets[key] = in.Data
+			w.Write([]byte(`{"data": {"version": 1}}`))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")
+		switch r.Method {
+		case "LIST":
+			keys := []string{}
+			for k := range v.secrets {
+				if strings.HasPrefix(k, key+"/") {
+					keys = append(keys, strings.TrimPrefix(k, key+"/"))
+				}
+			}
+			if len(keys) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			sort.Strings(keys)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"keys": keys},
+			})
+		case http.MethodDelete:
+			delete(v.secrets, key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func Test_vaultProvider(t *testing.T) {
+	srv := newFakeVault(t, "s3cr3t")
+	backend, err := newVaultBackend(Config{VaultAddress: srv.URL + "/", VaultToken: "s3cr3t"})
+	if err != nil {
+		t.Fatalf("newVaultBackend(): %v", err)
+	}
+	p, err := backend("mlab-oti")
+	if err != nil {
+		t.Fatalf("backend(): %v", err)
+	}
+	ctx := context.Background()
+
+	list, err := p.ListCredentials(ctx)
+	if err != nil || len(list) != 0 {
+		t.Errorf("ListCredentials() = %v, %v; want empty list", list, err)
+	}
+	for _, h := range []string{"mlab2d-foo01", "mlab1d-foo01"} {
+		if err := p.AddCredentials(ctx, h, &creds.Credentials{Hostname: h}); err != nil {
+			t.Fatalf("AddCredentials(): %v", err)
+		}
+	}
+	list, err = p.ListCredentials(ctx)
+	if err != nil || len(list) != 2 || list[0].Hostname != "mlab1d-foo01" {
+		t.Errorf("ListCredentials() = %v, %v; want two credentials", list, err)
+	}
+	if err := p.DeleteCredentials(ctx, "mlab1d-foo01"); err != nil {
+		t.Errorf("DeleteCredentials(): %v", err)
+	}
+	if _, err := p.FindCredentials(ctx, "mlab1d-foo01"); err == nil {
+		t.Errorf("FindCredentials(): expected error after delete")
+	}
+	if err := p.DeleteCredentials(ctx, "mlab1d-foo01"); err != nil {
+		t.Errorf("DeleteCredentials(): unexpected error for missing host: %v", err)
+	}
+
+	if _, err := backend(""); err == nil {
+		t.Errorf("backend(): expected error for empty project")
+	}
+
+	// A wrong token is reported with the error returned by Vault.
+	backend, err = newVaultBackend(Config{VaultAddress: srv.URL, VaultToken: "wrong"})
+	if err != nil {
+		t.Fatalf("newVaultBackend(): %v", err)
+	}
+	p, _ = backend("mlab-oti")
+	err = p.AddCredentials(ctx, "mlab1d-foo01", &creds.Credentials{})
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("AddCredentials() = %v, want permission denied", err)
+	}
+}
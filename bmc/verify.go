@@ -0,0 +1,138 @@
+package bmc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/metrics"
+	"github.com/m-lab/reboot-service/creds"
+)
+
+const redfishSessionsPath = "/redfish/v1/SessionService/Sessions"
+
+var (
+	// ErrVerificationFailed is returned by PasswordStore.Put when the BMC
+	// rejected the credentials.
+	ErrVerificationFailed = errors.New("BMC verification failed")
+	// ErrBMCUnavailable is returned by PasswordStore.Put when the credentials
+	// could not be verified, because the BMC could not be reached or did not
+	// answer as expected.
+	ErrBMCUnavailable = errors.New("BMC unavailable")
+)
+
+// Verifier checks credentials against the BMC they belong to.
+type Verifier interface {
+	// Verify returns an error wrapping ErrVerificationFailed if the BMC does
+	// not accept c, or ErrBMCUnavailable if the BMC could not be asked.
+	Verify(ctx context.Context, c *creds.Credentials) error
+}
+
+// RedfishVerifier verifies credentials by creating, and then deleting, a
+// Redfish session on the BMC.
+type RedfishVerifier struct {
+	// Client is the HTTP client used to talk to BMCs.
+	Client *http.Client
+	// Scheme and Port of the Redfish endpoint. An empty Scheme means https,
+	// and an empty Port the default port of the scheme.
+	Scheme string
+	Port   string
+}
+
+// NewRedfishVerifier returns a RedfishVerifier talking to BMCs over HTTPS.
+// BMCs usually have self-signed certificates, which are only accepted if
+// insecure is true.
+func NewRedfishVerifier(timeout time.Duration, insecure bool) *RedfishVerifier {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecure}
+	return &RedfishVerifier{
+		Client: &http.Client{Timeout: timeout, Transport: transport},
+	}
+}
+
+// endpoint returns the base URL of the Redfish service at address.
+func (r *RedfishVerifier) endpoint(address string) string {
+	scheme := r.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	host := address
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		host = "[" + address + "]"
+	}
+	if r.Port != "" {
+		host = net.JoinHostPort(address, r.Port)
+	}
+	return scheme + "://" + host
+}
+
+// Verify logs into the Redfish service of the BMC at c.Address.
+func (r *RedfishVerifier) Verify(ctx context.Context, c *creds.Credentials) error {
+	err := r.verify(ctx, c)
+	switch {
+	case err == nil:
+		metrics.BMCVerifications.WithLabelValues("success").Inc()
+	case errors.Is(err, ErrVerificationFailed):
+		metrics.BMCVerifications.WithLabelValues("rejected").Inc()
+	default:
+		metrics.BMCVerifications.WithLabelValues("error").Inc()
+		err = fmt.Errorf("%w: %s: %v", ErrBMCUnavailable, c.Hostname, err)
+	}
+	return err
+}
+
+func (r *RedfishVerifier) verify(ctx context.Context, c *creds.Credentials) error {
+	base := r.endpoint(c.Address)
+	body, err := json.Marshal(map[string]string{
+		"UserName": c.Username,
+		"Password": c.Password,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+redfishSessionsPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: %s rejected the credentials of %s", ErrVerificationFailed, c.Hostname, c.Username)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("unexpected response from Redfish: %s", resp.Status)
+	}
+
+	// Log out again, so that verification does not exhaust the BMC's
+	// sessions. Failing to do so does not fail the verification.
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	if location[0] == '/' {
+		location = base + location
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodDelete, location, nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("X-Auth-Token", resp.Header.Get("X-Auth-Token"))
+	if resp, err := r.Client.Do(req); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return nil
+}
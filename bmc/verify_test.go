@@ -0,0 +1,186 @@
+package bmc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/internal/resolver"
+	"github.com/m-lab/epoxy-extensions/metrics"
+	"github.com/m-lab/reboot-service/creds"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeRedfish implements the Redfish session service of a BMC.
+type fakeRedfish struct {
+	mu       sync.Mutex
+	username string
+	password string
+	status   int
+	sessions map[string]bool
+}
+
+func (f *fakeRedfish) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == redfishSessionsPath:
+		var login struct {
+			UserName string
+			Password string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if login.UserName != f.username || login.Password != f.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.sessions["1"] = true
+		w.Header().Set("Location", redfishSessionsPath+"/1")
+		w.Header().Set("X-Auth-Token", "token1")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete && r.URL.Path == redfishSessionsPath+"/1":
+		if r.Header.Get("X-Auth-Token") != "token1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		delete(f.sessions, "1")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newFakeRedfish starts a fake BMC accepting username and password, and
+// returns it with a RedfishVerifier talking to it.
+func newFakeRedfish(t *testing.T, username, password string) (*fakeRedfish, *RedfishVerifier) {
+	f := &fakeRedfish{username: username, password: password, sessions: map[string]bool{}}
+	srv := httptest.NewTLSServer(f)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	v := NewRedfishVerifier(time.Second, true)
+	v.Port = u.Port()
+	return f, v
+}
+
+func Test_RedfishVerifier(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		status   int
+		result   string
+		wantErr  error
+	}{
+		{
+			name:     "success",
+			password: "password",
+			result:   "success",
+		},
+		{
+			name:     "failure-wrong-password",
+			password: "passwor",
+			result:   "rejected",
+			wantErr:  ErrVerificationFailed,
+		},
+		{
+			name:     "failure-server-error",
+			password: "password",
+			status:   http.StatusInternalServerError,
+			result:   "error",
+			wantErr:  ErrBMCUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, v := newFakeRedfish(t, "admin", "password")
+			f.mu.Lock()
+			f.status = tt.status
+			f.mu.Unlock()
+			before := testutil.ToFloat64(metrics.BMCVerifications.WithLabelValues(tt.result))
+
+			c := &creds.Credentials{Hostname: "mlab1d-foo01", Address: "127.0.0.1", Username: "admin", Password: tt.password}
+			err := v.Verify(context.Background(), c)
+			if !errors.Is(err, tt.wantErr) || (err != nil) != (tt.wantErr != nil) {
+				t.Fatalf("Verify(): error = %v, want %v", err, tt.wantErr)
+			}
+			f.mu.Lock()
+			if len(f.sessions) != 0 {
+				t.Errorf("Verify(): left %d sessions open", len(f.sessions))
+			}
+			f.mu.Unlock()
+			after := testutil.ToFloat64(metrics.BMCVerifications.WithLabelValues(tt.result))
+			if after != before+1 {
+				t.Errorf("bmc_verifications_total{result=%q} = %v, want %v", tt.result, after, before+1)
+			}
+		})
+	}
+
+	// Self-signed certificates are rejected unless verification is insecure.
+	_, v := newFakeRedfish(t, "admin", "password")
+	secure := NewRedfishVerifier(time.Second, false)
+	secure.Port = v.Port
+	err := secure.Verify(context.Background(), &creds.Credentials{Address: "127.0.0.1", Username: "admin", Password: "password"})
+	if !errors.Is(err, ErrBMCUnavailable) {
+		t.Errorf("Verify() = %v, want ErrBMCUnavailable for untrusted certificate", err)
+	}
+
+	// Unreachable BMCs are not reported as rejecting the credentials.
+	v = NewRedfishVerifier(time.Second, true)
+	v.Scheme, v.Port = "http", "1"
+	err = v.Verify(context.Background(), &creds.Credentials{Address: "127.0.0.1", Username: "admin", Password: "password"})
+	if !errors.Is(err, ErrBMCUnavailable) || errors.Is(err, ErrVerificationFailed) {
+		t.Errorf("Verify() = %v, want ErrBMCUnavailable for unreachable BMC", err)
+	}
+}
+
+func Test_RedfishVerifier_endpoint(t *testing.T) {
+	v := &RedfishVerifier{}
+	if got := v.endpoint("192.168.0.1"); got != "https://192.168.0.1" {
+		t.Errorf("endpoint() = %q", got)
+	}
+	if got := v.endpoint("2001:db8::1"); got != "https://[2001:db8::1]" {
+		t.Errorf("endpoint() = %q", got)
+	}
+	v = &RedfishVerifier{Scheme: "http", Port: "8000"}
+	if got := v.endpoint("2001:db8::1"); got != "http://[2001:db8::1]:8000" {
+		t.Errorf("endpoint() = %q", got)
+	}
+}
+
+func Test_PutWithVerifier(t *testing.T) {
+	resolver.LookupHost = func(host string) (addrs []string, err error) {
+		return []string{"127.0.0.1"}, nil
+	}
+	_, v := newFakeRedfish(t, "admin", "password")
+	ps, err := NewStore("memory", Config{Verifier: v}, nil)
+	if err != nil {
+		t.Fatalf("NewStore(): %v", err)
+	}
+	hostname := "mlab1-foo01.mlab-oti.measurement-lab.org"
+
+	err = ps.Put(Request{Hostname: hostname, Password: "wrong"})
+	if !errors.Is(err, ErrVerificationFailed) {
+		t.Errorf("Put() = %v, want ErrVerificationFailed", err)
+	}
+	if _, err := ps.Get(hostname); err == nil {
+		t.Errorf("Get(): unverified credentials were stored")
+	}
+	if err := ps.Put(Request{Hostname: hostname, Password: "password"}); err != nil {
+		t.Errorf("Put(): %v", err)
+	}
+	if c, err := ps.Get(hostname); err != nil || c.Password != "password" {
+		t.Errorf("Get() = %v, %v; want verified credentials", c, err)
+	}
+}
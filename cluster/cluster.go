@@ -0,0 +1,183 @@
+// Package cluster routes token and node requests to the platform cluster of
+// the requesting machine, so that a single deployment can serve several
+// clusters, e.g. one per project.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/m-lab/epoxy-extensions/node"
+	"github.com/m-lab/epoxy-extensions/token"
+	"github.com/m-lab/go/host"
+)
+
+// ErrUnknownCluster is returned for machines that belong to no cluster of a
+// Registry.
+var ErrUnknownCluster = errors.New("unknown cluster")
+
+// Cluster is a platform cluster, with the managers of its tokens and nodes.
+type Cluster struct {
+	Name   string
+	Tokens token.Manager
+	Nodes  node.Manager
+}
+
+// Registry selects the Cluster of a machine by the site or project of its
+// hostname. Sites take precedence over projects. A Registry must not be
+// modified once in use.
+type Registry struct {
+	// Default serves the machines that match no cluster. If nil, their
+	// requests are rejected with ErrUnknownCluster.
+	Default *Cluster
+
+	clusters []*Cluster
+	projects map[string]*Cluster
+	sites    map[string]*Cluster
+}
+
+// NewRegistry returns an empty *Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		projects: map[string]*Cluster{},
+		sites:    map[string]*Cluster{},
+	}
+}
+
+// Add adds a cluster serving the machines of the given projects and sites. A
+// project or site may belong to a single cluster.
+func (r *Registry) Add(c *Cluster, projects []string, sites []string) error {
+	if len(projects) == 0 && len(sites) == 0 {
+		return fmt.Errorf("cluster %q has no projects or sites", c.Name)
+	}
+	for _, p := range projects {
+		if other, ok := r.projects[p]; ok {
+			return fmt.Errorf("project %q belongs to clusters %q and %q", p, other.Name, c.Name)
+		}
+	}
+	for _, s := range sites {
+		if other, ok := r.sites[s]; ok {
+			return fmt.Errorf("site %q belongs to clusters %q and %q", s, other.Name, c.Name)
+		}
+	}
+	for _, p := range projects {
+		r.projects[p] = c
+	}
+	for _, s := range sites {
+		r.sites[s] = c
+	}
+	r.clusters = append(r.clusters, c)
+	return nil
+}
+
+// Clusters returns all clusters of the registry, including Default.
+func (r *Registry) Clusters() []*Cluster {
+	clusters := append([]*Cluster(nil), r.clusters...)
+	if r.Default != nil {
+		clusters = append(clusters, r.Default)
+	}
+	return clusters
+}
+
+// Lookup returns the Cluster of the machine with the given hostname, or
+// ErrUnknownCluster.
+func (r *Registry) Lookup(hostname string) (*Cluster, error) {
+	parts, err := host.Parse(hostname)
+	if err == nil {
+		if c, ok := r.sites[parts.Site]; ok {
+			return c, nil
+		}
+		if c, ok := r.projects[parts.Project]; ok {
+			return c, nil
+		}
+	}
+	if r.Default != nil {
+		return r.Default, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownCluster, err)
+	}
+	return nil, fmt.Errorf("%w: no cluster for site %q or project %q", ErrUnknownCluster, parts.Site, parts.Project)
+}
+
+// Tokens returns a token.Manager creating the tokens of each machine in its
+// cluster.
+func (r *Registry) Tokens() token.Manager {
+	return &tokenRouter{registry: r}
+}
+
+// Nodes returns a node.Manager managing the node of each machine in its
+// cluster.
+func (r *Registry) Nodes() node.Manager {
+	return &nodeRouter{registry: r}
+}
+
+// tokenRouter implements the token.Manager interface by routing requests to
+// the cluster of the requesting machine.
+type tokenRouter struct {
+	registry *Registry
+}
+
+func (t *tokenRouter) Create(ctx context.Context, req token.Request) (token.Details, error) {
+	c, err := t.registry.Lookup(req.Hostname)
+	if err != nil {
+		return token.Details{}, err
+	}
+	return c.Tokens.Create(ctx, req)
+}
+
+// nodeRouter implements the node.Manager interface by routing operations to
+// the cluster of the target node.
+type nodeRouter struct {
+	registry *Registry
+}
+
+// manager returns the node.Manager of the cluster of target.
+func (n *nodeRouter) manager(target string) (node.Manager, error) {
+	c, err := n.registry.Lookup(target)
+	if err != nil {
+		return nil, err
+	}
+	return c.Nodes, nil
+}
+
+func (n *nodeRouter) Delete(ctx context.Context, target string) error {
+	m, err := n.manager(target)
+	if err != nil {
+		return err
+	}
+	return m.Delete(ctx, target)
+}
+
+func (n *nodeRouter) Cordon(ctx context.Context, target string) error {
+	m, err := n.manager(target)
+	if err != nil {
+		return err
+	}
+	return m.Cordon(ctx, target)
+}
+
+func (n *nodeRouter) Uncordon(ctx context.Context, target string) error {
+	m, err := n.manager(target)
+	if err != nil {
+		return err
+	}
+	return m.Uncordon(ctx, target)
+}
+
+func (n *nodeRouter) Label(ctx context.Context, target string, changes []string) error {
+	m, err := n.manager(target)
+	if err != nil {
+		return err
+	}
+	return m.Label(ctx, target, changes)
+}
+
+func (n *nodeRouter) Taint(ctx context.Context, target string, changes []string) error {
+	m, err := n.manager(target)
+	if err != nil {
+		return err
+	}
+	return m.Taint(ctx, target, changes)
+}
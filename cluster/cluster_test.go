@@ -0,0 +1,264 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/m-lab/epoxy-extensions/node"
+	"github.com/m-lab/epoxy-extensions/token"
+)
+
+// fakeTokens records the hostnames it creates tokens for.
+type fakeTokens struct {
+	hosts []string
+}
+
+func (f *fakeTokens) Create(ctx context.Context, req token.Request) (token.Details, error) {
+	f.hosts = append(f.hosts, req.Hostname)
+	return token.Details{Token: "abcdef.0123456789abcdef"}, nil
+}
+
+// fakeNodes records the operations it runs.
+type fakeNodes struct {
+	ops []string
+}
+
+func (f *fakeNodes) run(op string, target string) error {
+	f.ops = append(f.ops, op+" "+target)
+	return nil
+}
+
+func (f *fakeNodes) Delete(ctx context.Context, target string) error {
+	return f.run("delete", target)
+}
+func (f *fakeNodes) Cordon(ctx context.Context, target string) error {
+	return f.run("cordon", target)
+}
+func (f *fakeNodes) Uncordon(ctx context.Context, target string) error {
+	return f.run("uncordon", target)
+}
+func (f *fakeNodes) Label(ctx context.Context, target string, changes []string) error {
+	return f.run("label", target)
+}
+func (f *fakeNodes) Taint(ctx context.Context, target string, changes []string) error {
+	return f.run("taint", target)
+}
+
+func newTestRegistry(t *testing.T) *Registry {
+	r := NewRegistry()
+	for _, c := range []struct {
+		name     string
+		projects []string
+		sites    []string
+	}{
+		{name: "sandbox", projects: []string{"mlab-sandbox"}},
+		{name: "production", projects: []string{"mlab-oti"}, sites: []string{"abc0t"}},
+	} {
+		cluster := &Cluster{Name: c.name, Tokens: &fakeTokens{}, Nodes: &fakeNodes{}}
+		if err := r.Add(cluster, c.projects, c.sites); err != nil {
+			t.Fatalf("Add(%q): %v", c.name, err)
+		}
+	}
+	return r
+}
+
+func Test_RegistryAdd(t *testing.T) {
+	tests := []struct {
+		name     string
+		projects []string
+		sites    []string
+		wantErr  bool
+	}{
+		{
+			name:     "success",
+			projects: []string{"mlab-staging"},
+		},
+		{
+			name:     "failure-duplicate-project",
+			projects: []string{"mlab-staging", "mlab-oti"},
+			wantErr:  true,
+		},
+		{
+			name:    "failure-duplicate-site",
+			sites:   []string{"abc0t"},
+			wantErr: true,
+		},
+		{
+			name:    "failure-empty",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			err := r.Add(&Cluster{Name: "staging"}, tt.projects, tt.sites)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Add(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+			want := 3
+			if tt.wantErr {
+				want = 2
+				// A rejected cluster must not claim any of its projects.
+				if c, err := r.Lookup("mlab1-foo01.mlab-staging.measurement-lab.org"); err == nil {
+					t.Errorf("Lookup() = %q after a failed Add()", c.Name)
+				}
+			}
+			if got := len(r.Clusters()); got != want {
+				t.Errorf("Clusters() returned %d clusters, want %d", got, want)
+			}
+		})
+	}
+}
+
+func Test_RegistryLookup(t *testing.T) {
+	tests := []struct {
+		name        string
+		hostname    string
+		withDefault bool
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:     "success-project",
+			hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+			want:     "sandbox",
+		},
+		{
+			name:     "success-site-before-project",
+			hostname: "mlab1-abc0t.mlab-sandbox.measurement-lab.org",
+			want:     "production",
+		},
+		{
+			name:     "success-mig-instance",
+			hostname: "mlab1-foo01.mlab-oti.measurement-lab.org-d9h6",
+			want:     "production",
+		},
+		{
+			name:     "failure-unknown-project",
+			hostname: "mlab1-foo01.mlab-staging.measurement-lab.org",
+			wantErr:  true,
+		},
+		{
+			name:     "failure-bad-hostname",
+			hostname: "localhost",
+			wantErr:  true,
+		},
+		{
+			name:        "success-default",
+			hostname:    "mlab1-foo01.mlab-staging.measurement-lab.org",
+			withDefault: true,
+			want:        "default",
+		},
+		{
+			name:        "success-default-bad-hostname",
+			hostname:    "localhost",
+			withDefault: true,
+			want:        "default",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			if tt.withDefault {
+				r.Default = &Cluster{Name: "default"}
+			}
+			c, err := r.Lookup(tt.hostname)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Lookup(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrUnknownCluster) {
+					t.Errorf("Lookup(): error = %v, want %v", err, ErrUnknownCluster)
+				}
+				return
+			}
+			if c.Name != tt.want {
+				t.Errorf("Lookup() = %q, want %q", c.Name, tt.want)
+			}
+		})
+	}
+}
+
+func Test_RegistryTokens(t *testing.T) {
+	r := newTestRegistry(t)
+	tokens := r.Tokens()
+	ctx := context.Background()
+
+	if _, err := tokens.Create(ctx, token.Request{Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org"}); err != nil {
+		t.Fatalf("Create(): unexpected error: %v", err)
+	}
+	_, err := tokens.Create(ctx, token.Request{Hostname: "mlab1-foo01.mlab-staging.measurement-lab.org"})
+	if !errors.Is(err, ErrUnknownCluster) {
+		t.Errorf("Create() for an unknown project: error = %v, want %v", err, ErrUnknownCluster)
+	}
+
+	sandbox, _ := r.Lookup("mlab1-foo01.mlab-sandbox.measurement-lab.org")
+	production, _ := r.Lookup("mlab1-foo01.mlab-oti.measurement-lab.org")
+	if hosts := sandbox.Tokens.(*fakeTokens).hosts; len(hosts) != 1 {
+		t.Errorf("sandbox created tokens for %v, want 1 host", hosts)
+	}
+	if hosts := production.Tokens.(*fakeTokens).hosts; len(hosts) != 0 {
+		t.Errorf("production created tokens for %v, want none", hosts)
+	}
+}
+
+func Test_RegistryNodes(t *testing.T) {
+	target := "mlab1-foo01.mlab-oti.measurement-lab.org"
+	tests := []struct {
+		name string
+		run  func(m node.Manager, target string) error
+		want string
+	}{
+		{
+			name: "delete",
+			run:  func(m node.Manager, target string) error { return m.Delete(context.Background(), target) },
+			want: "delete " + target,
+		},
+		{
+			name: "cordon",
+			run:  func(m node.Manager, target string) error { return m.Cordon(context.Background(), target) },
+			want: "cordon " + target,
+		},
+		{
+			name: "uncordon",
+			run:  func(m node.Manager, target string) error { return m.Uncordon(context.Background(), target) },
+			want: "uncordon " + target,
+		},
+		{
+			name: "label",
+			run: func(m node.Manager, target string) error {
+				return m.Label(context.Background(), target, []string{"mlab/maintenance=true"})
+			},
+			want: "label " + target,
+		},
+		{
+			name: "taint",
+			run: func(m node.Manager, target string) error {
+				return m.Taint(context.Background(), target, []string{"mlab/maintenance=true:NoSchedule"})
+			},
+			want: "taint " + target,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			nodes := r.Nodes()
+			if err := tt.run(nodes, target); err != nil {
+				t.Fatalf("%s: unexpected error: %v", tt.name, err)
+			}
+			err := tt.run(nodes, "mlab1-foo01.mlab-staging.measurement-lab.org")
+			if !errors.Is(err, ErrUnknownCluster) {
+				t.Errorf("%s for an unknown project: error = %v, want %v", tt.name, err, ErrUnknownCluster)
+			}
+			production, _ := r.Lookup(target)
+			sandbox, _ := r.Lookup("mlab1-foo01.mlab-sandbox.measurement-lab.org")
+			if ops := production.Nodes.(*fakeNodes).ops; len(ops) != 1 || ops[0] != tt.want {
+				t.Errorf("%s: production ran %v, want [%s]", tt.name, ops, tt.want)
+			}
+			if ops := sandbox.Nodes.(*fakeNodes).ops; len(ops) != 0 {
+				t.Errorf("%s: sandbox ran %v, want none", tt.name, ops)
+			}
+		})
+	}
+}
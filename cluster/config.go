@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Config describes a platform cluster and the machines it serves.
+type Config struct {
+	Name string `json:"name"`
+	// Projects and Sites list the projects and sites, as parsed from the
+	// hostnames of machines, whose machines belong to the cluster.
+	Projects []string `json:"projects,omitempty"`
+	Sites    []string `json:"sites,omitempty"`
+	// Kubeconfig is the path of the kubeconfig file used to reach the
+	// cluster. If empty, the default kubeconfig file is used.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// TokenPolicy is the path of the JSON token policy configuration of the
+	// cluster. If empty, the default token policy configuration is used.
+	TokenPolicy string `json:"token_policy,omitempty"`
+}
+
+// Configs is the cluster configuration.
+type Configs struct {
+	Clusters []*Config `json:"clusters"`
+}
+
+// LoadConfigs reads a JSON cluster configuration from path. An empty path
+// returns a nil *Configs.
+func LoadConfigs(path string) (*Configs, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Configs{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("could not parse cluster configuration: %v", err)
+	}
+	if len(c.Clusters) == 0 {
+		return nil, fmt.Errorf("cluster configuration has no clusters")
+	}
+	names := map[string]bool{}
+	for i, cluster := range c.Clusters {
+		if cluster == nil || cluster.Name == "" {
+			return nil, fmt.Errorf("cluster %d has no name", i)
+		}
+		if names[cluster.Name] {
+			return nil, fmt.Errorf("duplicate cluster %q", cluster.Name)
+		}
+		names[cluster.Name] = true
+		if len(cluster.Projects) == 0 && len(cluster.Sites) == 0 {
+			return nil, fmt.Errorf("cluster %q has no projects or sites", cluster.Name)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testConfigs = `{
+  "clusters": [
+    {
+      "name": "sandbox",
+      "projects": ["mlab-sandbox"],
+      "kubeconfig": "/etc/kubeconfig/sandbox.conf",
+      "token_policy": "/etc/token-policy/sandbox.json"
+    },
+    {
+      "name": "production",
+      "projects": ["mlab-oti"],
+      "sites": ["abc0t"],
+      "kubeconfig": "/etc/kubeconfig/production.conf"
+    }
+  ]
+}`
+
+func Test_LoadConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			content: testConfigs,
+			want:    2,
+		},
+		{
+			name:    "failure-bad-json",
+			content: `{"clusters": [`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-no-clusters",
+			content: `{"clusters": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-no-name",
+			content: `{"clusters": [{"projects": ["mlab-oti"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-null-cluster",
+			content: `{"clusters": [null]}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-duplicate-name",
+			content: `{"clusters": [{"name": "a", "projects": ["mlab-oti"]}, {"name": "a", "sites": ["abc0t"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-no-projects-or-sites",
+			content: `{"clusters": [{"name": "a", "kubeconfig": "/etc/a.conf"}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "clusters.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("failed to write configuration: %v", err)
+			}
+			c, err := LoadConfigs(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfigs(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(c.Clusters) != tt.want {
+				t.Errorf("LoadConfigs() returned %d clusters, want %d", len(c.Clusters), tt.want)
+			}
+		})
+	}
+}
+
+func Test_LoadConfigsEmptyPath(t *testing.T) {
+	c, err := LoadConfigs("")
+	if c != nil || err != nil {
+		t.Errorf("LoadConfigs(\"\") = %v, %v; want nil, nil", c, err)
+	}
+	if _, err := LoadConfigs(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("LoadConfigs() of a missing file: want an error")
+	}
+}
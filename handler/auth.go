@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// SignatureHeader is the header carrying the HMAC signature of an extension
+// request, in the form "sha256=<hex>".
+const SignatureHeader = "X-Epoxy-Signature"
+
+// ErrUnauthenticated is returned by Authenticators for requests they reject.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Authenticator checks that an extension request comes from a trusted client,
+// e.g. the ePoxy server, before the extension acts on it.
+type Authenticator interface {
+	// Name returns the name of the authenticator, as used in the auth
+	// configuration and in logs and metrics.
+	Name() string
+	// Authenticate returns an error wrapping ErrUnauthenticated if req, whose
+	// body has already been read into body, is not trusted.
+	Authenticate(req *http.Request, body []byte) error
+}
+
+// HMACAuthenticator accepts requests signed with a secret shared with the
+// ePoxy server. The signature is the hex encoded HMAC-SHA256 of the request
+// body, passed in the SignatureHeader.
+type HMACAuthenticator struct {
+	// Keys lists the accepted keys. More than one key allows rotating them.
+	Keys [][]byte
+}
+
+// Name returns "hmac".
+func (h *HMACAuthenticator) Name() string {
+	return "hmac"
+}
+
+// Sign returns the value of the SignatureHeader for body signed with key.
+func Sign(key []byte, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate checks the signature of req against all keys.
+func (h *HMACAuthenticator) Authenticate(req *http.Request, body []byte) error {
+	sig := req.Header.Get(SignatureHeader)
+	if sig == "" {
+		return fmt.Errorf("%w: missing %s header", ErrUnauthenticated, SignatureHeader)
+	}
+	for _, key := range h.Keys {
+		if hmac.Equal([]byte(Sign(key, body)), []byte(sig)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: bad signature", ErrUnauthenticated)
+}
+
+// CertAuthenticator accepts requests over TLS connections whose client
+// certificate was verified by the server and names one of the allowed
+// identities, either as its common name or as a DNS name.
+type CertAuthenticator struct {
+	Names []string
+}
+
+// Name returns "mtls".
+func (c *CertAuthenticator) Name() string {
+	return "mtls"
+}
+
+// Authenticate checks the identity of the verified client certificate of req.
+func (c *CertAuthenticator) Authenticate(req *http.Request, body []byte) error {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return fmt.Errorf("%w: no verified client certificate", ErrUnauthenticated)
+	}
+	leaf := req.TLS.VerifiedChains[0][0]
+	for _, id := range identities(leaf) {
+		if slices.Contains(c.Names, id) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: client certificate %q is not allowed", ErrUnauthenticated, leaf.Subject.CommonName)
+}
+
+// identities returns the common name and DNS names of cert.
+func identities(cert *x509.Certificate) []string {
+	ids := append([]string{}, cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return ids
+}
+
+// CIDRAuthenticator accepts requests whose source address is in one of the
+// allowed networks.
+type CIDRAuthenticator struct {
+	Networks []*net.IPNet
+}
+
+// NewCIDRAuthenticator returns a CIDRAuthenticator allowing the given networks
+// in CIDR notation. Single addresses are allowed as well.
+func NewCIDRAuthenticator(cidrs []string) (*CIDRAuthenticator, error) {
+	c := &CIDRAuthenticator{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		c.Networks = append(c.Networks, n)
+	}
+	return c, nil
+}
+
+// Name returns "cidr".
+func (c *CIDRAuthenticator) Name() string {
+	return "cidr"
+}
+
+// Authenticate checks the source address of req.
+func (c *CIDRAuthenticator) Authenticate(req *http.Request, body []byte) error {
+	ip := net.ParseIP(sourceAddress(req))
+	if ip == nil {
+		return fmt.Errorf("%w: bad source address %q", ErrUnauthenticated, req.RemoteAddr)
+	}
+	for _, n := range c.Networks {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: source address %s is not allowed", ErrUnauthenticated, ip)
+}
+
+// HMACConfig configures the HMACAuthenticator.
+type HMACConfig struct {
+	// KeyFiles lists files each containing one shared key.
+	KeyFiles []string `json:"key_files"`
+}
+
+// MTLSConfig configures the CertAuthenticator.
+type MTLSConfig struct {
+	Names []string `json:"names"`
+}
+
+// CIDRConfig configures the CIDRAuthenticator.
+type CIDRConfig struct {
+	Networks []string `json:"networks"`
+}
+
+// AuthConfig configures the authenticators and which of them each extension
+// requires.
+type AuthConfig struct {
+	HMAC *HMACConfig `json:"hmac,omitempty"`
+	MTLS *MTLSConfig `json:"mtls,omitempty"`
+	CIDR *CIDRConfig `json:"cidr,omitempty"`
+	// Extensions maps the names of extensions ("token", "bmc" or "node") to
+	// the names of the authenticators they require. Extensions not listed
+	// use the "default" entry, if any.
+	Extensions map[string][]string `json:"extensions"`
+
+	authenticators map[string]Authenticator
+}
+
+// LoadAuthConfig reads a JSON auth configuration from path. An empty path
+// returns a nil *AuthConfig, which requires no authentication.
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &AuthConfig{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("could not parse auth config: %v", err)
+	}
+
+	c.authenticators = map[string]Authenticator{}
+	if c.HMAC != nil {
+		h := &HMACAuthenticator{}
+		for _, f := range c.HMAC.KeyFiles {
+			key, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			key = []byte(strings.TrimSpace(string(key)))
+			if len(key) < 32 {
+				return nil, fmt.Errorf("HMAC key in %s must be at least 32 bytes long", f)
+			}
+			h.Keys = append(h.Keys, key)
+		}
+		if len(h.Keys) == 0 {
+			return nil, fmt.Errorf("hmac authenticator needs at least one key")
+		}
+		c.authenticators[h.Name()] = h
+	}
+	if c.MTLS != nil {
+		if len(c.MTLS.Names) == 0 {
+			return nil, fmt.Errorf("mtls authenticator needs at least one name")
+		}
+		m := &CertAuthenticator{Names: c.MTLS.Names}
+		c.authenticators[m.Name()] = m
+	}
+	if c.CIDR != nil {
+		n, err := NewCIDRAuthenticator(c.CIDR.Networks)
+		if err != nil {
+			return nil, err
+		}
+		if len(n.Networks) == 0 {
+			return nil, fmt.Errorf("cidr authenticator needs at least one network")
+		}
+		c.authenticators[n.Name()] = n
+	}
+
+	for ext, names := range c.Extensions {
+		for _, name := range names {
+			if c.authenticators[name] == nil {
+				return nil, fmt.Errorf("extension %q requires unconfigured authenticator %q", ext, name)
+			}
+		}
+	}
+	return c, nil
+}
+
+// Authenticators returns the authenticators required by the named extension.
+func (c *AuthConfig) Authenticators(extension string) []Authenticator {
+	if c == nil {
+		return nil
+	}
+	names, ok := c.Extensions[extension]
+	if !ok {
+		names = c.Extensions["default"]
+	}
+	var result []Authenticator
+	for _, name := range names {
+		result = append(result, c.authenticators[name])
+	}
+	return result
+}
@@ -0,0 +1,264 @@
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testHMACKey = []byte("0123456789abcdef0123456789abcdef")
+
+func Test_HMACAuthenticator(t *testing.T) {
+	body := []byte(`{"v1": {"hostname": "mlab1-foo01.mlab-oti.measurement-lab.org"}}`)
+	tests := []struct {
+		name      string
+		signature string
+		wantErr   bool
+	}{
+		{
+			name:      "success",
+			signature: Sign(testHMACKey, body),
+		},
+		{
+			name:      "success-rotated-key",
+			signature: Sign([]byte("fedcba9876543210fedcba9876543210"), body),
+		},
+		{
+			name:    "failure-missing-signature",
+			wantErr: true,
+		},
+		{
+			name:      "failure-wrong-key",
+			signature: Sign([]byte("not the key"), body),
+			wantErr:   true,
+		},
+		{
+			name:      "failure-other-body",
+			signature: Sign(testHMACKey, []byte("{}")),
+			wantErr:   true,
+		},
+	}
+	h := &HMACAuthenticator{Keys: [][]byte{testHMACKey, []byte("fedcba9876543210fedcba9876543210")}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/allocate_k8s_token", nil)
+			if tt.signature != "" {
+				req.Header.Set(SignatureHeader, tt.signature)
+			}
+			err := h.Authenticate(req, body)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Authenticate(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUnauthenticated) {
+				t.Errorf("Authenticate(): error = %v, want ErrUnauthenticated", err)
+			}
+		})
+	}
+}
+
+func Test_CertAuthenticator(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   *tls.ConnectionState
+		wantErr bool
+	}{
+		{
+			name: "success-common-name",
+			state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+				{Subject: pkix.Name{CommonName: "epoxy.mlab-oti.measurementlab.net"}},
+			}}},
+		},
+		{
+			name: "success-dns-name",
+			state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+				{DNSNames: []string{"other.example.com", "epoxy.mlab-oti.measurementlab.net"}},
+			}}},
+		},
+		{
+			name: "failure-other-name",
+			state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+				{Subject: pkix.Name{CommonName: "mlab1-foo01.mlab-oti.measurement-lab.org"}},
+			}}},
+			wantErr: true,
+		},
+		{
+			name:    "failure-unverified",
+			state:   &tls.ConnectionState{},
+			wantErr: true,
+		},
+		{
+			name:    "failure-no-tls",
+			wantErr: true,
+		},
+	}
+	c := &CertAuthenticator{Names: []string{"epoxy.mlab-oti.measurementlab.net"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/allocate_k8s_token", nil)
+			req.TLS = tt.state
+			err := c.Authenticate(req, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Authenticate(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_CIDRAuthenticator(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantErr    bool
+	}{
+		{
+			name:       "success-network",
+			remoteAddr: "10.1.2.3:4567",
+		},
+		{
+			name:       "success-single-address",
+			remoteAddr: "192.0.2.1:4567",
+		},
+		{
+			name:       "success-ipv6",
+			remoteAddr: "[2001:db8::1]:4567",
+		},
+		{
+			name:       "failure-not-allowed",
+			remoteAddr: "192.0.2.2:4567",
+			wantErr:    true,
+		},
+		{
+			name:       "failure-bad-address",
+			remoteAddr: "lol",
+			wantErr:    true,
+		},
+	}
+	c, err := NewCIDRAuthenticator([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/64"})
+	if err != nil {
+		t.Fatalf("NewCIDRAuthenticator(): %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/allocate_k8s_token", nil)
+			req.RemoteAddr = tt.remoteAddr
+			err := c.Authenticate(req, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Authenticate(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := NewCIDRAuthenticator([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("NewCIDRAuthenticator() with bad network succeeded")
+	}
+}
+
+func Test_LoadAuthConfig(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, append(testHMACKey, '\n'), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	shortKeyFile := filepath.Join(dir, "short-key")
+	if err := os.WriteFile(shortKeyFile, []byte("short"), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	tests := []struct {
+		name    string
+		content string
+		expect  map[string][]string
+		wantErr bool
+	}{
+		{
+			name: "success",
+			content: `{
+				"hmac": {"key_files": ["` + keyFile + `"]},
+				"mtls": {"names": ["epoxy.mlab-oti.measurementlab.net"]},
+				"cidr": {"networks": ["10.0.0.0/8"]},
+				"extensions": {"token": ["hmac", "cidr"], "default": ["mtls"]}
+			}`,
+			expect: map[string][]string{
+				"token": {"hmac", "cidr"},
+				"node":  {"mtls"},
+			},
+		},
+		{
+			name:    "success-no-default",
+			content: `{"cidr": {"networks": ["10.0.0.0/8"]}, "extensions": {"node": ["cidr"]}}`,
+			expect: map[string][]string{
+				"node":  {"cidr"},
+				"token": nil,
+			},
+		},
+		{
+			name:    "failure-bad-json",
+			content: `{"hmac": `,
+			wantErr: true,
+		},
+		{
+			name:    "failure-unconfigured-authenticator",
+			content: `{"extensions": {"token": ["hmac"]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-short-key",
+			content: `{"hmac": {"key_files": ["` + shortKeyFile + `"]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-missing-key-file",
+			content: `{"hmac": {"key_files": ["` + filepath.Join(dir, "missing") + `"]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-no-keys",
+			content: `{"hmac": {"key_files": []}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-no-names",
+			content: `{"mtls": {}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-network",
+			content: `{"cidr": {"networks": ["lol"]}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "auth.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("failed to write auth config: %v", err)
+			}
+			c, err := LoadAuthConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadAuthConfig(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for ext, want := range tt.expect {
+				var got []string
+				for _, a := range c.Authenticators(ext) {
+					got = append(got, a.Name())
+				}
+				if strings.Join(got, ",") != strings.Join(want, ",") {
+					t.Errorf("Authenticators(%q) = %v, want %v", ext, got, want)
+				}
+			}
+		})
+	}
+
+	c, err := LoadAuthConfig("")
+	if c != nil || err != nil {
+		t.Errorf("LoadAuthConfig(\"\") = %v, %v; want nil, nil", c, err)
+	}
+	if a := c.Authenticators("token"); len(a) != 0 {
+		t.Errorf("Authenticators() on nil AuthConfig = %v, want none", a)
+	}
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/m-lab/epoxy-extensions/logging"
+)
+
+// Codes of error responses, which tell clients why a request failed.
+const (
+	codeBadMethod               = "bad_method"
+	codeRateLimited             = "rate_limited"
+	codeBadBody                 = "bad_body"
+	codeUnauthenticated         = "unauthenticated"
+	codeFutureBoot              = "future_boot"
+	codeStaleBoot               = "stale_boot"
+	codeIdentityMismatch        = "identity_mismatch"
+	codeLookupFailed            = "identity_lookup_failed"
+	codeMissingNonce            = "missing_nonce"
+	codeReplay                  = "replay"
+	codeSeenStoreUnavailable    = "seen_store_unavailable"
+	codeBadRequest              = "bad_request"
+	codeUnknownCluster          = "unknown_cluster"
+	codeControlPlaneForbidden   = "control_plane_not_allowed"
+	codeControlPlaneUnsupported = "control_plane_unsupported"
+	codeKubeadmFailed           = "kubeadm_failed"
+	codeMissingPassword         = "missing_password"
+	codeOverrideNotAllowed      = "override_not_allowed"
+	codeVerificationFailed      = "verification_failed"
+	codeBMCUnavailable          = "bmc_unavailable"
+	codeBMCLookupFailed         = "bmc_lookup_failed"
+	codeBackendUnavailable      = "backend_unavailable"
+	codeNodeNotFound            = "node_not_found"
+	codeNodeForbidden           = "node_forbidden"
+	codeNodeConflict            = "node_conflict"
+	codeKubectlFailed           = "kubectl_failed"
+	codeInternal                = "internal_error"
+)
+
+// ErrorResponse is the body of an error response to a client accepting JSON.
+// Code is one of a fixed set of machine-readable reasons, Message describes
+// the error to humans and RequestID identifies the request in the logs of
+// the server.
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeError writes an error response with the given status. If the client
+// accepts JSON, the body is an ErrorResponse with code and message; otherwise
+// the body is empty, as expected by older clients. Messages are returned to
+// clients, so they must not include the output of backends.
+func writeError(resp http.ResponseWriter, req *http.Request, status int, code string, message string) {
+	if !acceptsJSON(req.Header.Get("Accept")) {
+		resp.WriteHeader(status)
+		return
+	}
+	// Marshaling strings cannot fail.
+	body, _ := json.Marshal(&ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: resp.Header().Get(logging.RequestIDHeader),
+	})
+	resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp.WriteHeader(status)
+	resp.Write(body)
+}
@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/logging"
+	"github.com/m-lab/epoxy-extensions/node"
+	"github.com/m-lab/epoxy/extension"
+)
+
+func Test_writeError(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   *ErrorResponse
+	}{
+		{
+			name:   "json",
+			accept: "application/json",
+			want:   &ErrorResponse{Code: codeStaleBoot, Message: "machine booted too long ago", RequestID: "abc"},
+		},
+		{
+			name:   "json-before-yaml",
+			accept: "application/json, application/yaml;q=0.9",
+			want:   &ErrorResponse{Code: codeStaleBoot, Message: "machine booted too long ago", RequestID: "abc"},
+		},
+		{
+			name: "no-accept",
+		},
+		{
+			name:   "any",
+			accept: "*/*",
+		},
+		{
+			name:   "yaml",
+			accept: "application/yaml, application/json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/allocate_k8s_token", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			rec.Header().Set(logging.RequestIDHeader, "abc")
+
+			writeError(rec, req, http.StatusRequestTimeout, codeStaleBoot, "machine booted too long ago")
+
+			if rec.Code != http.StatusRequestTimeout {
+				t.Errorf("writeError() status = %d, want %d", rec.Code, http.StatusRequestTimeout)
+			}
+			if tt.want == nil {
+				if rec.Body.Len() != 0 {
+					t.Errorf("writeError() body = %q, want empty", rec.Body.String())
+				}
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("writeError() Content-Type = %q, want application/json", ct)
+			}
+			got := &ErrorResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), got); err != nil {
+				t.Fatalf("writeError() body %q is not JSON: %v", rec.Body.String(), err)
+			}
+			if *got != *tt.want {
+				t.Errorf("writeError() body = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_errorResponses(t *testing.T) {
+	v1 := func(rawQuery string, lastBoot time.Duration) *extension.V1 {
+		return &extension.V1{
+			Hostname:    "mlab1-foo01.mlab-oti.measurement-lab.org",
+			IPv4Address: "192.168.1.1",
+			LastBoot:    time.Now().UTC().Add(-lastBoot),
+			RawQuery:    rawQuery,
+		}
+	}
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		v1      *extension.V1
+		status  int
+		code    string
+	}{
+		{
+			name:    "bad-method",
+			handler: NewBmcHandler(&fakePasswordStore{}),
+			method:  http.MethodGet,
+			status:  http.StatusMethodNotAllowed,
+			code:    codeBadMethod,
+		},
+		{
+			name:    "stale-boot",
+			handler: NewBmcHandler(&fakePasswordStore{}),
+			v1:      v1("p=somepass", 3*time.Hour),
+			status:  http.StatusRequestTimeout,
+			code:    codeStaleBoot,
+		},
+		{
+			name:    "missing-password",
+			handler: NewBmcHandler(&fakePasswordStore{}),
+			v1:      v1("z=lol", 5*time.Minute),
+			status:  http.StatusBadRequest,
+			code:    codeMissingPassword,
+		},
+		{
+			name:    "invalid-hostname",
+			handler: NewBmcHandler(&fakePasswordStore{}),
+			v1: &extension.V1{
+				Hostname:    "lol-foo01.mlab-oti.measurement-lab.org",
+				IPv4Address: "192.168.1.1",
+				LastBoot:    time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery:    "p=somepass",
+			},
+			status: http.StatusBadRequest,
+			code:   codeBadRequest,
+		},
+		{
+			name:    "bmc-lookup-failed",
+			handler: NewBmcHandler(&fakePasswordStore{}),
+			v1:      v1("p=unresolvable", 5*time.Minute),
+			status:  http.StatusServiceUnavailable,
+			code:    codeBMCLookupFailed,
+		},
+		{
+			name:    "backend-unavailable",
+			handler: NewBmcHandler(&fakePasswordStore{}),
+			v1:      v1("p=backend-down", 5*time.Minute),
+			status:  http.StatusInternalServerError,
+			code:    codeBackendUnavailable,
+		},
+		{
+			name:    "bad-join-mode",
+			handler: NewTokenHandler("v2", &fakeTokenManager{token: testToken}),
+			v1:      v1("mode=lol", 5*time.Minute),
+			status:  http.StatusBadRequest,
+			code:    codeBadRequest,
+		},
+		{
+			name:    "kubeadm-failed",
+			handler: NewTokenHandler("v2", &fakeTokenManager{wantErr: true}),
+			v1:      v1("", 5*time.Minute),
+			status:  http.StatusInternalServerError,
+			code:    codeKubeadmFailed,
+		},
+		{
+			name:    "node-not-found",
+			handler: NewNodeHandler(&fakeNodeManager{err: node.ErrNotFound}, "cordon"),
+			v1:      v1("", 5*time.Minute),
+			status:  http.StatusNotFound,
+			code:    codeNodeNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			ext := extension.Request{V1: tt.v1}
+			h := logging.Middleware(tt.handler)
+
+			// Clients accepting JSON get an ErrorResponse.
+			req := httptest.NewRequest(method, "/v1/extension", strings.NewReader(ext.Encode()))
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("ServeHTTP() status = %d, want %d", rec.Code, tt.status)
+			}
+			got := &ErrorResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), got); err != nil {
+				t.Fatalf("ServeHTTP() body %q is not JSON: %v", rec.Body.String(), err)
+			}
+			if got.Code != tt.code || got.Message == "" {
+				t.Errorf("ServeHTTP() error = %+v, want code %q", got, tt.code)
+			}
+			if id := rec.Header().Get(logging.RequestIDHeader); got.RequestID == "" || got.RequestID != id {
+				t.Errorf("ServeHTTP() request ID = %q, want %q", got.RequestID, id)
+			}
+
+			// Other clients get an empty body.
+			req = httptest.NewRequest(method, "/v1/extension", strings.NewReader(ext.Encode()))
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status || rec.Body.Len() != 0 {
+				t.Errorf("ServeHTTP() without JSON = %d, %q; want %d, empty", rec.Code, rec.Body.String(), tt.status)
+			}
+		})
+	}
+}
@@ -1,25 +1,26 @@
 package handler
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"mime"
 	"net/http"
 	"net/url"
-	"time"
+	"strings"
 
 	"github.com/m-lab/epoxy-extensions/bmc"
+	"github.com/m-lab/epoxy-extensions/cluster"
 	"github.com/m-lab/epoxy-extensions/node"
 	"github.com/m-lab/epoxy-extensions/token"
-	"github.com/m-lab/epoxy/extension"
+	"github.com/m-lab/go/host"
+	"sigs.k8s.io/yaml"
 )
 
-// The maximum amount of time since a machine has booted that extensions will
-// accept requests from that host.
-const maxUptime time.Duration = 120 * time.Minute
-
 // tokenHandler implements the http.Handler interface and is the struct used to
 // interact with the token package.
 type tokenHandler struct {
+	options
 	manager token.Manager
 	version string
 }
@@ -28,47 +29,90 @@ type tokenHandler struct {
 func (t *tokenHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	var body []byte
 
-	log.Printf("context %p: %s", req.Context(), req.RequestURI)
-
-	// Require requests to be POSTs.
-	if req.Method != http.MethodPost {
-		resp.WriteHeader(http.StatusMethodNotAllowed)
+	ext, ok := t.checkRequest(resp, req)
+	if !ok {
 		return
 	}
+	logger := t.logger(req).With("hostname", ext.V1.Hostname)
+	outcome := outcomeSuccess
+	defer func() { t.done(req, ext.V1, outcome) }()
+
+	// A v3 response needs node labels derived from the hostname, so check that
+	// it can be parsed before creating a token.
+	if t.version == "v3" {
+		if _, err := host.Parse(ext.V1.Hostname); err != nil {
+			logger.Warn("invalid hostname", "error", err)
+			outcome = outcomeBadRequest
+			writeError(resp, req, http.StatusBadRequest, codeBadRequest, "invalid hostname")
+			return
+		}
+	}
 
-	ext, err := decodeMessage(req)
-	if err != nil || ext.V1 == nil {
-		log.Printf("context %p: %v", req.Context(), err)
-		resp.WriteHeader(http.StatusBadRequest)
+	controlPlane, err := controlPlaneMode(ext.V1.RawQuery)
+	if err != nil {
+		logger.Warn("invalid join mode", "error", err)
+		outcome = outcomeBadRequest
+		writeError(resp, req, http.StatusBadRequest, codeBadRequest, err.Error())
 		return
 	}
-
-	if time.Since(ext.V1.LastBoot) > maxUptime {
-		// According to ePoxy the machine booted over 2 hours ago,
-		// which is longer than we're willing to support.
-		resp.WriteHeader(http.StatusRequestTimeout)
+	// A v1 response has no room for the certificate key.
+	if controlPlane && t.version == "v1" {
+		logger.Warn("control-plane joins require v2 or later")
+		outcome = outcomeBadRequest
+		writeError(resp, req, http.StatusBadRequest, codeBadRequest, "control-plane joins require v2 or later")
 		return
 	}
 
-	log.Printf("context %p: %s", req.Context(), ext.Encode())
-
-	err = t.manager.Create(ext.V1.Hostname)
-	if err != nil {
-		log.Printf("context %p: %v", req.Context(), err)
-		resp.WriteHeader(http.StatusInternalServerError)
+	details, err := t.manager.Create(req.Context(), token.Request{
+		Hostname:     ext.V1.Hostname,
+		RawQuery:     ext.V1.RawQuery,
+		ControlPlane: controlPlane,
+	})
+	switch {
+	case errors.Is(err, token.ErrControlPlaneNotAllowed):
+		logger.Warn("control-plane join rejected", "error", err)
+		outcome = outcomeForbidden
+		writeError(resp, req, http.StatusForbidden, codeControlPlaneForbidden, "machine is not allowed to join the control plane")
+		return
+	case errors.Is(err, token.ErrControlPlaneUnsupported):
+		logger.Warn("control-plane joins unsupported", "error", err)
+		outcome = outcomeUnsupported
+		writeError(resp, req, http.StatusNotImplemented, codeControlPlaneUnsupported, "control-plane joins are not supported")
+		return
+	case errors.Is(err, cluster.ErrUnknownCluster):
+		logger.Warn("token request for an unknown cluster", "error", err)
+		outcome = outcomeUnknownCluster
+		writeError(resp, req, http.StatusForbidden, codeUnknownCluster, "machine belongs to no known cluster")
 		return
+	case err != nil:
+		logger.Error("failed to create token", "error", err)
+		outcome = outcomeBackendError
+		writeError(resp, req, http.StatusInternalServerError, codeKubeadmFailed, "failed to create token")
+		return
+	}
+	if details.Policy != nil {
+		logger.Info("created token", "policy", details.Policy.Name, "ttl", details.Policy.TTL,
+			"usages", details.Policy.Usages, "groups", details.Policy.Groups)
 	}
 
-	// A v1 response is just a string (the token), whereas a v2 response will be JSON.
-	if t.version == "v1" {
+	// A v1 response is just a string (the token), a v2 response will be JSON,
+	// and a v3 response is a kubeadm JoinConfiguration as YAML or JSON.
+	switch t.version {
+	case "v1":
 		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	} else {
+		body, err = details.Response(t.version)
+	case "v3":
+		var contentType string
+		contentType, body, err = joinConfigResponse(details, ext.V1.Hostname, req.Header.Get("Accept"))
+		resp.Header().Set("Content-Type", contentType)
+	default:
 		resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+		body, err = details.Response(t.version)
 	}
-
-	body, err = t.manager.Response(t.version)
 	if err != nil {
-		resp.WriteHeader(http.StatusInternalServerError)
+		logger.Error("failed to encode response", "error", err)
+		outcome = outcomeBackendError
+		writeError(resp, req, http.StatusInternalServerError, codeInternal, "failed to encode response")
 		return
 	}
 
@@ -76,9 +120,61 @@ func (t *tokenHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	resp.Write(body)
 }
 
+// controlPlaneMode returns whether the "mode" parameter of rawQuery requests a
+// control-plane join. A missing mode means a worker join.
+func controlPlaneMode(rawQuery string) (bool, error) {
+	queryParams, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse RawQuery field: %v", err)
+	}
+	switch mode := queryParams.Get("mode"); mode {
+	case "", "worker":
+		return false, nil
+	case "control-plane":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown join mode '%s'", mode)
+	}
+}
+
+// joinConfigResponse returns the content type and body of a v3 token response
+// for hostname. The body is a kubeadm JoinConfiguration, encoded as JSON if the
+// client accepts application/json ahead of YAML, or as YAML otherwise.
+func joinConfigResponse(details token.Details, hostname string, accept string) (string, []byte, error) {
+	config, err := details.JoinConfiguration(hostname)
+	if err != nil {
+		return "", nil, err
+	}
+	if acceptsJSON(accept) {
+		body, err := json.Marshal(config)
+		return "application/json; charset=utf-8", body, err
+	}
+	body, err := yaml.Marshal(config)
+	return "application/yaml; charset=utf-8", body, err
+}
+
+// acceptsJSON returns whether the first of the JSON or YAML media types listed
+// in the Accept header value accept is JSON.
+func acceptsJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return true
+		case "application/yaml", "application/x-yaml", "text/yaml":
+			return false
+		}
+	}
+	return false
+}
+
 // bmcHandler implements the http.Handler interface and is the struct used to
 // interact with the bmc package.
 type bmcHandler struct {
+	options
 	passwordStore bmc.PasswordStore
 }
 
@@ -86,52 +182,79 @@ type bmcHandler struct {
 func (b *bmcHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	var reqPassword string
 
-	log.Printf("context %p: %s", req.Context(), req.RequestURI)
-
-	// Require requests to be POSTs.
-	if req.Method != http.MethodPost {
-		resp.WriteHeader(http.StatusMethodNotAllowed)
-		// Write no response.
-		return
-	}
-
-	ext, err := decodeMessage(req)
-	if err != nil || ext.V1 == nil {
-		log.Printf("context %p: %v", req.Context(), err)
-		resp.WriteHeader(http.StatusBadRequest)
-		// Write no response.
-		return
-	}
-
-	if time.Since(ext.V1.LastBoot) > maxUptime {
-		// According to ePoxy the machine booted over 2 hours ago,
-		// which is longer than we're willing to support.
-		resp.WriteHeader(http.StatusRequestTimeout)
-		// Write no response.
+	ext, ok := b.checkRequest(resp, req)
+	if !ok {
 		return
 	}
-
-	log.Printf("context %p: %s", req.Context(), ext.Encode())
+	logger := b.logger(req).With("hostname", ext.V1.Hostname)
+	outcome := outcomeSuccess
+	defer func() { b.done(req, ext.V1, outcome) }()
 
 	// Parse query parameters from the request.
 	queryParams, err := url.ParseQuery(ext.V1.RawQuery)
 	if err != nil {
-		log.Printf("context %p: failed to parse RawQuery field: %v", req.Context(), err)
-		resp.WriteHeader(http.StatusInternalServerError)
+		logger.Warn("failed to parse RawQuery field", "error", err)
+		outcome = outcomeBadRequest
+		writeError(resp, req, http.StatusBadRequest, codeBadRequest, "failed to parse RawQuery field")
 		return
 	}
 
 	reqPassword = queryParams.Get("p")
 	if reqPassword == "" {
-		log.Printf("context %p: query parameter 'p' missing in request or empty", req.Context())
-		resp.WriteHeader(http.StatusBadRequest)
+		logger.Warn("query parameter 'p' missing in request or empty")
+		outcome = outcomeBadRequest
+		writeError(resp, req, http.StatusBadRequest, codeMissingPassword, "query parameter 'p' missing or empty")
 		return
 	}
 
-	err = b.passwordStore.Put(ext.V1.Hostname, reqPassword)
+	// The model and username of the BMC may be overridden by the request, if
+	// allowed for the machine.
+	override := bmc.Override{
+		Model:    queryParams.Get("model"),
+		Username: queryParams.Get("username"),
+	}
+
+	err = b.passwordStore.Put(bmc.Request{
+		Hostname: ext.V1.Hostname,
+		Password: reqPassword,
+		Override: override,
+		SetBy:    ext.V1.Hostname,
+		SourceIP: sourceAddress(req),
+	})
 	if err != nil {
-		log.Printf("context %p: %v", req.Context(), err)
-		resp.WriteHeader(http.StatusInternalServerError)
+		logger.Warn("failed to store BMC password", "error", err)
+		if errors.Is(err, bmc.ErrInvalidHostname) {
+			outcome = outcomeBadRequest
+			writeError(resp, req, http.StatusBadRequest, codeBadRequest, "invalid hostname")
+			return
+		}
+		if errors.Is(err, bmc.ErrOverrideNotAllowed) {
+			outcome = outcomeForbidden
+			writeError(resp, req, http.StatusForbidden, codeOverrideNotAllowed, "BMC override not allowed for this machine")
+			return
+		}
+		if errors.Is(err, bmc.ErrVerificationFailed) {
+			outcome = outcomeVerificationFailed
+			writeError(resp, req, http.StatusUnprocessableEntity, codeVerificationFailed, "BMC rejected the password")
+			return
+		}
+		if errors.Is(err, bmc.ErrBMCUnavailable) {
+			outcome = outcomeBMCUnavailable
+			writeError(resp, req, http.StatusBadGateway, codeBMCUnavailable, "BMC could not be reached to verify the password")
+			return
+		}
+		if errors.Is(err, bmc.ErrBMCLookupFailed) {
+			outcome = outcomeLookupFailure
+			writeError(resp, req, http.StatusServiceUnavailable, codeBMCLookupFailed, "failed to resolve the BMC hostname")
+			return
+		}
+		if errors.Is(err, bmc.ErrMapping) {
+			outcome = outcomeBackendError
+			writeError(resp, req, http.StatusInternalServerError, codeInternal, "failed to apply the BMC mapping")
+			return
+		}
+		outcome = outcomeBackendError
+		writeError(resp, req, http.StatusInternalServerError, codeBackendUnavailable, "failed to store BMC password")
 		return
 	}
 
@@ -141,68 +264,85 @@ func (b *bmcHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 // nodeHandler implements the http.Handler interface and is the struct used to
 // interact with the node package.
 type nodeHandler struct {
-	manager *node.Manager
+	options
+	manager node.Manager
 	action  string
 }
 
 // ServeHTTP is the request handler for node requests.
 func (nh *nodeHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	log.Printf("context %p: %s", req.Context(), req.RequestURI)
-
-	// Require requests to be POSTs.
-	if req.Method != http.MethodPost {
-		resp.WriteHeader(http.StatusMethodNotAllowed)
-		// Write no response.
-		return
-	}
-
-	ext, err := decodeMessage(req)
-	if err != nil || ext.V1 == nil {
-		log.Printf("context %p: %v", req.Context(), err)
-		resp.WriteHeader(http.StatusBadRequest)
-		// Write no response.
+	ext, ok := nh.checkRequest(resp, req)
+	if !ok {
 		return
 	}
+	logger := nh.logger(req).With("hostname", ext.V1.Hostname)
+	outcome := outcomeSuccess
+	defer func() { nh.done(req, ext.V1, outcome) }()
 
-	if time.Since(ext.V1.LastBoot) > maxUptime {
-		// According to ePoxy the machine booted over 2 hours ago,
-		// which is longer than we're willing to support.
-		resp.WriteHeader(http.StatusRequestTimeout)
-		// Write no response.
-		return
-	}
-
-	log.Printf("context %p: %s", req.Context(), ext.Encode())
-
+	var err error
 	switch nh.action {
 	case "delete":
-		err = nh.manager.Delete(ext.V1.Hostname)
+		err = nh.manager.Delete(req.Context(), ext.V1.Hostname)
+	case "cordon":
+		err = nh.manager.Cordon(req.Context(), ext.V1.Hostname)
+	case "uncordon":
+		err = nh.manager.Uncordon(req.Context(), ext.V1.Hostname)
+	case "label", "taint":
+		// Labels and taints are passed as repeated "label" or "taint"
+		// parameters of the RawQuery. Other actions ignore the RawQuery.
+		queryParams, perr := url.ParseQuery(ext.V1.RawQuery)
+		if perr != nil {
+			logger.Warn("failed to parse RawQuery field", "error", perr)
+			outcome = outcomeBadRequest
+			writeError(resp, req, http.StatusBadRequest, codeBadRequest, "failed to parse RawQuery field")
+			return
+		}
+		if nh.action == "label" {
+			err = nh.manager.Label(req.Context(), ext.V1.Hostname, queryParams["label"])
+		} else {
+			err = nh.manager.Taint(req.Context(), ext.V1.Hostname, queryParams["taint"])
+		}
 	default:
-		log.Printf("context %p: unknown action '%s'", req.Context(), nh.action)
+		logger.Error("unknown node action", "action", nh.action)
 		err = fmt.Errorf("unknown node action '%s'", nh.action)
 	}
 
 	if err != nil {
-		log.Printf("context %p: %v", req.Context(), err)
-		resp.WriteHeader(http.StatusInternalServerError)
+		logger.Warn("node action failed", "action", nh.action, "error", err)
+		switch {
+		case errors.Is(err, cluster.ErrUnknownCluster):
+			outcome = outcomeUnknownCluster
+			writeError(resp, req, http.StatusForbidden, codeUnknownCluster, "machine belongs to no known cluster")
+		case errors.Is(err, node.ErrNotFound) && nh.action == "delete":
+			// The node is already gone, which is what the machine asked for.
+			resp.WriteHeader(http.StatusOK)
+		case errors.Is(err, node.ErrNotFound):
+			outcome = outcomeNotFound
+			writeError(resp, req, http.StatusNotFound, codeNodeNotFound, "node not found")
+		case errors.Is(err, node.ErrInvalid):
+			outcome = outcomeBadRequest
+			writeError(resp, req, http.StatusBadRequest, codeBadRequest, "invalid node change")
+		case errors.Is(err, node.ErrNotAllowed), errors.Is(err, node.ErrForbidden):
+			outcome = outcomeForbidden
+			writeError(resp, req, http.StatusForbidden, codeNodeForbidden, "node change not allowed")
+		case errors.Is(err, node.ErrConflict):
+			outcome = outcomeConflict
+			writeError(resp, req, http.StatusConflict, codeNodeConflict, "node changed concurrently")
+		default:
+			outcome = outcomeBackendError
+			writeError(resp, req, http.StatusInternalServerError, codeKubectlFailed, "node action failed")
+		}
 		return
 	}
 
 	resp.WriteHeader(http.StatusOK)
 }
 
-// decodeMessage takes and http request as input and returns the decoded
-// extension request data.
-func decodeMessage(req *http.Request) (*extension.Request, error) {
-	ext := &extension.Request{}
-	err := ext.Decode(req.Body)
-	return ext, err
-}
-
 // NewTokenHandler returns a new tokenHandler, which implements the http.Handler
 // interface.
-func NewTokenHandler(version string, manager token.Manager) http.Handler {
+func NewTokenHandler(version string, manager token.Manager, opts ...Option) http.Handler {
 	return &tokenHandler{
+		options: newOptions("token", opts),
 		manager: manager,
 		version: version,
 	}
@@ -210,16 +350,20 @@ func NewTokenHandler(version string, manager token.Manager) http.Handler {
 
 // NewBmcHandler returns a new bmcHandler, which implmements the
 // http.Hanlder interface.
-func NewBmcHandler(store bmc.PasswordStore) http.Handler {
+func NewBmcHandler(store bmc.PasswordStore, opts ...Option) http.Handler {
 	return &bmcHandler{
+		options:       newOptions("bmc", opts),
 		passwordStore: store,
 	}
 }
 
 // NewDeleteHandler returns a new deleteHandler, which implmements the
 // http.Hanlder interface.
-func NewNodeHandler(manager *node.Manager, action string) http.Handler {
+func NewNodeHandler(manager node.Manager, action string, opts ...Option) http.Handler {
+	o := newOptions("node", opts)
+	o.action = action
 	return &nodeHandler{
+		options: o,
 		manager: manager,
 		action:  action,
 	}
@@ -1,49 +1,62 @@
 package handler
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/m-lab/epoxy-extensions/bmc"
+	"github.com/m-lab/epoxy-extensions/cluster"
+	"github.com/m-lab/epoxy-extensions/internal/exec"
+	"github.com/m-lab/epoxy-extensions/logging"
+	"github.com/m-lab/epoxy-extensions/metrics"
 	"github.com/m-lab/epoxy-extensions/node"
 	"github.com/m-lab/epoxy-extensions/token"
 	"github.com/m-lab/epoxy/extension"
 	"github.com/m-lab/go/host"
+	"github.com/m-lab/reboot-service/creds"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var (
 	testAPIAddress string = "api.example.com:6443"
 	testCAHash     string = "sha256:hash"
 	testToken      string = "012345.abcdefghijklmnop"
+
+	testCertificateKey string = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
 )
 
 type fakeTokenManager struct {
-	response token.Details
-	token    string
-	version  string
-	wantErr  bool
+	token     string
+	wantErr   bool
+	createErr error
 }
 
-func (ft *fakeTokenManager) Create(target string) error {
-	if ft.response.Token == "" {
-		return fmt.Errorf("failed to generate token")
+func (ft *fakeTokenManager) Create(ctx context.Context, req token.Request) (token.Details, error) {
+	if ft.createErr != nil {
+		return token.Details{}, ft.createErr
 	}
-	ft.response.Token = ft.token
-	return nil
-}
-
-func (ft *fakeTokenManager) Response(version string) ([]byte, error) {
-	if ft.wantErr {
-		return nil, fmt.Errorf("Error!")
+	if ft.wantErr || ft.token == "" {
+		return token.Details{}, fmt.Errorf("failed to generate token")
 	}
-	if ft.version == "v1" {
-		return []byte(ft.token), nil
+	d := token.Details{
+		APIAddress: testAPIAddress,
+		CAHash:     testCAHash,
+		Token:      ft.token,
 	}
-	return json.Marshal(ft.response)
+	if req.ControlPlane {
+		d.CertificateKey = testCertificateKey
+	}
+	return d, nil
 }
 
 func Test_tokenHandler(t *testing.T) {
@@ -100,7 +113,7 @@ func Test_tokenHandler(t *testing.T) {
 			v1: &extension.V1{
 				Hostname:    "mlab1-foo01.mlab-sandbox.measurement-lab.org",
 				IPv4Address: "192.168.1.1",
-				LastBoot:    time.Now().UTC().Add(-125 * time.Minute),
+				LastBoot:    time.Now().UTC().Add(-135 * time.Minute),
 			},
 			status: http.StatusRequestTimeout,
 		},
@@ -116,7 +129,7 @@ func Test_tokenHandler(t *testing.T) {
 			token:  "",
 		},
 		{
-			name:   "failure-json-marshall-error",
+			name:   "failure-create-error",
 			method: "POST",
 			v1: &extension.V1{
 				Hostname:    "mlab1-foo01.mlab-sandbox.measurement-lab.org",
@@ -132,13 +145,7 @@ func Test_tokenHandler(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ft := &fakeTokenManager{
-				response: token.Details{
-					APIAddress: testAPIAddress,
-					CAHash:     testCAHash,
-					Token:      tt.token,
-				},
 				token:   tt.token,
-				version: tt.version,
 				wantErr: tt.wantErr,
 			}
 			th := NewTokenHandler(tt.version, ft)
@@ -176,14 +183,292 @@ func Test_tokenHandler(t *testing.T) {
 	}
 }
 
-type fakePasswordStore struct{}
+func Test_tokenHandlerV3(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		hostname    string
+		status      int
+		contentType string
+		expect      string
+	}{
+		{
+			name:        "success-yaml-default",
+			hostname:    "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+			status:      http.StatusOK,
+			contentType: "application/yaml; charset=utf-8",
+			expect: `apiVersion: kubeadm.k8s.io/v1beta3
+discovery:
+  bootstrapToken:
+    apiServerEndpoint: ` + testAPIAddress + `
+    caCertHashes:
+    - ` + testCAHash + `
+    token: ` + testToken + `
+kind: JoinConfiguration
+nodeRegistration:
+  kubeletExtraArgs:
+    node-labels: mlab/machine=mlab1,mlab/metro=foo,mlab/project=mlab-sandbox,mlab/site=foo01
+  name: mlab1-foo01.mlab-sandbox.measurement-lab.org
+  taints: []
+`,
+		},
+		{
+			name:        "success-yaml-preferred",
+			accept:      "application/yaml, application/json",
+			hostname:    "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+			status:      http.StatusOK,
+			contentType: "application/yaml; charset=utf-8",
+		},
+		{
+			name:        "success-json",
+			accept:      "text/html, application/json;q=0.9",
+			hostname:    "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+			status:      http.StatusOK,
+			contentType: "application/json; charset=utf-8",
+			expect: `{"apiVersion":"kubeadm.k8s.io/v1beta3","kind":"JoinConfiguration",` +
+				`"discovery":{"bootstrapToken":{"token":"` + testToken + `","apiServerEndpoint":"` + testAPIAddress +
+				`","caCertHashes":["` + testCAHash + `"]}},"nodeRegistration":{"name":"mlab1-foo01.mlab-sandbox.measurement-lab.org",` +
+				`"kubeletExtraArgs":{"node-labels":"mlab/machine=mlab1,mlab/metro=foo,mlab/project=mlab-sandbox,mlab/site=foo01"},"taints":[]}}`,
+		},
+		{
+			name:     "failure-bad-hostname",
+			hostname: "lol-foo01.mlab-sandbox.measurement-lab.org",
+			status:   http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := NewTokenHandler("v3", &fakeTokenManager{token: testToken})
+			ext := extension.Request{
+				V1: &extension.V1{
+					Hostname: tt.hostname,
+					LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+				},
+			}
+			req := httptest.NewRequest(
+				"POST", "/v3/allocate_k8s_token", strings.NewReader(ext.Encode()))
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+
+			th.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("TokenHandler: bad status code: got %d; want %d", rec.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("TokenHandler: bad Content-Type: got %q; want %q", ct, tt.contentType)
+			}
+			if tt.expect != "" && rec.Body.String() != tt.expect {
+				t.Errorf("TokenHandler: bad response: got %q; want %q", rec.Body.String(), tt.expect)
+			}
+		})
+	}
+}
+
+func Test_tokenHandlerControlPlane(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   string
+		rawQuery  string
+		createErr error
+		status    int
+		expect    string
+	}{
+		{
+			name:     "success-v2",
+			version:  "v2",
+			rawQuery: "mode=control-plane",
+			status:   http.StatusOK,
+			expect: `{"api_address":"` + testAPIAddress + `","token":"` + testToken + `","ca_hash":"` + testCAHash +
+				`","certificate_key":"` + testCertificateKey + `"}`,
+		},
+		{
+			name:     "success-worker",
+			version:  "v2",
+			rawQuery: "mode=worker",
+			status:   http.StatusOK,
+			expect:   `{"api_address":"` + testAPIAddress + `","token":"` + testToken + `","ca_hash":"` + testCAHash + `"}`,
+		},
+		{
+			name:     "failure-v1",
+			version:  "v1",
+			rawQuery: "mode=control-plane",
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:     "failure-unknown-mode",
+			version:  "v2",
+			rawQuery: "mode=lol",
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:     "failure-bad-query",
+			version:  "v2",
+			rawQuery: "mode=control-plane&;",
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:      "failure-not-allowed",
+			version:   "v2",
+			rawQuery:  "mode=control-plane",
+			createErr: token.ErrControlPlaneNotAllowed,
+			status:    http.StatusForbidden,
+		},
+		{
+			name:      "failure-unsupported",
+			version:   "v3",
+			rawQuery:  "mode=control-plane",
+			createErr: fmt.Errorf("wrapped: %w", token.ErrControlPlaneUnsupported),
+			status:    http.StatusNotImplemented,
+		},
+		{
+			name:      "failure-unknown-cluster",
+			version:   "v2",
+			createErr: fmt.Errorf("%w: no cluster for project", cluster.ErrUnknownCluster),
+			status:    http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := NewTokenHandler(tt.version, &fakeTokenManager{token: testToken, createErr: tt.createErr})
+			ext := extension.Request{
+				V1: &extension.V1{
+					Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+					LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+					RawQuery: tt.rawQuery,
+				},
+			}
+			req := httptest.NewRequest(
+				"POST", "/"+tt.version+"/allocate_k8s_token", strings.NewReader(ext.Encode()))
+			rec := httptest.NewRecorder()
+
+			th.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("TokenHandler: bad status code: got %d; want %d", rec.Code, tt.status)
+			}
+			if tt.expect != "" && rec.Body.String() != tt.expect {
+				t.Errorf("TokenHandler: bad response: got %q; want %q", rec.Body.String(), tt.expect)
+			}
+		})
+	}
+}
+
+// fakeHostTokenManager returns a token derived from the target hostname, so
+// that responses can be matched to the request that caused them.
+type fakeHostTokenManager struct{}
+
+func (fh *fakeHostTokenManager) Create(ctx context.Context, req token.Request) (token.Details, error) {
+	// Yield to make interleaving of concurrent requests more likely.
+	runtime.Gosched()
+	return token.Details{
+		APIAddress:  testAPIAddress,
+		CAHash:      testCAHash,
+		Token:       "token-" + req.Hostname,
+		Description: fmt.Sprintf("Allow %s to join the cluster", req.Hostname),
+	}, nil
+}
+
+func Test_tokenHandlerConcurrent(t *testing.T) {
+	const hosts = 50
+	for _, version := range []string{"v1", "v2"} {
+		t.Run(version, func(t *testing.T) {
+			th := NewTokenHandler(version, &fakeHostTokenManager{})
+			var wg sync.WaitGroup
+			for i := 0; i < hosts; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					hostname := fmt.Sprintf("mlab%d-foo%02d.mlab-sandbox.measurement-lab.org", i%4+1, i)
+					ext := extension.Request{
+						V1: &extension.V1{
+							Hostname: hostname,
+							LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+						},
+					}
+					req := httptest.NewRequest(
+						"POST", "/"+version+"/allocate_k8s_token", strings.NewReader(ext.Encode()))
+					rec := httptest.NewRecorder()
+
+					th.ServeHTTP(rec, req)
+
+					if rec.Code != http.StatusOK {
+						t.Errorf("TokenHandler: bad status code for %s: got %d; want %d",
+							hostname, rec.Code, http.StatusOK)
+						return
+					}
+					got := rec.Body.String()
+					if version == "v2" {
+						d := token.Details{}
+						if err := json.Unmarshal(rec.Body.Bytes(), &d); err != nil {
+							t.Errorf("TokenHandler: failed to unmarshal response: %v", err)
+							return
+						}
+						got = d.Token
+					}
+					if got != "token-"+hostname {
+						t.Errorf("TokenHandler: got token %q for %s", got, hostname)
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+type fakePasswordStore struct {
+	// sourceIP is the SourceIP of the last request.
+	sourceIP string
+}
 
-func (p *fakePasswordStore) Put(hostname string, password string) error {
-	_, err := host.Parse(hostname)
+func (p *fakePasswordStore) Put(req bmc.Request) error {
+	p.sourceIP = req.SourceIP
+	_, err := host.Parse(req.Hostname)
 	if err != nil {
-		return fmt.Errorf("bad hostname")
+		return fmt.Errorf("%w: %s", bmc.ErrInvalidHostname, req.Hostname)
+	}
+	switch req.Password {
+	case "wrong":
+		return fmt.Errorf("%w: rejected", bmc.ErrVerificationFailed)
+	case "unreachable":
+		return fmt.Errorf("%w: connection refused", bmc.ErrBMCUnavailable)
+	case "unresolvable":
+		return fmt.Errorf("%w: no such host", bmc.ErrBMCLookupFailed)
+	case "backend-down":
+		return fmt.Errorf("vault unavailable")
+	}
+	_, _, err = bmc.DefaultMapping.Apply(req.Override)
+	return err
+}
+
+func (p *fakePasswordStore) Get(hostname string) (*creds.Credentials, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (p *fakePasswordStore) List(project string) ([]bmc.Metadata, error) {
+	if project != "mlab-oti" {
+		return nil, fmt.Errorf("unknown project")
 	}
-	return nil
+	return []bmc.Metadata{{Hostname: "mlab1d-foo01.mlab-oti.measurement-lab.org", Version: 2}}, nil
+}
+
+func (p *fakePasswordStore) History(hostname string) ([]bmc.Metadata, error) {
+	if _, err := host.Parse(hostname); err != nil {
+		return nil, fmt.Errorf("%w: %s", bmc.ErrInvalidHostname, hostname)
+	}
+	return []bmc.Metadata{{Version: 1}, {Version: 2}}, nil
+}
+
+func (p *fakePasswordStore) Rollback(hostname string, version int, setBy string, sourceIP string) (bmc.Metadata, error) {
+	if version > 2 {
+		return bmc.Metadata{}, bmc.ErrVersionNotFound
+	}
+	return bmc.Metadata{Version: 3, RollbackOf: version, SetBy: setBy, SourceIP: sourceIP}, nil
 }
 
 func Test_bmcHandler(t *testing.T) {
@@ -216,7 +501,7 @@ func Test_bmcHandler(t *testing.T) {
 				LastBoot:    time.Now().UTC().Add(-5 * time.Minute),
 				RawQuery:    "p=somepass&z=lol",
 			},
-			status:   http.StatusInternalServerError,
+			status:   http.StatusBadRequest,
 			password: "012345abcdefghijklmnop",
 		},
 		{
@@ -238,7 +523,7 @@ func Test_bmcHandler(t *testing.T) {
 			v1: &extension.V1{
 				Hostname:    "mlab1-foo01.mlab-oti.measurement-lab.org",
 				IPv4Address: "192.168.1.1",
-				LastBoot:    time.Now().UTC().Add(-125 * time.Minute),
+				LastBoot:    time.Now().UTC().Add(-135 * time.Minute),
 				RawQuery:    "p=somepass&z=lol",
 			},
 			status:   http.StatusRequestTimeout,
@@ -253,7 +538,55 @@ func Test_bmcHandler(t *testing.T) {
 				LastBoot:    time.Now().UTC().Add(-5 * time.Minute),
 				RawQuery:    "p=somepass&;z=lol",
 			},
-			status:   http.StatusInternalServerError,
+			status:   http.StatusBadRequest,
+			password: "testpassword",
+		},
+		{
+			name:   "success-override-default-values",
+			method: "POST",
+			v1: &extension.V1{
+				Hostname:    "mlab1-foo01.mlab-oti.measurement-lab.org",
+				IPv4Address: "192.168.1.1",
+				LastBoot:    time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery:    "p=somepass&model=DRAC&username=admin",
+			},
+			status:   http.StatusOK,
+			password: "testpassword",
+		},
+		{
+			name:   "failure-override-not-allowed",
+			method: "POST",
+			v1: &extension.V1{
+				Hostname:    "mlab1-foo01.mlab-oti.measurement-lab.org",
+				IPv4Address: "192.168.1.1",
+				LastBoot:    time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery:    "p=somepass&model=iLO",
+			},
+			status:   http.StatusForbidden,
+			password: "testpassword",
+		},
+		{
+			name:   "failure-verification",
+			method: "POST",
+			v1: &extension.V1{
+				Hostname:    "mlab1-foo01.mlab-oti.measurement-lab.org",
+				IPv4Address: "192.168.1.1",
+				LastBoot:    time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery:    "p=wrong",
+			},
+			status:   http.StatusUnprocessableEntity,
+			password: "testpassword",
+		},
+		{
+			name:   "failure-bmc-unavailable",
+			method: "POST",
+			v1: &extension.V1{
+				Hostname:    "mlab1-foo01.mlab-oti.measurement-lab.org",
+				IPv4Address: "192.168.1.1",
+				LastBoot:    time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery:    "p=unreachable",
+			},
+			status:   http.StatusBadGateway,
 			password: "testpassword",
 		},
 		{
@@ -269,9 +602,17 @@ func Test_bmcHandler(t *testing.T) {
 			password: "testpassword",
 		},
 	}
+	// Capture the logs, which must not contain passwords.
+	var logs bytes.Buffer
+	logger, _ := logging.New(&logs, "json", slog.LevelDebug)
+	orig := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(orig) })
+
 	for _, tt := range tests {
 		fp := &fakePasswordStore{}
 		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
 			f := NewBmcHandler(fp)
 			ext := extension.Request{V1: tt.v1}
 			req := httptest.NewRequest(
@@ -284,14 +625,38 @@ func Test_bmcHandler(t *testing.T) {
 				t.Errorf("bmcPasswordStore: bad status code: got %d; want %d",
 					rec.Code, tt.status)
 			}
+			// The address the request came from is recorded, not the
+			// address claimed in its body.
+			if rec.Code == http.StatusOK && fp.sourceIP != "192.0.2.1" {
+				t.Errorf("bmcPasswordStore: SourceIP = %q, want %q", fp.sourceIP, "192.0.2.1")
+			}
+			if strings.Contains(logs.String(), "p=somepass") {
+				t.Errorf("bmcPasswordStore: logged the password: %s", logs.String())
+			}
 		})
 	}
 }
 
+// fakeNodeManager fails all actions with err.
+type fakeNodeManager struct {
+	err error
+}
+
+func (f *fakeNodeManager) Delete(ctx context.Context, target string) error   { return f.err }
+func (f *fakeNodeManager) Cordon(ctx context.Context, target string) error   { return f.err }
+func (f *fakeNodeManager) Uncordon(ctx context.Context, target string) error { return f.err }
+func (f *fakeNodeManager) Label(ctx context.Context, target string, changes []string) error {
+	return f.err
+}
+func (f *fakeNodeManager) Taint(ctx context.Context, target string, changes []string) error {
+	return f.err
+}
+
 func Test_nodeHandler(t *testing.T) {
 	tests := []struct {
 		action  string
 		command string
+		err     error
 		method  string
 		name    string
 		status  int
@@ -319,6 +684,155 @@ func Test_nodeHandler(t *testing.T) {
 			},
 			status: http.StatusInternalServerError,
 		},
+		{
+			name:    "success-cordon",
+			action:  "cordon",
+			command: "/bin/true",
+			method:  "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:    "success-uncordon",
+			action:  "uncordon",
+			command: "/bin/true",
+			method:  "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:    "success-label",
+			action:  "label",
+			command: "/bin/true",
+			method:  "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery: "label=mlab/maintenance%3Dtrue",
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:    "success-taint",
+			action:  "taint",
+			command: "/bin/true",
+			method:  "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery: "taint=mlab/maintenance%3Dtrue:NoSchedule",
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:    "failure-label-not-allowed",
+			action:  "label",
+			command: "/bin/true",
+			method:  "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery: "label=mlab/type%3Dvirtual",
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name:    "failure-taint-invalid",
+			action:  "taint",
+			command: "/bin/true",
+			method:  "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery: "taint=mlab/maintenance%3Dtrue",
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:    "failure-bad-query",
+			action:  "label",
+			command: "/bin/true",
+			method:  "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery: "label=%zz",
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:    "success-delete-ignores-bad-query",
+			action:  "delete",
+			command: "/bin/true",
+			method:  "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery: "label=%zz",
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:   "success-delete-not-found",
+			action: "delete",
+			err:    fmt.Errorf("%w: nodes not found", node.ErrNotFound),
+			method: "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:   "failure-cordon-not-found",
+			action: "cordon",
+			err:    fmt.Errorf("%w: nodes not found", node.ErrNotFound),
+			method: "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+			},
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "failure-forbidden",
+			action: "delete",
+			err:    fmt.Errorf("%w: nodes is forbidden", node.ErrForbidden),
+			method: "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "failure-unknown-cluster",
+			action: "delete",
+			err:    fmt.Errorf("%w: no cluster for project", cluster.ErrUnknownCluster),
+			method: "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-staging.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "failure-conflict",
+			action: "taint",
+			err:    fmt.Errorf("%w: the object has been modified", node.ErrConflict),
+			method: "POST",
+			v1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+			},
+			status: http.StatusConflict,
+		},
 		{
 			action: "bad-action",
 			name:   "failure-bad-action",
@@ -345,17 +859,24 @@ func Test_nodeHandler(t *testing.T) {
 			method: "POST",
 			v1: &extension.V1{
 				Hostname: "mlab1-foo01.mlab-oti.measurement-lab.org",
-				LastBoot: time.Now().UTC().Add(-125 * time.Minute),
+				LastBoot: time.Now().UTC().Add(-135 * time.Minute),
 			},
 			status: http.StatusRequestTimeout,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			nm := &node.Manager{
-				Command: &node.Command{
+			var nm node.Manager = &node.KubectlManager{
+				Runner: &exec.Command{
 					Path: tt.command,
 				},
+				Allowlist: &node.Allowlist{
+					Labels: map[string][]string{"mlab/maintenance": {"true"}},
+					Taints: map[string][]string{"mlab/maintenance": {"true"}},
+				},
+			}
+			if tt.err != nil {
+				nm = &fakeNodeManager{err: tt.err}
 			}
 			nh := NewNodeHandler(nm, tt.action)
 			ext := extension.Request{V1: tt.v1}
@@ -372,3 +893,146 @@ func Test_nodeHandler(t *testing.T) {
 		})
 	}
 }
+
+func Test_nodeHandlerReplayRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		retry  int
+	}{
+		{
+			name:   "success-retry-after-backend-error",
+			err:    fmt.Errorf("connection refused"),
+			status: http.StatusInternalServerError,
+			retry:  http.StatusInternalServerError,
+		},
+		{
+			name:   "failure-retry-after-rejection",
+			err:    fmt.Errorf("%w: nodes not found", node.ErrNotFound),
+			status: http.StatusNotFound,
+			retry:  http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nh := NewNodeHandler(&fakeNodeManager{err: tt.err}, "cordon",
+				WithReplayProtection(NewMemorySeenStore(), true))
+			ext := extension.Request{V1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+				RawQuery: "session_id=1234",
+			}}
+			for i, want := range []int{tt.status, tt.retry} {
+				req := httptest.NewRequest("POST", "/v1/node/cordon", strings.NewReader(ext.Encode()))
+				rec := httptest.NewRecorder()
+
+				nh.ServeHTTP(rec, req)
+
+				if rec.Code != want {
+					t.Errorf("nodeHandler: request %d: bad status code: got %d; want %d", i, rec.Code, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_nodeHandlerReplayPerAction(t *testing.T) {
+	store := NewMemorySeenStore()
+	ext := extension.Request{V1: &extension.V1{
+		Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+		LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+		RawQuery: "session_id=1234",
+	}}
+	// The same session may cordon and later uncordon the node, but not
+	// repeat either action.
+	for _, step := range []struct {
+		action string
+		status int
+	}{
+		{action: "cordon", status: http.StatusOK},
+		{action: "uncordon", status: http.StatusOK},
+		{action: "cordon", status: http.StatusConflict},
+	} {
+		nh := NewNodeHandler(&fakeNodeManager{}, step.action, WithReplayProtection(store, true))
+		req := httptest.NewRequest("POST", "/v1/node/"+step.action, strings.NewReader(ext.Encode()))
+		rec := httptest.NewRecorder()
+
+		nh.ServeHTTP(rec, req)
+
+		if rec.Code != step.status {
+			t.Errorf("nodeHandler %s: bad status code: got %d; want %d", step.action, rec.Code, step.status)
+		}
+	}
+}
+
+func Test_nodeHandlerOutcomes(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		lastBoot time.Duration
+		outcome  string
+		site     string
+		machine  string
+	}{
+		{
+			name:     "success",
+			lastBoot: -5 * time.Minute,
+			outcome:  outcomeSuccess,
+			site:     "foo01",
+			machine:  "mlab1",
+		},
+		{
+			name:     "failure-backend",
+			err:      fmt.Errorf("kubectl failed"),
+			lastBoot: -5 * time.Minute,
+			outcome:  outcomeBackendError,
+			site:     "foo01",
+			machine:  "mlab1",
+		},
+		{
+			name:     "failure-forbidden",
+			err:      node.ErrForbidden,
+			lastBoot: -5 * time.Minute,
+			outcome:  outcomeForbidden,
+			site:     "foo01",
+			machine:  "mlab1",
+		},
+		{
+			name:     "failure-unknown-cluster",
+			err:      cluster.ErrUnknownCluster,
+			lastBoot: -5 * time.Minute,
+			outcome:  outcomeUnknownCluster,
+			site:     "foo01",
+			machine:  "mlab1",
+		},
+		{
+			name:     "failure-stale-boot",
+			lastBoot: -135 * time.Minute,
+			outcome:  outcomeStaleBoot,
+			site:     "foo01",
+			machine:  "mlab1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := metrics.ExtensionRequests.WithLabelValues("node", tt.site, tt.machine, tt.outcome)
+			before := testutil.ToFloat64(c)
+			h := NewNodeHandler(&fakeNodeManager{err: tt.err}, "cordon",
+				WithAuthenticators(&HMACAuthenticator{Keys: [][]byte{testHMACKey}}))
+			ext := extension.Request{V1: &extension.V1{
+				Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+				LastBoot: time.Now().UTC().Add(tt.lastBoot),
+			}}
+			body := ext.Encode()
+			req := httptest.NewRequest("POST", "/v1/node/cordon", strings.NewReader(body))
+			req.Header.Set(SignatureHeader, Sign(testHMACKey, []byte(body)))
+
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if after := testutil.ToFloat64(c); after != before+1 {
+				t.Errorf("extension_requests_total{outcome=%q} = %v, want %v", tt.outcome, after, before+1)
+			}
+		})
+	}
+}
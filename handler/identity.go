@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/m-lab/epoxy-extensions/internal/resolver"
+	"github.com/m-lab/epoxy/extension"
+)
+
+// Identity checks, as recorded in metrics.
+const (
+	checkForward = "forward"
+	checkReverse = "reverse"
+)
+
+var (
+	// ErrIdentityMismatch is returned when the DNS records of a machine do not
+	// match the identity claimed by its extension request.
+	ErrIdentityMismatch = errors.New("identity mismatch")
+	// ErrLookupFailed is returned when the DNS records of a machine could not
+	// be looked up, e.g. because the resolver timed out.
+	ErrLookupFailed = errors.New("lookup failed")
+)
+
+// IdentityError describes a failed identity check.
+type IdentityError struct {
+	// Check is the check that failed, "forward" or "reverse".
+	Check string
+	Err   error
+}
+
+func (e *IdentityError) Error() string {
+	return e.Check + " check: " + e.Err.Error()
+}
+
+func (e *IdentityError) Unwrap() error {
+	return e.Err
+}
+
+// IdentityVerifier checks the identity claimed by an extension request against
+// DNS: the claimed Hostname must resolve to the claimed addresses and, if
+// Reverse is set, each claimed address must resolve back to the Hostname.
+type IdentityVerifier struct {
+	Reverse bool
+}
+
+// lookupError wraps err in ErrIdentityMismatch if the name does not exist, and
+// in ErrLookupFailed otherwise.
+func lookupError(name string, err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return fmt.Errorf("%w: %s does not resolve", ErrIdentityMismatch, name)
+	}
+	return fmt.Errorf("%w: %s: %v", ErrLookupFailed, name, err)
+}
+
+// Verify checks the identity claimed by v1. It returns an *IdentityError
+// wrapping ErrIdentityMismatch or ErrLookupFailed if the check fails.
+func (iv *IdentityVerifier) Verify(v1 *extension.V1) error {
+	var claimed []net.IP
+	for _, a := range []string{v1.IPv4Address, v1.IPv6Address} {
+		if a == "" {
+			continue
+		}
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return &IdentityError{checkForward, fmt.Errorf("%w: bad address %q", ErrIdentityMismatch, a)}
+		}
+		claimed = append(claimed, ip)
+	}
+	if len(claimed) == 0 {
+		return &IdentityError{checkForward, fmt.Errorf("%w: no addresses claimed", ErrIdentityMismatch)}
+	}
+
+	addrs, err := resolver.LookupHost(v1.Hostname)
+	if err != nil {
+		return &IdentityError{checkForward, lookupError(v1.Hostname, err)}
+	}
+	for _, ip := range claimed {
+		if !containsIP(addrs, ip) {
+			return &IdentityError{checkForward, fmt.Errorf("%w: %s does not resolve to %s", ErrIdentityMismatch, v1.Hostname, ip)}
+		}
+	}
+
+	if !iv.Reverse {
+		return nil
+	}
+	for _, ip := range claimed {
+		names, err := resolver.LookupAddr(ip.String())
+		if err != nil {
+			return &IdentityError{checkReverse, lookupError(ip.String(), err)}
+		}
+		if !containsName(names, v1.Hostname) {
+			return &IdentityError{checkReverse, fmt.Errorf("%w: %s does not resolve to %s", ErrIdentityMismatch, ip, v1.Hostname)}
+		}
+	}
+	return nil
+}
+
+// containsIP returns whether addrs contains ip.
+func containsIP(addrs []string, ip net.IP) bool {
+	for _, a := range addrs {
+		if ip.Equal(net.ParseIP(a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsName returns whether names contains the DNS name name, ignoring case
+// and trailing dots.
+func containsName(names []string, name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	for _, n := range names {
+		if strings.EqualFold(strings.TrimSuffix(n, "."), name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/m-lab/epoxy-extensions/internal/resolver"
+	"github.com/m-lab/epoxy/extension"
+)
+
+const testHostname = "mlab1-foo01.mlab-oti.measurement-lab.org"
+
+// fakeDNS replaces the DNS lookups of the resolver with lookups in the given
+// records, restoring them when the test ends.
+func fakeDNS(t *testing.T, forward map[string][]string, reverse map[string][]string) {
+	t.Helper()
+	origHost, origAddr := resolver.LookupHost, resolver.LookupAddr
+	t.Cleanup(func() {
+		resolver.LookupHost, resolver.LookupAddr = origHost, origAddr
+	})
+	lookup := func(records map[string][]string) func(string) ([]string, error) {
+		return func(name string) ([]string, error) {
+			if name == "timeout.measurement-lab.org" {
+				return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+			}
+			r, ok := records[name]
+			if !ok {
+				return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+			}
+			return r, nil
+		}
+	}
+	resolver.LookupHost = lookup(forward)
+	resolver.LookupAddr = lookup(reverse)
+}
+
+func Test_IdentityVerifier(t *testing.T) {
+	fakeDNS(t,
+		map[string][]string{
+			testHostname:                      {"192.0.2.1", "2001:db8::1"},
+			"timeout.measurement-lab.org":     nil,
+			"mlab2-foo01.measurement-lab.org": {"192.0.2.2"},
+		},
+		map[string][]string{
+			"192.0.2.1":   {testHostname + "."},
+			"2001:db8::1": {"MLAB1-FOO01.mlab-oti.measurement-lab.org."},
+			"192.0.2.2":   {"other.example.com."},
+		},
+	)
+	tests := []struct {
+		name    string
+		reverse bool
+		v1      *extension.V1
+		check   string
+		wantErr error
+	}{
+		{
+			name: "success-forward",
+			v1:   &extension.V1{Hostname: testHostname, IPv4Address: "192.0.2.1"},
+		},
+		{
+			name:    "success-reverse",
+			reverse: true,
+			v1:      &extension.V1{Hostname: testHostname, IPv4Address: "192.0.2.1", IPv6Address: "2001:db8:0::1"},
+		},
+		{
+			name:    "failure-forward-mismatch",
+			v1:      &extension.V1{Hostname: testHostname, IPv4Address: "192.0.2.2"},
+			check:   checkForward,
+			wantErr: ErrIdentityMismatch,
+		},
+		{
+			name:    "failure-forward-not-found",
+			v1:      &extension.V1{Hostname: "mlab3-foo01.mlab-oti.measurement-lab.org", IPv4Address: "192.0.2.1"},
+			check:   checkForward,
+			wantErr: ErrIdentityMismatch,
+		},
+		{
+			name:    "failure-forward-timeout",
+			v1:      &extension.V1{Hostname: "timeout.measurement-lab.org", IPv4Address: "192.0.2.1"},
+			check:   checkForward,
+			wantErr: ErrLookupFailed,
+		},
+		{
+			name:    "failure-no-addresses",
+			v1:      &extension.V1{Hostname: testHostname},
+			check:   checkForward,
+			wantErr: ErrIdentityMismatch,
+		},
+		{
+			name:    "failure-bad-address",
+			v1:      &extension.V1{Hostname: testHostname, IPv4Address: "lol"},
+			check:   checkForward,
+			wantErr: ErrIdentityMismatch,
+		},
+		{
+			name:    "failure-reverse-mismatch",
+			reverse: true,
+			v1:      &extension.V1{Hostname: "mlab2-foo01.measurement-lab.org", IPv4Address: "192.0.2.2"},
+			check:   checkReverse,
+			wantErr: ErrIdentityMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iv := &IdentityVerifier{Reverse: tt.reverse}
+			err := iv.Verify(tt.v1)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify(): error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+			var idErr *IdentityError
+			if !errors.As(err, &idErr) || idErr.Check != tt.check {
+				t.Errorf("Verify(): error = %v, want %s check to fail", err, tt.check)
+			}
+		})
+	}
+}
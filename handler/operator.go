@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/m-lab/epoxy-extensions/bmc"
+	"github.com/m-lab/epoxy-extensions/logging"
+)
+
+// Operators maps the names of the operators allowed to use the operator API to
+// their bearer tokens.
+type Operators map[string]string
+
+// LoadOperators reads a JSON object mapping operator names to bearer tokens
+// from path. An empty path returns no operators, which rejects all requests.
+func LoadOperators(path string) (Operators, error) {
+	if path == "" {
+		return Operators{}, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	o := Operators{}
+	if err := json.Unmarshal(b, &o); err != nil {
+		return nil, fmt.Errorf("could not parse operators: %v", err)
+	}
+	for name, token := range o {
+		if name == "" || len(token) < 16 {
+			return nil, fmt.Errorf("operator %q: token must be at least 16 characters long", name)
+		}
+	}
+	return o, nil
+}
+
+// authenticate returns the name of the operator whose bearer token is in the
+// Authorization header of req.
+func (o Operators) authenticate(req *http.Request) (string, bool) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == req.Header.Get("Authorization") {
+		return "", false
+	}
+	found := ""
+	for name, t := range o {
+		// Compare with all tokens in constant time.
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
+// operatorHandler implements the http.Handler interface for the authenticated
+// operator API, which lets operators inspect and roll back BMC credentials.
+// Unlike the extensions, it is not called by ePoxy.
+type operatorHandler struct {
+	passwordStore bmc.PasswordStore
+	operators     Operators
+	action        string
+}
+
+// ServeHTTP is the request handler for operator requests.
+func (o *operatorHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context()).With("operator_action", o.action)
+
+	operator, ok := o.operators.authenticate(req)
+	if !ok {
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	method := http.MethodGet
+	if o.action == "rollback" {
+		method = http.MethodPost
+	}
+	logger = logger.With("operator", operator)
+	if req.Method != method {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	var result interface{}
+	var err error
+	switch o.action {
+	case "list":
+		project := query.Get("project")
+		if project == "" {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		result, err = o.passwordStore.List(project)
+	case "history":
+		result, err = o.passwordStore.History(query.Get("hostname"))
+	case "rollback":
+		version, verr := strconv.Atoi(query.Get("version"))
+		if verr != nil || version < 1 {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sourceIP := sourceAddress(req)
+		logger.Info("rolling back BMC password", "hostname", query.Get("hostname"), "version", version)
+		result, err = o.passwordStore.Rollback(query.Get("hostname"), version, "operator:"+operator, sourceIP)
+	default:
+		err = fmt.Errorf("unknown operator action '%s'", o.action)
+	}
+
+	if err != nil {
+		logger.Warn("operator request failed", "error", err)
+		if errors.Is(err, bmc.ErrInvalidHostname) {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, bmc.ErrVersionNotFound) {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	json.NewEncoder(resp).Encode(result)
+}
+
+// NewOperatorHandler returns a new operatorHandler for the given action, one of
+// "list", "history" or "rollback".
+func NewOperatorHandler(store bmc.PasswordStore, operators Operators, action string) http.Handler {
+	return &operatorHandler{
+		passwordStore: store,
+		operators:     operators,
+		action:        action,
+	}
+}
@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/epoxy-extensions/bmc"
+)
+
+const testOperatorToken = "0123456789abcdef"
+
+func Test_LoadOperators(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			content: `{"alice": "0123456789abcdef"}`,
+		},
+		{
+			name:    "failure-bad-json",
+			content: `{"alice": `,
+			wantErr: true,
+		},
+		{
+			name:    "failure-short-token",
+			content: `{"alice": "short"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "operators.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("failed to write operators: %v", err)
+			}
+			_, err := LoadOperators(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadOperators(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	o, err := LoadOperators("")
+	if err != nil || len(o) != 0 {
+		t.Errorf("LoadOperators(\"\") = %v, %v; want no operators", o, err)
+	}
+}
+
+func Test_operatorHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  string
+		method  string
+		query   string
+		auth    string
+		status  int
+		version int
+	}{
+		{
+			name:    "success-list",
+			action:  "list",
+			method:  "GET",
+			query:   "project=mlab-oti",
+			auth:    "Bearer " + testOperatorToken,
+			status:  http.StatusOK,
+			version: 2,
+		},
+		{
+			name:   "failure-list-no-project",
+			action: "list",
+			method: "GET",
+			auth:   "Bearer " + testOperatorToken,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "failure-list-error",
+			action: "list",
+			method: "GET",
+			query:  "project=lol",
+			auth:   "Bearer " + testOperatorToken,
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:    "success-history",
+			action:  "history",
+			method:  "GET",
+			query:   "hostname=mlab1-foo01.mlab-oti.measurement-lab.org",
+			auth:    "Bearer " + testOperatorToken,
+			status:  http.StatusOK,
+			version: 1,
+		},
+		{
+			name:   "failure-history-bad-hostname",
+			action: "history",
+			method: "GET",
+			query:  "hostname=lol",
+			auth:   "Bearer " + testOperatorToken,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:    "success-rollback",
+			action:  "rollback",
+			method:  "POST",
+			query:   "hostname=mlab1-foo01.mlab-oti.measurement-lab.org&version=1",
+			auth:    "Bearer " + testOperatorToken,
+			status:  http.StatusOK,
+			version: 3,
+		},
+		{
+			name:   "failure-rollback-unknown-version",
+			action: "rollback",
+			method: "POST",
+			query:  "hostname=mlab1-foo01.mlab-oti.measurement-lab.org&version=5",
+			auth:   "Bearer " + testOperatorToken,
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "failure-rollback-bad-version",
+			action: "rollback",
+			method: "POST",
+			query:  "hostname=mlab1-foo01.mlab-oti.measurement-lab.org&version=lol",
+			auth:   "Bearer " + testOperatorToken,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "failure-rollback-get",
+			action: "rollback",
+			method: "GET",
+			query:  "hostname=mlab1-foo01.mlab-oti.measurement-lab.org&version=1",
+			auth:   "Bearer " + testOperatorToken,
+			status: http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "failure-no-token",
+			action: "list",
+			method: "GET",
+			query:  "project=mlab-oti",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "failure-wrong-token",
+			action: "list",
+			method: "GET",
+			query:  "project=mlab-oti",
+			auth:   "Bearer fedcba9876543210",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "failure-not-bearer",
+			action: "list",
+			method: "GET",
+			query:  "project=mlab-oti",
+			auth:   testOperatorToken,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "failure-unknown-action",
+			action: "lol",
+			method: "GET",
+			auth:   "Bearer " + testOperatorToken,
+			status: http.StatusInternalServerError,
+		},
+	}
+	operators := Operators{"alice": testOperatorToken}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewOperatorHandler(&fakePasswordStore{}, operators, tt.action)
+			req := httptest.NewRequest(tt.method, "/v1/operator/bmc/"+tt.action+"?"+tt.query, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("operatorHandler: bad status code: got %d; want %d", rec.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var m bmc.Metadata
+			switch tt.action {
+			case "rollback":
+				err := json.Unmarshal(rec.Body.Bytes(), &m)
+				if err != nil {
+					t.Fatalf("operatorHandler: bad response: %v", err)
+				}
+				if m.SetBy != "operator:alice" || m.SourceIP != "192.0.2.1" {
+					t.Errorf("operatorHandler: rollback recorded as %q from %q", m.SetBy, m.SourceIP)
+				}
+			default:
+				var list []bmc.Metadata
+				err := json.Unmarshal(rec.Body.Bytes(), &list)
+				if err != nil || len(list) == 0 {
+					t.Fatalf("operatorHandler: bad response: %v, %v", list, err)
+				}
+				m = list[0]
+			}
+			if m.Version != tt.version {
+				t.Errorf("operatorHandler: got version %d; want %d", m.Version, tt.version)
+			}
+		})
+	}
+}
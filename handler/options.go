@@ -0,0 +1,421 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/logging"
+	"github.com/m-lab/epoxy-extensions/metrics"
+	"github.com/m-lab/epoxy/extension"
+	"github.com/m-lab/go/host"
+)
+
+// DefaultMaxUptime is the default maximum amount of time since a machine has
+// booted that extensions will accept requests from that host.
+const DefaultMaxUptime time.Duration = 120 * time.Minute
+
+// DefaultClockSkew is the default tolerance for differences between the clocks
+// of the ePoxy server and of this server.
+const DefaultClockSkew time.Duration = 5 * time.Minute
+
+// DefaultReplayTTL is the default time nonces are remembered for extensions
+// that accept requests however long ago the machine booted.
+const DefaultReplayTTL time.Duration = 7 * 24 * time.Hour
+
+// Reasons for rejecting the LastBoot of a request, as recorded in metrics.
+const (
+	lastBootStale  = "stale"
+	lastBootFuture = "future"
+)
+
+// Outcomes of extension requests, as recorded in metrics.
+const (
+	outcomeSuccess            = "success"
+	outcomeBadMethod          = "bad_method"
+	outcomeBadBody            = "bad_body"
+	outcomeAuthFailure        = "auth_failure"
+	outcomeRateLimited        = "rate_limited"
+	outcomeStaleBoot          = "stale_boot"
+	outcomeFutureBoot         = "future_boot"
+	outcomeIdentityMismatch   = "identity_mismatch"
+	outcomeLookupFailure      = "lookup_failure"
+	outcomeMissingNonce       = "missing_nonce"
+	outcomeReplay             = "replay"
+	outcomeSeenStoreError     = "seen_store_error"
+	outcomeBadRequest         = "bad_request"
+	outcomeForbidden          = "forbidden"
+	outcomeNotFound           = "not_found"
+	outcomeConflict           = "conflict"
+	outcomeVerificationFailed = "verification_failed"
+	outcomeBMCUnavailable     = "bmc_unavailable"
+	outcomeUnsupported        = "unsupported"
+	outcomeUnknownCluster     = "unknown_cluster"
+	outcomeBackendError       = "backend_error"
+)
+
+// maxBodySize limits the size of extension request bodies.
+const maxBodySize = 1 << 20
+
+// options holds the checks extension handlers apply to requests before acting
+// on them.
+type options struct {
+	// extension is the name of the extension, e.g. "token".
+	extension string
+	// action is the action of extensions serving several, e.g. "cordon" for
+	// the node extension, or empty.
+	action         string
+	maxUptime      time.Duration
+	clockSkew      time.Duration
+	authenticators []Authenticator
+	identity       *IdentityVerifier
+	hostLimiter    Limiter
+	ipLimiter      Limiter
+	seen           SeenStore
+	requireNonce   bool
+	replayTTL      time.Duration
+}
+
+// Option configures an extension handler.
+type Option func(*options)
+
+// WithMaxUptime sets how long after a machine booted requests from it are
+// accepted. Zero accepts requests however long ago the machine booted.
+func WithMaxUptime(d time.Duration) Option {
+	return func(o *options) {
+		o.maxUptime = d
+	}
+}
+
+// WithClockSkew sets the tolerance for differences between the clocks of the
+// ePoxy server, which reports when machines booted, and of this server.
+func WithClockSkew(d time.Duration) Option {
+	return func(o *options) {
+		o.clockSkew = d
+	}
+}
+
+// WithAuthenticators requires requests to pass all of the given
+// authenticators.
+func WithAuthenticators(a ...Authenticator) Option {
+	return func(o *options) {
+		o.authenticators = append(o.authenticators, a...)
+	}
+}
+
+// WithIdentityVerifier requires the identity claimed by requests to match DNS.
+func WithIdentityVerifier(v *IdentityVerifier) Option {
+	return func(o *options) {
+		o.identity = v
+	}
+}
+
+// WithHostLimiter limits the rate of requests of each machine, by the hostname
+// it claims. Requests are only counted once they pass authentication, the last
+// boot check and the identity check, so that requests failing those cannot use
+// up the limit of a machine. Without authenticators or an identity verifier,
+// any caller claiming the hostname of a machine counts against its limit.
+func WithHostLimiter(l Limiter) Option {
+	return func(o *options) {
+		o.hostLimiter = l
+	}
+}
+
+// WithIPLimiter limits the rate of requests from each source address.
+// Requests are counted before anything else is checked.
+func WithIPLimiter(l Limiter) Option {
+	return func(o *options) {
+		o.ipLimiter = l
+	}
+}
+
+// WithReplayProtection refuses requests whose nonce, passed in one of the
+// NonceParams of the RawQuery, was already redeemed for the extension. Nonces
+// are remembered by store for as long as their request would be accepted, or
+// for the replay TTL if the max uptime is zero. If required, requests without a
+// nonce are refused as well.
+func WithReplayProtection(store SeenStore, required bool) Option {
+	return func(o *options) {
+		o.seen = store
+		o.requireNonce = required
+	}
+}
+
+// WithReplayTTL sets how long nonces are remembered when the max uptime is
+// zero, since the last boot time of the machine then no longer bounds how long
+// a captured request would be accepted.
+func WithReplayTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.replayTTL = d
+	}
+}
+
+// newOptions returns the options of the named extension.
+func newOptions(extension string, opts []Option) options {
+	o := options{
+		extension: extension,
+		maxUptime: DefaultMaxUptime,
+		clockSkew: DefaultClockSkew,
+		replayTTL: DefaultReplayTTL,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// checkRequest rejects requests that are not POSTs, exceed a rate limit, fail
+// authentication, cannot be decoded, come from machines that booted too long
+// ago or claim to have booted in the future, fail the identity check, exceed
+// the rate limit of their machine, or are replays, writing the status of the
+// response. Otherwise, it returns the decoded extension request.
+func (o *options) checkRequest(resp http.ResponseWriter, req *http.Request) (*extension.Request, bool) {
+	logger := o.logger(req)
+
+	// Require requests to be POSTs.
+	if req.Method != http.MethodPost {
+		o.record("", outcomeBadMethod)
+		writeError(resp, req, http.StatusMethodNotAllowed, codeBadMethod, "extension requests must be POSTs")
+		return nil, false
+	}
+
+	if !o.allow(resp, req, o.ipLimiter, limitIP, sourceAddress(req), "") {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(resp, req.Body, maxBodySize))
+	if err != nil {
+		logger.Warn("failed to read request body", "error", err)
+		o.record("", outcomeBadBody)
+		writeError(resp, req, http.StatusBadRequest, codeBadBody, "failed to read request body")
+		return nil, false
+	}
+
+	for _, a := range o.authenticators {
+		if err := a.Authenticate(req, body); err != nil {
+			logger.Warn("authentication failed", "authenticator", a.Name(), "error", err)
+			metrics.AuthFailures.WithLabelValues(o.extension, a.Name()).Inc()
+			o.record("", outcomeAuthFailure)
+			writeError(resp, req, http.StatusUnauthorized, codeUnauthenticated, "request failed authentication")
+			return nil, false
+		}
+	}
+
+	ext, err := decodeMessage(body)
+	if err != nil || ext.V1 == nil {
+		if err == nil {
+			err = errors.New("missing v1 request")
+		}
+		logger.Warn("failed to decode request", "error", err)
+		o.record("", outcomeBadBody)
+		writeError(resp, req, http.StatusBadRequest, codeBadBody, "request body is not an extension request")
+		return nil, false
+	}
+	logger = logger.With("hostname", ext.V1.Hostname)
+
+	if reason := o.checkLastBoot(ext.V1.LastBoot); reason != "" {
+		logger.Warn("rejecting last boot time", "reason", reason, "last_boot", ext.V1.LastBoot)
+		metrics.LastBootRejections.WithLabelValues(o.extension, reason).Inc()
+		// The hostname is only verified at this point if the request
+		// passed authentication.
+		hostname := ""
+		if len(o.authenticators) > 0 {
+			hostname = ext.V1.Hostname
+		}
+		if reason == lastBootFuture {
+			o.record(hostname, outcomeFutureBoot)
+			writeError(resp, req, http.StatusBadRequest, codeFutureBoot, "last boot time is in the future")
+		} else {
+			o.record(hostname, outcomeStaleBoot)
+			writeError(resp, req, http.StatusRequestTimeout, codeStaleBoot, "machine booted too long ago")
+		}
+		return nil, false
+	}
+
+	if o.identity != nil {
+		if err := o.identity.Verify(ext.V1); err != nil {
+			logger.Warn("identity check failed", "error", err)
+			if errors.Is(err, ErrLookupFailed) {
+				// Do not blame the machine for a failing resolver.
+				o.record("", outcomeLookupFailure)
+				writeError(resp, req, http.StatusServiceUnavailable, codeLookupFailed, "failed to look up the identity of the machine")
+				return nil, false
+			}
+			check := checkForward
+			var idErr *IdentityError
+			if errors.As(err, &idErr) {
+				check = idErr.Check
+			}
+			metrics.IdentityMismatches.WithLabelValues(o.extension, check).Inc()
+			o.record("", outcomeIdentityMismatch)
+			writeError(resp, req, http.StatusForbidden, codeIdentityMismatch, "request does not match the identity of the machine")
+			return nil, false
+		}
+	}
+
+	if !o.allow(resp, req, o.hostLimiter, limitHost, ext.V1.Hostname, ext.V1.Hostname) {
+		return nil, false
+	}
+
+	if o.seen != nil && !o.redeem(resp, req, logger, ext.V1) {
+		return nil, false
+	}
+
+	logger.Info("extension request", requestAttrs(ext.V1)...)
+	return ext, true
+}
+
+// redeem redeems the nonce of v1, rejecting the request if it has none and
+// nonces are required, or if the nonce was already redeemed.
+func (o *options) redeem(resp http.ResponseWriter, req *http.Request, logger *slog.Logger, v1 *extension.V1) bool {
+	n, err := nonce(v1.RawQuery)
+	if err != nil || (n == "" && o.requireNonce) {
+		logger.Warn("missing nonce", "error", err)
+		o.record(v1.Hostname, outcomeMissingNonce)
+		writeError(resp, req, http.StatusBadRequest, codeMissingNonce, "request has no nonce")
+		return false
+	}
+	if n == "" {
+		return true
+	}
+	// Remember the nonce for as long as checkLastBoot accepts the request.
+	expires := v1.LastBoot.Add(o.maxUptime + o.clockSkew)
+	if o.maxUptime == 0 {
+		// Requests are accepted however long ago the machine booted, so
+		// only the replay TTL bounds how long the nonce is remembered.
+		expires = time.Now().Add(o.replayTTL)
+	}
+	ok, err := o.seen.Redeem(o.nonceKey(n), expires)
+	if err != nil {
+		logger.Error("failed to redeem nonce", "error", err)
+		o.record(v1.Hostname, outcomeSeenStoreError)
+		writeError(resp, req, http.StatusServiceUnavailable, codeSeenStoreUnavailable, "failed to check the nonce of the request")
+		return false
+	}
+	if !ok {
+		logger.Warn("replayed request", "nonce", n)
+		metrics.Replays.WithLabelValues(o.extension).Inc()
+		o.record(v1.Hostname, outcomeReplay)
+		writeError(resp, req, http.StatusConflict, codeReplay, "request nonce was already used")
+		return false
+	}
+	return true
+}
+
+// nonceKey returns the key of nonce n in the SeenStore. Nonces are redeemed
+// separately for each action, so that a machine may use the same session ID
+// for e.g. cordoning and later uncordoning its node.
+func (o *options) nonceKey(n string) string {
+	if o.action != "" {
+		return o.extension + "/" + o.action + "/" + n
+	}
+	return o.extension + "/" + n
+}
+
+// done records the outcome of a request that passed checkRequest. If the
+// request failed in a backend, its nonce is released, so that the machine can
+// retry the request with the same nonce once the backend recovers.
+func (o *options) done(req *http.Request, v1 *extension.V1, outcome string) {
+	o.record(v1.Hostname, outcome)
+	if o.seen == nil || !retryable(outcome) {
+		return
+	}
+	// The nonce was parsed successfully by redeem already.
+	n, _ := nonce(v1.RawQuery)
+	if n == "" {
+		return
+	}
+	if err := o.seen.Release(o.nonceKey(n)); err != nil {
+		o.logger(req).Error("failed to release nonce", "hostname", v1.Hostname, "error", err)
+	}
+}
+
+// retryable returns whether requests with the given outcome failed for reasons
+// other than the request itself, and may succeed if sent again.
+func retryable(outcome string) bool {
+	switch outcome {
+	case outcomeBackendError, outcomeBMCUnavailable, outcomeLookupFailure:
+		return true
+	}
+	return false
+}
+
+// allow counts a request for key against limiter, which may be nil. If the
+// request exceeds the limit, it rejects it with the time to wait in the
+// Retry-After header. hostname is empty if the request was not verified yet.
+func (o *options) allow(resp http.ResponseWriter, req *http.Request, limiter Limiter, limit string, key string, hostname string) bool {
+	if limiter == nil {
+		return true
+	}
+	ok, wait := limiter.Allow(key)
+	if ok {
+		return true
+	}
+	o.logger(req).Warn("rate limit exceeded", "limit", limit, "key", key, "retry_after", wait)
+	metrics.RateLimited.WithLabelValues(o.extension, limit).Inc()
+	o.record(hostname, outcomeRateLimited)
+	resp.Header().Set("Retry-After", retryAfter(wait))
+	writeError(resp, req, http.StatusTooManyRequests, codeRateLimited, "too many requests")
+	return false
+}
+
+// record counts a request from hostname with the given outcome. hostname is
+// empty if the request was rejected before its hostname was verified. The site
+// and machine of hostname are only used as labels if the extension verifies
+// hostnames, through authentication or the identity check, so that callers
+// cannot create time series by claiming arbitrary hostnames.
+func (o *options) record(hostname string, outcome string) {
+	site, machine := "unknown", "unknown"
+	if h, err := host.Parse(hostname); err == nil && o.verifiesHostname() {
+		site, machine = h.Site, h.Machine
+	}
+	metrics.ExtensionRequests.WithLabelValues(o.extension, site, machine, outcome).Inc()
+}
+
+// verifiesHostname returns whether requests must pass authentication or the
+// identity check before they are acted on.
+func (o *options) verifiesHostname() bool {
+	return len(o.authenticators) > 0 || o.identity != nil
+}
+
+// logger returns the logger of req for the extension.
+func (o *options) logger(req *http.Request) *slog.Logger {
+	return logging.FromContext(req.Context()).With("extension", o.extension)
+}
+
+// requestAttrs returns the attributes of v1 to log. Secrets in the RawQuery,
+// like BMC passwords, are redacted.
+func requestAttrs(v1 *extension.V1) []any {
+	return []any{
+		"ipv4_address", v1.IPv4Address,
+		"ipv6_address", v1.IPv6Address,
+		"last_boot", v1.LastBoot,
+		"raw_query", logging.RedactQuery(v1.RawQuery),
+	}
+}
+
+// checkLastBoot returns why lastBoot is not acceptable, or an empty string if
+// it is.
+func (o *options) checkLastBoot(lastBoot time.Time) string {
+	since := time.Since(lastBoot)
+	switch {
+	case since < -o.clockSkew:
+		// Machines cannot have booted in the future.
+		return lastBootFuture
+	case o.maxUptime > 0 && since > o.maxUptime+o.clockSkew:
+		// According to ePoxy the machine booted longer ago than we're
+		// willing to support.
+		return lastBootStale
+	}
+	return ""
+}
+
+// decodeMessage returns the extension request encoded in body.
+func decodeMessage(body []byte) (*extension.Request, error) {
+	ext := &extension.Request{}
+	err := ext.Decode(bytes.NewReader(body))
+	return ext, err
+}
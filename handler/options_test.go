@@ -0,0 +1,632 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/metrics"
+	"github.com/m-lab/epoxy/extension"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_checkRequest(t *testing.T) {
+	valid := (&extension.Request{V1: &extension.V1{
+		Hostname: "mlab1-foo01.mlab-oti.measurement-lab.org",
+		LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+	}}).Encode()
+	tests := []struct {
+		name      string
+		method    string
+		body      string
+		signature string
+		status    int
+		ok        bool
+	}{
+		{
+			name:      "success",
+			method:    "POST",
+			body:      valid,
+			signature: Sign(testHMACKey, []byte(valid)),
+			ok:        true,
+		},
+		{
+			name:   "failure-unsigned",
+			method: "POST",
+			body:   valid,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:      "failure-bad-body",
+			method:    "POST",
+			body:      "{",
+			signature: Sign(testHMACKey, []byte("{")),
+			status:    http.StatusBadRequest,
+		},
+		{
+			name:      "failure-too-large",
+			method:    "POST",
+			body:      strings.Repeat(" ", maxBodySize+1),
+			signature: Sign(testHMACKey, []byte(valid)),
+			status:    http.StatusBadRequest,
+		},
+		{
+			name:   "failure-get",
+			method: "GET",
+			status: http.StatusMethodNotAllowed,
+		},
+	}
+	o := newOptions("token", []Option{WithAuthenticators(&HMACAuthenticator{Keys: [][]byte{testHMACKey}})})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(metrics.AuthFailures.WithLabelValues("token", "hmac"))
+			req := httptest.NewRequest(tt.method, "/v1/allocate_k8s_token", strings.NewReader(tt.body))
+			if tt.signature != "" {
+				req.Header.Set(SignatureHeader, tt.signature)
+			}
+			rec := httptest.NewRecorder()
+
+			ext, ok := o.checkRequest(rec, req)
+
+			if ok != tt.ok {
+				t.Fatalf("checkRequest() = %v, want %v", ok, tt.ok)
+			}
+			if ok {
+				if ext.V1.Hostname != "mlab1-foo01.mlab-oti.measurement-lab.org" {
+					t.Errorf("checkRequest() returned %v", ext.V1)
+				}
+				return
+			}
+			if rec.Code != tt.status {
+				t.Errorf("checkRequest(): bad status code: got %d; want %d", rec.Code, tt.status)
+			}
+			after := testutil.ToFloat64(metrics.AuthFailures.WithLabelValues("token", "hmac"))
+			if wantFailures := tt.status == http.StatusUnauthorized; (after == before+1) != wantFailures {
+				t.Errorf("extension_auth_failures_total = %v, was %v", after, before)
+			}
+		})
+	}
+}
+
+func Test_checkRequestIdentity(t *testing.T) {
+	fakeDNS(t, map[string][]string{testHostname: {"192.0.2.1"}}, nil)
+	tests := []struct {
+		name     string
+		hostname string
+		ip       string
+		status   int
+	}{
+		{
+			name:     "success",
+			hostname: testHostname,
+			ip:       "192.0.2.1",
+			status:   http.StatusOK,
+		},
+		{
+			name:     "failure-mismatch",
+			hostname: testHostname,
+			ip:       "192.0.2.2",
+			status:   http.StatusForbidden,
+		},
+		{
+			name:     "failure-lookup",
+			hostname: "timeout.measurement-lab.org",
+			ip:       "192.0.2.1",
+			status:   http.StatusServiceUnavailable,
+		},
+	}
+	o := newOptions("node", []Option{WithIdentityVerifier(&IdentityVerifier{})})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(metrics.IdentityMismatches.WithLabelValues("node", "forward"))
+			body := (&extension.Request{V1: &extension.V1{
+				Hostname:    tt.hostname,
+				IPv4Address: tt.ip,
+				LastBoot:    time.Now().UTC().Add(-5 * time.Minute),
+			}}).Encode()
+			req := httptest.NewRequest("POST", "/v1/node/delete", strings.NewReader(body))
+			rec := httptest.NewRecorder()
+
+			_, ok := o.checkRequest(rec, req)
+
+			if ok != (tt.status == http.StatusOK) || rec.Code != tt.status {
+				t.Errorf("checkRequest() = %v, status %d; want status %d", ok, rec.Code, tt.status)
+			}
+			after := testutil.ToFloat64(metrics.IdentityMismatches.WithLabelValues("node", "forward"))
+			if (after == before+1) != (tt.status == http.StatusForbidden) {
+				t.Errorf("extension_identity_mismatches_total = %v, was %v", after, before)
+			}
+		})
+	}
+}
+
+func Test_checkRequestLastBoot(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		lastBoot time.Duration
+		status   int
+		reason   string
+	}{
+		{
+			name:     "success-default",
+			lastBoot: -119 * time.Minute,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "success-within-skew",
+			lastBoot: -123 * time.Minute,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "success-future-within-skew",
+			lastBoot: 4 * time.Minute,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "success-disabled",
+			opts:     []Option{WithMaxUptime(0)},
+			lastBoot: -30 * 24 * time.Hour,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "success-longer-window",
+			opts:     []Option{WithMaxUptime(24 * time.Hour)},
+			lastBoot: -23 * time.Hour,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "failure-stale",
+			lastBoot: -126 * time.Minute,
+			status:   http.StatusRequestTimeout,
+			reason:   lastBootStale,
+		},
+		{
+			name:     "failure-stale-no-skew",
+			opts:     []Option{WithClockSkew(0)},
+			lastBoot: -121 * time.Minute,
+			status:   http.StatusRequestTimeout,
+			reason:   lastBootStale,
+		},
+		{
+			name:     "failure-future",
+			opts:     []Option{WithMaxUptime(0)},
+			lastBoot: 6 * time.Minute,
+			status:   http.StatusBadRequest,
+			reason:   lastBootFuture,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOptions("node", tt.opts)
+			var before float64
+			if tt.reason != "" {
+				before = testutil.ToFloat64(metrics.LastBootRejections.WithLabelValues("node", tt.reason))
+			}
+			body := (&extension.Request{V1: &extension.V1{
+				Hostname: testHostname,
+				LastBoot: time.Now().UTC().Add(tt.lastBoot),
+			}}).Encode()
+			req := httptest.NewRequest("POST", "/v1/node/delete", strings.NewReader(body))
+			rec := httptest.NewRecorder()
+
+			_, ok := o.checkRequest(rec, req)
+
+			if ok != (tt.status == http.StatusOK) || rec.Code != tt.status {
+				t.Errorf("checkRequest() = %v, status %d; want status %d", ok, rec.Code, tt.status)
+			}
+			if tt.reason == "" {
+				return
+			}
+			after := testutil.ToFloat64(metrics.LastBootRejections.WithLabelValues("node", tt.reason))
+			if after != before+1 {
+				t.Errorf("extension_last_boot_rejections_total{reason=%q} = %v, want %v", tt.reason, after, before+1)
+			}
+		})
+	}
+}
+
+func Test_checkRequestLastBootLabels(t *testing.T) {
+	body := (&extension.Request{V1: &extension.V1{
+		Hostname: testHostname,
+		LastBoot: time.Now().UTC().Add(-3 * time.Hour),
+	}}).Encode()
+	tests := []struct {
+		name      string
+		opts      []Option
+		signature string
+		site      string
+		machine   string
+	}{
+		{
+			name:      "success-authenticated",
+			opts:      []Option{WithAuthenticators(&HMACAuthenticator{Keys: [][]byte{testHMACKey}})},
+			signature: Sign(testHMACKey, []byte(body)),
+			site:      "foo01",
+			machine:   "mlab1",
+		},
+		{
+			// The identity check runs after the last boot check.
+			name:    "success-identity-not-checked-yet",
+			opts:    []Option{WithIdentityVerifier(&IdentityVerifier{})},
+			site:    "unknown",
+			machine: "unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOptions("token", tt.opts)
+			c := metrics.ExtensionRequests.WithLabelValues("token", tt.site, tt.machine, outcomeStaleBoot)
+			before := testutil.ToFloat64(c)
+			req := httptest.NewRequest("POST", "/v1/allocate_k8s_token", strings.NewReader(body))
+			if tt.signature != "" {
+				req.Header.Set(SignatureHeader, tt.signature)
+			}
+
+			if _, ok := o.checkRequest(httptest.NewRecorder(), req); ok {
+				t.Fatalf("checkRequest() accepted a stale request")
+			}
+
+			if after := testutil.ToFloat64(c); after != before+1 {
+				t.Errorf("extension_requests_total = %v, want %v", after, before+1)
+			}
+		})
+	}
+}
+
+func Test_checkRequestRateLimit(t *testing.T) {
+	encode := func(hostname string) string {
+		return (&extension.Request{V1: &extension.V1{
+			Hostname: hostname,
+			LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+		}}).Encode()
+	}
+	other := "mlab2-foo01.mlab-oti.measurement-lab.org"
+	tests := []struct {
+		name       string
+		opts       []Option
+		remoteAddr string
+		body       string
+		limit      string
+		ok         bool
+	}{
+		{
+			name: "success-burst",
+			opts: []Option{
+				WithHostLimiter(NewMemoryLimiter(time.Minute, 2)),
+				WithIPLimiter(NewMemoryLimiter(time.Minute, 2)),
+			},
+			body: encode(testHostname),
+			ok:   true,
+		},
+		{
+			name:  "failure-host",
+			opts:  []Option{WithHostLimiter(NewMemoryLimiter(time.Minute, 1))},
+			body:  encode(testHostname),
+			limit: limitHost,
+		},
+		{
+			name: "success-other-host",
+			opts: []Option{WithHostLimiter(NewMemoryLimiter(time.Minute, 1))},
+			body: encode(other),
+			ok:   true,
+		},
+		{
+			name:  "failure-ip",
+			opts:  []Option{WithIPLimiter(NewMemoryLimiter(time.Minute, 1))},
+			body:  encode(other),
+			limit: limitIP,
+		},
+		{
+			name:       "success-other-ip",
+			opts:       []Option{WithIPLimiter(NewMemoryLimiter(time.Minute, 1))},
+			remoteAddr: "192.0.2.2:1234",
+			body:       encode(other),
+			ok:         true,
+		},
+		{
+			name: "success-unlimited",
+			body: encode(testHostname),
+			ok:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOptions("bmc", tt.opts)
+			// Use up the limits of testHostname and of the default address
+			// of test requests.
+			first := httptest.NewRequest("POST", "/v1/bmc_store_password", strings.NewReader(encode(testHostname)))
+			if _, ok := o.checkRequest(httptest.NewRecorder(), first); !ok {
+				t.Fatalf("checkRequest() of the first request failed")
+			}
+			c := metrics.RateLimited.WithLabelValues("bmc", tt.limit)
+			before := testutil.ToFloat64(c)
+			req := httptest.NewRequest("POST", "/v1/bmc_store_password", strings.NewReader(tt.body))
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			rec := httptest.NewRecorder()
+
+			_, ok := o.checkRequest(rec, req)
+
+			if ok != tt.ok {
+				t.Fatalf("checkRequest() = %v, want %v", ok, tt.ok)
+			}
+			if ok {
+				return
+			}
+			if rec.Code != http.StatusTooManyRequests {
+				t.Errorf("checkRequest(): bad status code: got %d; want %d", rec.Code, http.StatusTooManyRequests)
+			}
+			if got := rec.Header().Get("Retry-After"); got != "60" {
+				t.Errorf("checkRequest(): Retry-After = %q, want %q", got, "60")
+			}
+			if after := testutil.ToFloat64(c); after != before+1 {
+				t.Errorf("extension_rate_limited_total{limit=%q} = %v, want %v", tt.limit, after, before+1)
+			}
+		})
+	}
+}
+
+func Test_checkRequestRateLimitAfterChecks(t *testing.T) {
+	fakeDNS(t, map[string][]string{testHostname: {"192.0.2.1"}}, nil)
+	o := newOptions("bmc", []Option{
+		WithHostLimiter(NewMemoryLimiter(time.Minute, 1)),
+		WithIdentityVerifier(&IdentityVerifier{}),
+	})
+	// Requests failing the last boot or identity checks do not count
+	// against the limit of the machine they claim to be.
+	for _, v1 := range []*extension.V1{
+		{Hostname: testHostname, IPv4Address: "192.0.2.1", LastBoot: time.Now().UTC().Add(-24 * time.Hour)},
+		{Hostname: testHostname, IPv4Address: "192.0.2.2", LastBoot: time.Now().UTC().Add(-5 * time.Minute)},
+	} {
+		req := httptest.NewRequest("POST", "/v1/bmc_store_password", strings.NewReader((&extension.Request{V1: v1}).Encode()))
+		rec := httptest.NewRecorder()
+		if _, ok := o.checkRequest(rec, req); ok || rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("checkRequest() = %v, status %d; want a failed check", ok, rec.Code)
+		}
+	}
+	body := (&extension.Request{V1: &extension.V1{
+		Hostname:    testHostname,
+		IPv4Address: "192.0.2.1",
+		LastBoot:    time.Now().UTC().Add(-5 * time.Minute),
+	}}).Encode()
+	req := httptest.NewRequest("POST", "/v1/bmc_store_password", strings.NewReader(body))
+	if _, ok := o.checkRequest(httptest.NewRecorder(), req); !ok {
+		t.Errorf("checkRequest() refused the first valid request of the machine")
+	}
+}
+
+// failingSeenStore fails to redeem nonces.
+type failingSeenStore struct{}
+
+func (failingSeenStore) Redeem(key string, expires time.Time) (bool, error) {
+	return false, errors.New("store unavailable")
+}
+
+func (failingSeenStore) Release(key string) error {
+	return errors.New("store unavailable")
+}
+
+func Test_checkRequestReplay(t *testing.T) {
+	encode := func(rawQuery string) string {
+		return (&extension.Request{V1: &extension.V1{
+			Hostname: testHostname,
+			LastBoot: time.Now().UTC().Add(-5 * time.Minute),
+			RawQuery: rawQuery,
+		}}).Encode()
+	}
+	tests := []struct {
+		name      string
+		store     SeenStore
+		required  bool
+		rawQuery  string
+		extension string
+		status    int
+		outcome   string
+		ok        bool
+	}{
+		{
+			name:     "success-new-nonce",
+			rawQuery: "nonce=5678",
+			ok:       true,
+		},
+		{
+			name:      "success-other-extension",
+			rawQuery:  "nonce=1234",
+			extension: "node",
+			ok:        true,
+		},
+		{
+			name:    "failure-replay",
+			status:  http.StatusConflict,
+			outcome: outcomeReplay,
+		},
+		{
+			name:     "failure-replay-session-id",
+			rawQuery: "session_id=1234",
+			status:   http.StatusConflict,
+			outcome:  outcomeReplay,
+		},
+		{
+			name:     "success-optional",
+			rawQuery: "mode=worker",
+			ok:       true,
+		},
+		{
+			name:     "failure-required",
+			required: true,
+			rawQuery: "mode=worker",
+			status:   http.StatusBadRequest,
+			outcome:  outcomeMissingNonce,
+		},
+		{
+			name:     "failure-store",
+			store:    failingSeenStore{},
+			rawQuery: "nonce=5678",
+			status:   http.StatusServiceUnavailable,
+			outcome:  outcomeSeenStoreError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemorySeenStore()
+			first := newOptions("bmc", []Option{WithReplayProtection(store, false)})
+			req := httptest.NewRequest("POST", "/v1/bmc_store_password", strings.NewReader(encode("nonce=1234")))
+			if _, ok := first.checkRequest(httptest.NewRecorder(), req); !ok {
+				t.Fatalf("checkRequest() of the first request failed")
+			}
+
+			if tt.store == nil {
+				tt.store = store
+			}
+			if tt.extension == "" {
+				tt.extension = "bmc"
+			}
+			if tt.rawQuery == "" {
+				tt.rawQuery = "nonce=1234"
+			}
+			o := newOptions(tt.extension, []Option{WithReplayProtection(tt.store, tt.required)})
+			// Without authentication or identity checks, hostnames are
+			// not used as labels.
+			c := metrics.ExtensionRequests.WithLabelValues(tt.extension, "unknown", "unknown", tt.outcome)
+			before := testutil.ToFloat64(c)
+			req = httptest.NewRequest("POST", "/v1/bmc_store_password", strings.NewReader(encode(tt.rawQuery)))
+			rec := httptest.NewRecorder()
+
+			_, ok := o.checkRequest(rec, req)
+
+			if ok != tt.ok {
+				t.Fatalf("checkRequest() = %v, want %v", ok, tt.ok)
+			}
+			if ok {
+				return
+			}
+			if rec.Code != tt.status {
+				t.Errorf("checkRequest(): bad status code: got %d; want %d", rec.Code, tt.status)
+			}
+			if after := testutil.ToFloat64(c); after != before+1 {
+				t.Errorf("extension_requests_total{outcome=%q} = %v, want %v", tt.outcome, after, before+1)
+			}
+		})
+	}
+}
+
+// expiringSeenStore records when the nonces it redeems expire.
+type expiringSeenStore struct {
+	expires time.Time
+}
+
+func (s *expiringSeenStore) Redeem(key string, expires time.Time) (bool, error) {
+	s.expires = expires
+	return true, nil
+}
+
+func (s *expiringSeenStore) Release(key string) error {
+	return nil
+}
+
+func Test_checkRequestReplayExpiry(t *testing.T) {
+	lastBoot := time.Now().UTC().Add(-30 * 24 * time.Hour)
+	tests := []struct {
+		name string
+		opts []Option
+		want time.Time
+	}{
+		{
+			name: "success-max-uptime",
+			opts: []Option{WithMaxUptime(24 * 60 * time.Hour)},
+			want: lastBoot.Add(24*60*time.Hour + DefaultClockSkew),
+		},
+		{
+			name: "success-default-replay-ttl",
+			opts: []Option{WithMaxUptime(0)},
+			want: time.Now().Add(DefaultReplayTTL),
+		},
+		{
+			name: "success-replay-ttl",
+			opts: []Option{WithMaxUptime(0), WithReplayTTL(48 * time.Hour)},
+			want: time.Now().Add(48 * time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &expiringSeenStore{}
+			o := newOptions("node", append(tt.opts, WithReplayProtection(store, true)))
+			body := (&extension.Request{V1: &extension.V1{
+				Hostname: testHostname,
+				LastBoot: lastBoot,
+				RawQuery: "nonce=1234",
+			}}).Encode()
+			req := httptest.NewRequest("POST", "/v1/node/delete", strings.NewReader(body))
+			if _, ok := o.checkRequest(httptest.NewRecorder(), req); !ok {
+				t.Fatalf("checkRequest() failed")
+			}
+			if d := store.expires.Sub(tt.want); d < -time.Minute || d > time.Minute {
+				t.Errorf("checkRequest(): nonce expires %v, want %v", store.expires, tt.want)
+			}
+		})
+	}
+}
+
+func Test_record(t *testing.T) {
+	verified := []Option{WithAuthenticators(&HMACAuthenticator{Keys: [][]byte{testHMACKey}})}
+	tests := []struct {
+		name     string
+		opts     []Option
+		hostname string
+		site     string
+		machine  string
+	}{
+		{
+			name:     "success",
+			opts:     verified,
+			hostname: testHostname,
+			site:     "foo01",
+			machine:  "mlab1",
+		},
+		{
+			name:     "success-identity-check",
+			opts:     []Option{WithIdentityVerifier(&IdentityVerifier{})},
+			hostname: testHostname,
+			site:     "foo01",
+			machine:  "mlab1",
+		},
+		{
+			name:     "success-unverified",
+			hostname: testHostname,
+			site:     "unknown",
+			machine:  "unknown",
+		},
+		{
+			name:     "success-undecoded",
+			opts:     verified,
+			hostname: "",
+			site:     "unknown",
+			machine:  "unknown",
+		},
+		{
+			name:     "success-not-mlab",
+			opts:     verified,
+			hostname: "example.com",
+			site:     "unknown",
+			machine:  "unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOptions("bmc", tt.opts)
+			c := metrics.ExtensionRequests.WithLabelValues("bmc", tt.site, tt.machine, outcomeBadBody)
+			before := testutil.ToFloat64(c)
+
+			o.record(tt.hostname, outcomeBadBody)
+
+			if after := testutil.ToFloat64(c); after != before+1 {
+				t.Errorf("extension_requests_total = %v, want %v", after, before+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Limits of extension requests, as recorded in metrics.
+const (
+	limitHost = "host"
+	limitIP   = "ip"
+)
+
+// Limiter limits the rate of requests sharing a key, e.g. the hostname of the
+// requesting machine. Implementations must be safe for concurrent use.
+// MemoryLimiter keeps its state in the memory of a single server; replicas
+// may share a Limiter keeping its state elsewhere.
+type Limiter interface {
+	// Allow counts a request for key. If the request exceeds the limit, it
+	// returns false and how long to wait before the next request would be
+	// allowed.
+	Allow(key string) (bool, time.Duration)
+}
+
+// MemoryLimiter implements the Limiter interface with a token bucket per key,
+// kept in memory. Each bucket holds up to Burst requests and refills at a rate
+// of one request per Interval.
+type MemoryLimiter struct {
+	Interval time.Duration
+	Burst    int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+// bucket holds the requests left for a key as of updated.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewMemoryLimiter returns a *MemoryLimiter allowing bursts of burst requests
+// per key, and one request per interval on average.
+func NewMemoryLimiter(interval time.Duration, burst int) *MemoryLimiter {
+	return &MemoryLimiter{
+		Interval: interval,
+		Burst:    burst,
+		buckets:  map[string]*bucket{},
+		now:      time.Now,
+	}
+}
+
+// Allow takes a request from the bucket of key.
+func (l *MemoryLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+float64(now.Sub(b.updated))/float64(l.Interval))
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) * float64(l.Interval))
+}
+
+// sweep forgets the buckets that have refilled completely, which are the same
+// as new ones, at most once per refill period. This bounds the memory used by
+// requests for many keys, e.g. forged hostnames.
+func (l *MemoryLimiter) sweep(now time.Time) {
+	full := time.Duration(l.Burst) * l.Interval
+	if now.Sub(l.swept) < full {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// sourceAddress returns the IP address of the client of req, without its
+// port.
+func sourceAddress(req *http.Request) string {
+	addr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return addr
+}
+
+// retryAfter returns the value of the Retry-After header for a wait of d,
+// rounded up to whole seconds.
+func retryAfter(d time.Duration) string {
+	return fmt.Sprint(int64(math.Ceil(math.Max(d.Seconds(), 1))))
+}
+
+// RateConfig configures a rate limit, which allows bursts of Burst requests
+// and one request per Interval on average.
+type RateConfig struct {
+	Interval string `json:"interval"`
+	Burst    int    `json:"burst"`
+
+	interval time.Duration
+}
+
+// validate checks the rate and parses its interval.
+func (r *RateConfig) validate() error {
+	d, err := time.ParseDuration(r.Interval)
+	if err != nil {
+		return fmt.Errorf("bad interval: %v", err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("interval must be positive, got %s", r.Interval)
+	}
+	if r.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1, got %d", r.Burst)
+	}
+	r.interval = d
+	return nil
+}
+
+// LimitConfig configures the rate limits of an extension. Host limits the
+// requests of each machine, by hostname, and IP the requests from each source
+// address. Nil rates do not limit requests.
+type LimitConfig struct {
+	Host *RateConfig `json:"host,omitempty"`
+	IP   *RateConfig `json:"ip,omitempty"`
+}
+
+// RateLimits maps the names of extensions ("token", "bmc" or "node") to their
+// rate limits. Extensions not listed use the "default" entry, if any.
+type RateLimits map[string]*LimitConfig
+
+// LoadRateLimits reads a JSON rate limit configuration from path. An empty
+// path returns nil RateLimits, which limit no requests.
+func LoadRateLimits(path string) (RateLimits, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r RateLimits
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("could not parse rate limits: %v", err)
+	}
+	for ext, c := range r {
+		if c == nil {
+			return nil, fmt.Errorf("extension %q has no rate limits", ext)
+		}
+		for name, rate := range map[string]*RateConfig{limitHost: c.Host, limitIP: c.IP} {
+			if rate == nil {
+				continue
+			}
+			if err := rate.validate(); err != nil {
+				return nil, fmt.Errorf("extension %q: %s limit: %v", ext, name, err)
+			}
+		}
+	}
+	return r, nil
+}
+
+// Options returns the options limiting the requests of the named extension.
+// Each call returns new limiters, kept in memory.
+func (r RateLimits) Options(extension string) []Option {
+	c, ok := r[extension]
+	if !ok {
+		c = r["default"]
+	}
+	if c == nil {
+		return nil
+	}
+	var opts []Option
+	if c.Host != nil {
+		opts = append(opts, WithHostLimiter(NewMemoryLimiter(c.Host.interval, c.Host.Burst)))
+	}
+	if c.IP != nil {
+		opts = append(opts, WithIPLimiter(NewMemoryLimiter(c.IP.interval, c.IP.Burst)))
+	}
+	return opts
+}
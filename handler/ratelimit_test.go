@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_MemoryLimiter(t *testing.T) {
+	now := time.Date(2023, 3, 17, 19, 57, 10, 0, time.UTC)
+	l := NewMemoryLimiter(time.Minute, 2)
+	l.now = func() time.Time { return now }
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		key     string
+		ok      bool
+		wait    time.Duration
+	}{
+		{name: "burst-1", key: "a", ok: true},
+		{name: "burst-2", key: "a", ok: true},
+		{name: "empty", key: "a", wait: time.Minute},
+		{name: "other-key", key: "b", ok: true},
+		{name: "partly-refilled", advance: 45 * time.Second, key: "a", wait: 15 * time.Second},
+		{name: "refilled", advance: 15 * time.Second, key: "a", ok: true},
+		{name: "empty-again", key: "a", wait: time.Minute},
+		{name: "full-after-idle", advance: time.Hour, key: "a", ok: true},
+		{name: "burst-capped", key: "a", ok: true},
+		{name: "burst-capped-empty", key: "a", wait: time.Minute},
+	}
+	for _, s := range steps {
+		now = now.Add(s.advance)
+		ok, wait := l.Allow(s.key)
+		if ok != s.ok || wait != s.wait {
+			t.Errorf("%s: Allow(%q) = %v, %v; want %v, %v", s.name, s.key, ok, wait, s.ok, s.wait)
+		}
+	}
+}
+
+func Test_MemoryLimiterSweep(t *testing.T) {
+	now := time.Date(2023, 3, 17, 19, 57, 10, 0, time.UTC)
+	l := NewMemoryLimiter(time.Second, 5)
+	l.now = func() time.Time { return now }
+
+	l.Allow("a")
+	now = now.Add(3 * time.Second)
+	l.Allow("b")
+	now = now.Add(3 * time.Second)
+	l.Allow("c")
+
+	// "a" refilled completely and was forgotten, "b" is still refilling.
+	if _, ok := l.buckets["a"]; ok {
+		t.Errorf("Allow() kept the full bucket of %q", "a")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, ok := l.buckets[key]; !ok {
+			t.Errorf("Allow() forgot the bucket of %q", key)
+		}
+	}
+}
+
+func Test_retryAfter(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{wait: 0, want: "1"},
+		{wait: 10 * time.Millisecond, want: "1"},
+		{wait: 1500 * time.Millisecond, want: "2"},
+		{wait: time.Minute, want: "60"},
+	}
+	for _, tt := range tests {
+		if got := retryAfter(tt.wait); got != tt.want {
+			t.Errorf("retryAfter(%v) = %q, want %q", tt.wait, got, tt.want)
+		}
+	}
+}
+
+func Test_LoadRateLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name: "success",
+			content: `{
+				"token": {"host": {"interval": "1m", "burst": 5}, "ip": {"interval": "100ms", "burst": 50}},
+				"default": {"host": {"interval": "10s", "burst": 3}}
+			}`,
+		},
+		{
+			name:    "failure-bad-json",
+			content: `{"token": `,
+			wantErr: true,
+		},
+		{
+			name:    "failure-null",
+			content: `{"token": null}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-interval",
+			content: `{"token": {"host": {"interval": "often", "burst": 5}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-zero-interval",
+			content: `{"token": {"ip": {"interval": "0s", "burst": 5}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-zero-burst",
+			content: `{"token": {"host": {"interval": "1m"}}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rate-limits.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("failed to write rate limits: %v", err)
+			}
+			_, err := LoadRateLimits(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadRateLimits(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_RateLimitsOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rate-limits.json")
+	content := `{
+		"token": {"host": {"interval": "1m", "burst": 5}, "ip": {"interval": "100ms", "burst": 50}},
+		"default": {"host": {"interval": "10s", "burst": 3}}
+	}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write rate limits: %v", err)
+	}
+	r, err := LoadRateLimits(path)
+	if err != nil {
+		t.Fatalf("LoadRateLimits(): %v", err)
+	}
+
+	o := newOptions("token", r.Options("token"))
+	host, ip := o.hostLimiter.(*MemoryLimiter), o.ipLimiter.(*MemoryLimiter)
+	if host.Interval != time.Minute || host.Burst != 5 || ip.Interval != 100*time.Millisecond || ip.Burst != 50 {
+		t.Errorf("Options(\"token\") limits %+v and %+v", host, ip)
+	}
+	o = newOptions("bmc", r.Options("bmc"))
+	if host := o.hostLimiter.(*MemoryLimiter); host.Interval != 10*time.Second || host.Burst != 3 || o.ipLimiter != nil {
+		t.Errorf("Options(\"bmc\") did not use the default limits")
+	}
+	if opts := RateLimits(nil).Options("token"); opts != nil {
+		t.Errorf("Options() of nil RateLimits = %v, want nil", opts)
+	}
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// NonceParams lists the RawQuery parameters carrying the nonce of an extension
+// request, in order of preference. The RawQuery is part of the request body,
+// so authenticators signing the body cover the nonce as well.
+var NonceParams = []string{"nonce", "session_id"}
+
+// SeenStore remembers the nonces redeemed by extension requests.
+// Implementations must be safe for concurrent use. MemorySeenStore keeps its
+// state in the memory of a single server; replicas may share a SeenStore
+// keeping its state elsewhere.
+type SeenStore interface {
+	// Redeem records key until expires, and returns false if it was already
+	// recorded.
+	Redeem(key string, expires time.Time) (bool, error)
+	// Release forgets key, so that it can be redeemed again.
+	Release(key string) error
+}
+
+// MemorySeenStore implements the SeenStore interface in memory.
+type MemorySeenStore struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	swept time.Time
+	now   func() time.Time
+}
+
+// sweepInterval is how often a MemorySeenStore forgets expired keys.
+const sweepInterval = time.Minute
+
+// NewMemorySeenStore returns an empty *MemorySeenStore.
+func NewMemorySeenStore() *MemorySeenStore {
+	return &MemorySeenStore{
+		seen: map[string]time.Time{},
+		now:  time.Now,
+	}
+}
+
+// Redeem records key until expires, unless it is already recorded and has not
+// expired yet.
+func (s *MemorySeenStore) Redeem(key string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.swept) >= sweepInterval {
+		for k, e := range s.seen {
+			if !now.Before(e) {
+				delete(s.seen, k)
+			}
+		}
+		s.swept = now
+	}
+	if e, ok := s.seen[key]; ok && now.Before(e) {
+		return false, nil
+	}
+	s.seen[key] = expires
+	return true, nil
+}
+
+// Release forgets key.
+func (s *MemorySeenStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.seen, key)
+	return nil
+}
+
+// nonce returns the nonce of rawQuery, or an empty string if it has none.
+func nonce(rawQuery string) (string, error) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range NonceParams {
+		if n := values.Get(p); n != "" {
+			return n, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_MemorySeenStore(t *testing.T) {
+	now := time.Date(2023, 3, 17, 19, 57, 10, 0, time.UTC)
+	s := NewMemorySeenStore()
+	s.now = func() time.Time { return now }
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		key     string
+		expires time.Duration
+		ok      bool
+	}{
+		{name: "new", key: "token/a", expires: time.Hour, ok: true},
+		{name: "replay", key: "token/a", expires: time.Hour},
+		{name: "other-extension", key: "bmc/a", expires: time.Hour, ok: true},
+		{name: "replay-later", advance: 59 * time.Minute, key: "token/a", expires: time.Hour},
+		{name: "expired", advance: time.Minute, key: "token/a", expires: time.Hour, ok: true},
+		{name: "replay-after-expiry", key: "token/a", expires: time.Hour},
+	}
+	for _, st := range steps {
+		now = now.Add(st.advance)
+		ok, err := s.Redeem(st.key, now.Add(st.expires))
+		if ok != st.ok || err != nil {
+			t.Errorf("%s: Redeem(%q) = %v, %v; want %v, nil", st.name, st.key, ok, err, st.ok)
+		}
+	}
+
+	// Released keys can be redeemed again.
+	if err := s.Release("bmc/a"); err != nil {
+		t.Errorf("Release(): unexpected error: %v", err)
+	}
+	if ok, _ := s.Redeem("bmc/a", now.Add(time.Hour)); !ok {
+		t.Errorf("Redeem() refused a released key")
+	}
+
+	// Expired keys are forgotten.
+	now = now.Add(2 * time.Hour)
+	s.Redeem("node/b", now.Add(time.Hour))
+	if len(s.seen) != 1 {
+		t.Errorf("Redeem() kept %d keys, want 1", len(s.seen))
+	}
+}
+
+func Test_nonce(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawQuery string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "success-nonce",
+			rawQuery: "nonce=abc&session_id=def",
+			want:     "abc",
+		},
+		{
+			name:     "success-session-id",
+			rawQuery: "p=hunter2&session_id=def",
+			want:     "def",
+		},
+		{
+			name:     "success-none",
+			rawQuery: "mode=worker",
+		},
+		{
+			name:     "failure-bad-query",
+			rawQuery: "nonce=%zz",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nonce(tt.rawQuery)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nonce(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("nonce() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
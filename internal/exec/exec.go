@@ -0,0 +1,144 @@
+// Package exec runs the external commands of the extensions, like kubeadm and
+// kubectl. Commands are killed when their context is done or their deadline
+// passes, their output is capped, and failures are returned as *ExitError
+// carrying the exit code and stderr of the command.
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxOutput is the default limit of the size of the stdout and stderr
+// kept from a command.
+const DefaultMaxOutput = 1 << 20
+
+// waitDelay is how long to wait for the output of a killed command, e.g. if
+// one of its children keeps stdout open.
+const waitDelay = 5 * time.Second
+
+// ErrOutputTooLarge is returned when the stdout of a command exceeds its
+// limit. The truncated output is returned with it.
+var ErrOutputTooLarge = errors.New("command output too large")
+
+// Runner runs a program with arguments. Implementations must be safe for
+// concurrent use.
+type Runner interface {
+	// Run runs the program with args, killing it when ctx is done, and
+	// returns its stdout.
+	Run(ctx context.Context, args ...string) ([]byte, error)
+}
+
+// ExitError is returned when a command fails to start, exits with a non-zero
+// status or is killed. It wraps the underlying error, e.g. the error of the
+// context if the command was killed because of it.
+type ExitError struct {
+	// Program is the name of the program, without its directory.
+	Program string
+	// Code is the exit code, or -1 if the command did not exit on its own.
+	Code int
+	// Stderr is the stderr of the command, up to its limit.
+	Stderr []byte
+	Err    error
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("%s: %v", e.Program, e.Err)
+	if stderr := strings.TrimSpace(string(e.Stderr)); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// Command implements the Runner interface by running the program at Path.
+type Command struct {
+	Path string
+	// Timeout limits how long runs whose context has no deadline may take.
+	// Zero means no limit.
+	Timeout time.Duration
+	// MaxOutput limits the size of the stdout and stderr kept from a run.
+	// Zero means DefaultMaxOutput.
+	MaxOutput int
+}
+
+// Run runs the program with args and returns its stdout. Commands are not run
+// through a shell, so arguments are never interpreted.
+func (c *Command) Run(ctx context.Context, args ...string) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	max := c.MaxOutput
+	if max <= 0 {
+		max = DefaultMaxOutput
+	}
+	stdout := &limitedBuffer{max: max}
+	stderr := &limitedBuffer{max: max}
+	cmd := osexec.CommandContext(ctx, c.Path, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = waitDelay
+
+	err := cmd.Run()
+	if err != nil {
+		exitErr := &ExitError{
+			Program: filepath.Base(c.Path),
+			Code:    -1,
+			Stderr:  stderr.Bytes(),
+			Err:     err,
+		}
+		var osErr *osexec.ExitError
+		if errors.As(err, &osErr) {
+			exitErr.Code = osErr.ExitCode()
+		}
+		if ctx.Err() != nil {
+			// Report why the command was killed rather than the signal.
+			exitErr.Err = ctx.Err()
+		}
+		return stdout.Bytes(), exitErr
+	}
+	if stdout.truncated {
+		return stdout.Bytes(), fmt.Errorf("%s: %w (limit %d bytes)", filepath.Base(c.Path), ErrOutputTooLarge, max)
+	}
+	return stdout.Bytes(), nil
+}
+
+// limitedBuffer keeps the first max bytes written to it, and discards the
+// rest.
+type limitedBuffer struct {
+	mu        sync.Mutex
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	if room := b.max - len(b.buf); n > room {
+		p = p[:room]
+		b.truncated = true
+	}
+	b.buf = append(b.buf, p...)
+	// Report the whole write as successful, so that the command keeps
+	// running as it would without the limit.
+	return n, nil
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf
+}
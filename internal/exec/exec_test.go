@@ -0,0 +1,141 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_CommandRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		args      []string
+		timeout   time.Duration
+		maxOutput int
+		expect    string
+		code      int
+		stderr    string
+		wantErr   error
+	}{
+		{
+			name:   "success",
+			path:   "date",
+			args:   []string{"--date=@1679083030", "--utc", "+%FT%T"},
+			expect: "2023-03-17T19:57:10\n",
+		},
+		{
+			name:   "success-arguments-not-interpreted",
+			path:   "echo",
+			args:   []string{"lol", ";-)", "$(true)"},
+			expect: "lol ;-) $(true)\n",
+		},
+		{
+			name:   "failure-exit-code",
+			path:   "sh",
+			args:   []string{"-c", "echo partial; echo 'Error from server (NotFound)' >&2; exit 3"},
+			expect: "partial\n",
+			code:   3,
+			stderr: "Error from server (NotFound)\n",
+		},
+		{
+			name: "failure-not-found",
+			path: "/bin/doesnt/exist",
+			code: -1,
+		},
+		{
+			name:    "failure-timeout",
+			path:    "sleep",
+			args:    []string{"10"},
+			timeout: 10 * time.Millisecond,
+			code:    -1,
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name:      "failure-output-too-large",
+			path:      "echo",
+			args:      []string{"0123456789"},
+			maxOutput: 4,
+			expect:    "0123",
+			wantErr:   ErrOutputTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Command{Path: tt.path, Timeout: tt.timeout, MaxOutput: tt.maxOutput}
+			output, err := c.Run(context.Background(), tt.args...)
+			if string(output) != tt.expect {
+				t.Errorf("Run() = %q, want %q", output, tt.expect)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Run(): error = %v, want %v", err, tt.wantErr)
+			}
+			var exitErr *ExitError
+			if (tt.code != 0) != errors.As(err, &exitErr) {
+				t.Fatalf("Run(): error = %v, want exit code %d", err, tt.code)
+			}
+			if exitErr == nil {
+				return
+			}
+			if exitErr.Code != tt.code || string(exitErr.Stderr) != tt.stderr {
+				t.Errorf("Run(): exit code %d, stderr %q; want %d, %q",
+					exitErr.Code, exitErr.Stderr, tt.code, tt.stderr)
+			}
+			if tt.stderr != "" && !strings.Contains(err.Error(), strings.TrimSpace(tt.stderr)) {
+				t.Errorf("Run(): error %q does not include stderr", err)
+			}
+		})
+	}
+}
+
+func Test_CommandRunContext(t *testing.T) {
+	c := &Command{Path: "sleep", Timeout: time.Millisecond}
+
+	// Timeout does not apply to contexts with a deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.Run(ctx, "0.05"); err != nil {
+		t.Errorf("Run() with a deadline: unexpected error: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := (&Command{Path: "sleep"}).Run(ctx, "10")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() with a canceled context: error = %v, want %v", err, context.Canceled)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Run() with a canceled context took %s", time.Since(start))
+	}
+}
+
+func Test_Fake(t *testing.T) {
+	f := &Fake{Func: func(args []string) ([]byte, error) {
+		if args[0] == "fail" {
+			return nil, Failure(1, "failed")
+		}
+		return []byte("ok"), nil
+	}}
+	if out, err := f.Run(context.Background(), "cordon", "mlab1"); string(out) != "ok" || err != nil {
+		t.Errorf("Run() = %q, %v; want \"ok\", nil", out, err)
+	}
+	var exitErr *ExitError
+	if _, err := f.Run(context.Background(), "fail"); !errors.As(err, &exitErr) || exitErr.Code != 1 {
+		t.Errorf("Run(): error = %v, want an exit code 1", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := f.Run(ctx, "cordon"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() with a canceled context: error = %v, want %v", err, context.Canceled)
+	}
+	want := [][]string{{"cordon", "mlab1"}, {"fail"}, {"cordon"}}
+	if got := f.Runs(); len(got) != len(want) || got[1][0] != "fail" {
+		t.Errorf("Runs() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Fake implements the Runner interface for tests. It records the arguments of
+// each run, and returns the results of Func.
+type Fake struct {
+	// Func returns the stdout and error of a run with args. A nil Func
+	// returns no output and no error.
+	Func func(args []string) ([]byte, error)
+
+	mu   sync.Mutex
+	runs [][]string
+}
+
+// Run records args and returns the results of f.Func, or the error of ctx if
+// it is done.
+func (f *Fake) Run(ctx context.Context, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	f.runs = append(f.runs, args)
+	f.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, &ExitError{Program: "fake", Code: -1, Err: err}
+	}
+	if f.Func == nil {
+		return nil, nil
+	}
+	return f.Func(args)
+}
+
+// Runs returns the arguments of all runs so far, in order.
+func (f *Fake) Runs() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.runs...)
+}
+
+// Failure returns an *ExitError for a fake run that exited with code and
+// printed stderr.
+func Failure(code int, stderr string) *ExitError {
+	return &ExitError{
+		Program: "fake",
+		Code:    code,
+		Stderr:  []byte(stderr),
+		Err:     fmt.Errorf("exit status %d", code),
+	}
+}
@@ -0,0 +1,52 @@
+// Package machine matches M-Lab machines by their site and hostname, for the
+// rules of the configuration files that select settings per class of machines.
+package machine
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/m-lab/go/host"
+)
+
+// Matcher matches machines meeting all of its non-empty criteria. It is meant
+// to be embedded in configuration rules, whose JSON then has the "sites" and
+// "machine_pattern" fields. The zero Matcher matches all machines.
+type Matcher struct {
+	// Sites matches machines at any of the listed sites.
+	Sites []string `json:"sites,omitempty"`
+	// MachinePattern is a regular expression matched against the hostname of
+	// the machine.
+	MachinePattern string `json:"machine_pattern,omitempty"`
+
+	machineRe *regexp.Regexp
+}
+
+// Compile compiles the MachinePattern. It must be called before Matches.
+func (m *Matcher) Compile() error {
+	if m.MachinePattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(m.MachinePattern)
+	if err != nil {
+		return fmt.Errorf("bad machine_pattern: %v", err)
+	}
+	m.machineRe = re
+	return nil
+}
+
+// Matches returns whether the machine with the given hostname matches. If
+// Sites is set, hostnames that are not M-Lab hostnames never match.
+func (m *Matcher) Matches(hostname string) bool {
+	if len(m.Sites) > 0 {
+		parts, err := host.Parse(hostname)
+		if err != nil || !slices.Contains(m.Sites, parts.Site) {
+			return false
+		}
+	}
+	if m.machineRe != nil && !m.machineRe.MatchString(hostname) {
+		return false
+	}
+	return true
+}
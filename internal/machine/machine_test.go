@@ -0,0 +1,60 @@
+package machine
+
+import "testing"
+
+func Test_Matcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		matcher  Matcher
+		hostname string
+		want     bool
+	}{
+		{
+			name:     "success-zero",
+			hostname: "mlab1-foo01.mlab-oti.measurement-lab.org",
+			want:     true,
+		},
+		{
+			name:     "success-site",
+			matcher:  Matcher{Sites: []string{"abc0t", "foo01"}},
+			hostname: "mlab1-foo01.mlab-oti.measurement-lab.org",
+			want:     true,
+		},
+		{
+			name:     "success-site-and-pattern",
+			matcher:  Matcher{Sites: []string{"foo01"}, MachinePattern: `^mlab[1-2]-`},
+			hostname: "mlab2-foo01.mlab-oti.measurement-lab.org",
+			want:     true,
+		},
+		{
+			name:     "failure-other-site",
+			matcher:  Matcher{Sites: []string{"abc0t"}},
+			hostname: "mlab1-foo01.mlab-oti.measurement-lab.org",
+		},
+		{
+			name:     "failure-not-mlab",
+			matcher:  Matcher{Sites: []string{"foo01"}},
+			hostname: "example.com",
+		},
+		{
+			name:     "failure-pattern",
+			matcher:  Matcher{Sites: []string{"foo01"}, MachinePattern: `^mlab[1-2]-`},
+			hostname: "mlab4-foo01.mlab-oti.measurement-lab.org",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.matcher.Compile(); err != nil {
+				t.Fatalf("Compile(): unexpected error: %v", err)
+			}
+			if got := tt.matcher.Matches(tt.hostname); got != tt.want {
+				t.Errorf("Matches(%q) = %v, want %v", tt.hostname, got, tt.want)
+			}
+		})
+	}
+
+	m := Matcher{MachinePattern: "mlab[1-"}
+	if err := m.Compile(); err == nil {
+		t.Errorf("Compile(): expected error for bad machine_pattern")
+	}
+}
@@ -0,0 +1,13 @@
+// Package resolver is the DNS resolver shared by the extensions, e.g. to find
+// the address of a BMC or to check the identity claimed by a machine. Its
+// lookups are variables, so that tests can replace them with fake records.
+package resolver
+
+import "net"
+
+var (
+	// LookupHost returns the addresses of a host, like net.LookupHost.
+	LookupHost = net.LookupHost
+	// LookupAddr returns the names of an address, like net.LookupAddr.
+	LookupAddr = net.LookupAddr
+)
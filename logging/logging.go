@@ -0,0 +1,129 @@
+// Package logging provides the structured logger of the extension server,
+// which redacts secrets, and attaches a request ID to the logs of each
+// request.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RequestIDHeader is the header carrying the ID of a request. IDs set by the
+// client, e.g. the ePoxy server, are kept if valid. The ID is echoed in the
+// response.
+const RequestIDHeader = "X-Request-Id"
+
+// Redacted replaces secrets in logs.
+const Redacted = "REDACTED"
+
+// secretKeys lists the attribute keys and query parameters whose values are
+// secrets: BMC passwords, bootstrap tokens, certificate keys and CA material.
+var secretKeys = map[string]bool{
+	"p":               true,
+	"password":        true,
+	"token":           true,
+	"authorization":   true,
+	"certificate_key": true,
+	"certificatekey":  true,
+	"ca":              true,
+	"ca_data":         true,
+	"cadata":          true,
+	"ca_cert":         true,
+}
+
+// validRequestID matches request IDs accepted from clients.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// IsSecret returns whether the values of key are secrets.
+func IsSecret(key string) bool {
+	return secretKeys[strings.ToLower(key)]
+}
+
+// redact replaces the values of secret attributes.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if IsSecret(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// New returns a logger writing to w in the given format, "text" or "json",
+// which drops messages below level and redacts the values of secret
+// attributes.
+func New(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// RedactQuery returns the URL-encoded query rawQuery with the values of secret
+// parameters redacted. Queries that cannot be parsed are redacted as a whole.
+func RedactQuery(rawQuery string) string {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return Redacted
+	}
+	for k := range values {
+		if IsSecret(k) {
+			for i := range values[k] {
+				values[k][i] = Redacted
+			}
+		}
+	}
+	return values.Encode()
+}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger of the request of ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Middleware assigns an ID to each request, echoes it in the RequestIDHeader
+// of the response, and makes a logger with the ID available to next through
+// FromContext.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = NewRequestID()
+		}
+		resp.Header().Set(RequestIDHeader, id)
+		logger := slog.Default().With("request_id", id)
+		logger.Info("request", "method", req.Method, "path", req.URL.Path,
+			"query", RedactQuery(req.URL.RawQuery), "remote_addr", req.RemoteAddr)
+		next.ServeHTTP(resp, req.WithContext(WithLogger(req.Context(), logger)))
+	})
+}
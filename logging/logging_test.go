@@ -0,0 +1,185 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_New(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		level   slog.Level
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "success-text",
+			format: "text",
+			want:   `msg=hello hostname=mlab1-foo01 p=REDACTED`,
+		},
+		{
+			name:   "success-json",
+			format: "json",
+			want:   `"msg":"hello","hostname":"mlab1-foo01","p":"REDACTED"`,
+		},
+		{
+			name:   "success-level",
+			format: "text",
+			level:  slog.LevelWarn,
+		},
+		{
+			name:    "failure-format",
+			format:  "xml",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := New(&buf, tt.format, tt.level)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			logger.Info("hello", "hostname", "mlab1-foo01", "p", "hunter2")
+			if strings.Contains(buf.String(), "hunter2") {
+				t.Errorf("New() logged a secret: %s", buf.String())
+			}
+			if !strings.Contains(buf.String(), tt.want) {
+				t.Errorf("New() logged %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_NewRedactsGroups(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "json", slog.LevelInfo)
+	logger.Info("token", slog.Group("details", "token", "abcdef.0123456789abcdef", "certificate_key", "secret", "ca_hash", "sha256:1234"))
+
+	var got struct {
+		Details map[string]string `json:"details"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal(): %v", err)
+	}
+	want := map[string]string{"token": Redacted, "certificate_key": Redacted, "ca_hash": "sha256:1234"}
+	for k, v := range want {
+		if got.Details[k] != v {
+			t.Errorf("details.%s = %q, want %q", k, got.Details[k], v)
+		}
+	}
+}
+
+func Test_RedactQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawQuery string
+		want     string
+	}{
+		{
+			name:     "success-password",
+			rawQuery: "p=hunter2&model=drac",
+			want:     "model=drac&p=REDACTED",
+		},
+		{
+			name:     "success-no-secrets",
+			rawQuery: "label=a%3Db&label=c",
+			want:     "label=a%3Db&label=c",
+		},
+		{
+			name:     "success-empty",
+			rawQuery: "",
+			want:     "",
+		},
+		{
+			name:     "failure-unparsable",
+			rawQuery: "p=%zz",
+			want:     Redacted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RedactQuery(tt.rawQuery); got != tt.want {
+				t.Errorf("RedactQuery() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Middleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "json", slog.LevelInfo)
+	orig := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(orig) })
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{
+			name:   "success-client-id",
+			header: "epoxy-1234",
+			want:   "epoxy-1234",
+		},
+		{
+			name: "success-generated-id",
+		},
+		{
+			name:   "success-invalid-client-id",
+			header: "bad id\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			var inner string
+			h := Middleware(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				FromContext(req.Context()).Info("inner")
+				inner = buf.String()
+			}))
+			req := httptest.NewRequest("POST", "/v1/bmc_store_password?p=hunter2", nil)
+			if tt.header != "" {
+				req.Header.Set(RequestIDHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(RequestIDHeader)
+			if tt.want != "" && id != tt.want {
+				t.Errorf("Middleware() request ID = %q, want %q", id, tt.want)
+			}
+			if !validRequestID.MatchString(id) {
+				t.Errorf("Middleware() request ID = %q is not valid", id)
+			}
+			if strings.Count(inner, `"request_id":"`+id+`"`) != 2 {
+				t.Errorf("Middleware() logs lack the request ID %q: %s", id, inner)
+			}
+			if strings.Contains(inner, "hunter2") {
+				t.Errorf("Middleware() logged a secret: %s", inner)
+			}
+		})
+	}
+}
+
+func Test_FromContext(t *testing.T) {
+	if FromContext(context.Background()) != slog.Default() {
+		t.Errorf("FromContext() without a logger is not the default logger")
+	}
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	if FromContext(WithLogger(context.Background(), logger)) != logger {
+		t.Errorf("FromContext() did not return the logger of the context")
+	}
+}
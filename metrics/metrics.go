@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"math"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -43,10 +44,216 @@ var (
 		prometheus.HistogramOpts{
 			Name: "node_request_duration_seconds",
 			Help: "Request status codes and execution times.",
+			Buckets: []float64{
+				0.001, 0.01, 0.1, 1.0, 5.0, 10.0, 30.0, 60.0, 120.0, 300.0, math.Inf(+1),
+			},
+		},
+		[]string{"method", "code"},
+	)
+
+	OperatorRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "operator_request_duration_seconds",
+			Help: "Request status codes and execution times.",
 			Buckets: []float64{
 				0.001, 0.01, 0.1, 1.0, 5.0, 10.0, 30.0, math.Inf(+1),
 			},
 		},
 		[]string{"method", "code"},
 	)
+
+	// TokensCreated counts the bootstrap tokens created for hosts.
+	TokensCreated = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "k8s_tokens_created_total",
+			Help: "Number of bootstrap tokens created.",
+		},
+	)
+
+	// TokensReused counts the requests answered with an existing, still
+	// valid bootstrap token instead of a new one.
+	TokensReused = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "k8s_tokens_reused_total",
+			Help: "Number of existing bootstrap tokens handed out again.",
+		},
+	)
+
+	// TokensRevoked counts the bootstrap tokens deleted, by reason.
+	//
+	// For example, it provides metrics similar to:
+	//   k8s_tokens_revoked_total{reason="replaced"}
+	//   k8s_tokens_revoked_total{reason="expired"}
+	//   k8s_tokens_revoked_total{reason="superseded"}
+	TokensRevoked = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "k8s_tokens_revoked_total",
+			Help: "Number of bootstrap tokens revoked.",
+		},
+		[]string{"reason"},
+	)
+
+	// BMCVerifications counts the verifications of BMC credentials, by
+	// result: "success", "rejected" when the BMC refused the credentials, or
+	// "error" when the BMC could not be asked.
+	BMCVerifications = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bmc_verifications_total",
+			Help: "Number of BMC credential verifications.",
+		},
+		[]string{"result"},
+	)
+
+	// NodeDrains counts the drains of nodes before their deletion, by result:
+	// "success", "timeout" or "error".
+	NodeDrains = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "node_drains_total",
+			Help: "Number of node drains.",
+		},
+		[]string{"result"},
+	)
+
+	// NodeDrainDuration provides a histogram of the time taken to drain nodes,
+	// by result.
+	NodeDrainDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "node_drain_duration_seconds",
+			Help: "Node drain execution times.",
+			Buckets: []float64{
+				1.0, 5.0, 10.0, 30.0, 60.0, 120.0, 300.0, 600.0, 1800.0, math.Inf(+1),
+			},
+		},
+		[]string{"result"},
+	)
+
+	// AuthFailures counts the extension requests rejected by an
+	// authenticator, by extension and authenticator.
+	//
+	// For example, it provides metrics similar to:
+	//   extension_auth_failures_total{extension="token", authenticator="hmac"}
+	AuthFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "extension_auth_failures_total",
+			Help: "Number of extension requests that failed authentication.",
+		},
+		[]string{"extension", "authenticator"},
+	)
+
+	// IdentityMismatches counts the extension requests whose claimed identity
+	// did not match DNS, by extension and check: "forward" or "reverse".
+	IdentityMismatches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "extension_identity_mismatches_total",
+			Help: "Number of extension requests whose identity did not match DNS.",
+		},
+		[]string{"extension", "check"},
+	)
+
+	// RateLimited counts the extension requests rejected for exceeding a rate
+	// limit, by extension and limit: "host" or "ip".
+	RateLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "extension_rate_limited_total",
+			Help: "Number of extension requests rejected for exceeding a rate limit.",
+		},
+		[]string{"extension", "limit"},
+	)
+
+	// Replays counts the extension requests refused because their nonce was
+	// already redeemed, by extension.
+	Replays = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "extension_replays_total",
+			Help: "Number of replayed extension requests.",
+		},
+		[]string{"extension"},
+	)
+
+	// TLSReloads counts the reloads of the TLS certificate, key and client CA
+	// files after they changed, by result: "success" or "error".
+	TLSReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tls_reloads_total",
+			Help: "Number of reloads of the TLS files.",
+		},
+		[]string{"result"},
+	)
+
+	// LastBootRejections counts the extension requests rejected because of
+	// the last boot time of the machine, by extension and reason: "stale" if
+	// the machine booted too long ago, or "future" if it claims to have
+	// booted in the future.
+	LastBootRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "extension_last_boot_rejections_total",
+			Help: "Number of extension requests rejected because of their last boot time.",
+		},
+		[]string{"extension", "reason"},
+	)
+
+	// ExtensionRequests counts the extension requests, by extension, site and
+	// machine of the requesting host, and outcome: "success", or why the
+	// request failed, e.g. "bad_body", "auth_failure", "stale_boot" or
+	// "backend_error". The site and machine are "unknown" if the request was
+	// rejected before its hostname was verified by authentication or the
+	// identity check, if the extension verifies neither, or if its hostname is
+	// not an M-Lab hostname.
+	//
+	// For example, it provides metrics similar to:
+	//   extension_requests_total{extension="token", site="foo01", machine="mlab1", outcome="success"}
+	ExtensionRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "extension_requests_total",
+			Help: "Number of extension requests, by outcome.",
+		},
+		[]string{"extension", "site", "machine", "outcome"},
+	)
+
+	// RequestsInFlight is the number of requests being handled, by extension.
+	RequestsInFlight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "extension_requests_in_flight",
+			Help: "Number of requests being handled.",
+		},
+		[]string{"extension"},
+	)
+
+	// BackendCallDuration provides a histogram of the time taken by calls to
+	// backends, separately from the handling of the HTTP requests, by backend:
+	// "kubeadm", "kubectl" or "datastore", operation, and result: "success"
+	// or "error".
+	//
+	// For example, it provides metrics similar to:
+	//   backend_call_duration_seconds{backend="kubeadm", operation="token create", result="success", le="..."}
+	BackendCallDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "backend_call_duration_seconds",
+			Help: "Backend call execution times.",
+			Buckets: []float64{
+				0.001, 0.01, 0.1, 1.0, 5.0, 10.0, 30.0, 60.0, 120.0, 300.0, math.Inf(+1),
+			},
+		},
+		[]string{"backend", "operation", "result"},
+	)
+
+	// BuildInfo is always 1, and labeled with the version of the server and
+	// the Go version it was built with.
+	BuildInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "epoxy_extensions_build_info",
+			Help: "Build information of the server.",
+		},
+		[]string{"version", "go_version"},
+	)
 )
+
+// ObserveBackendCall records the time since start taken by a call to a
+// backend in BackendCallDuration, with result "error" if err is not nil.
+func ObserveBackendCall(backend, operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	BackendCallDuration.WithLabelValues(backend, operation, result).Observe(time.Since(start).Seconds())
+}
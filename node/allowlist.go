@@ -0,0 +1,187 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var (
+	// ErrInvalid is returned for malformed label or taint changes.
+	ErrInvalid = errors.New("invalid change")
+	// ErrNotAllowed is returned for label or taint changes that are not in
+	// the Allowlist.
+	ErrNotAllowed = errors.New("change not allowed")
+)
+
+// Allowlist lists the labels and taints machines may set on their own nodes.
+// Each key maps to its allowed values. An empty list of values allows any
+// valid value.
+type Allowlist struct {
+	Labels map[string][]string `json:"labels,omitempty"`
+	Taints map[string][]string `json:"taints,omitempty"`
+}
+
+// LoadAllowlist reads a JSON allowlist from path. An empty path returns a nil
+// *Allowlist, which allows no changes.
+func LoadAllowlist(path string) (*Allowlist, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &Allowlist{}
+	if err := json.Unmarshal(b, a); err != nil {
+		return nil, fmt.Errorf("could not parse node allowlist: %v", err)
+	}
+	for _, keys := range []map[string][]string{a.Labels, a.Taints} {
+		for k, values := range keys {
+			if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+				return nil, fmt.Errorf("bad key %q: %s", k, strings.Join(errs, "; "))
+			}
+			for _, v := range values {
+				if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+					return nil, fmt.Errorf("bad value %q for key %q: %s", v, k, strings.Join(errs, "; "))
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+// allowed returns whether key may be set to value according to keys. Removing
+// a key is allowed if it may be set.
+func allowed(keys map[string][]string, key string, value string, remove bool) bool {
+	values, ok := keys[key]
+	if !ok {
+		return false
+	}
+	if remove || len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Label is a label to set on, or remove from, a node.
+type Label struct {
+	Key    string
+	Value  string
+	Remove bool
+}
+
+// String returns the label in the syntax of `kubectl label`.
+func (l Label) String() string {
+	if l.Remove {
+		return l.Key + "-"
+	}
+	return l.Key + "=" + l.Value
+}
+
+// Taint is a taint to set on, or remove from, a node.
+type Taint struct {
+	Key    string
+	Value  string
+	Effect corev1.TaintEffect
+	Remove bool
+}
+
+// String returns the taint in the syntax of `kubectl taint`.
+func (t Taint) String() string {
+	if t.Remove {
+		return t.Key + ":" + string(t.Effect) + "-"
+	}
+	if t.Value == "" {
+		return t.Key + ":" + string(t.Effect)
+	}
+	return t.Key + "=" + t.Value + ":" + string(t.Effect)
+}
+
+// parseKeyValue parses "key=value" or, for removals, "key-".
+func parseKeyValue(s string) (key string, value string, remove bool, err error) {
+	if strings.HasSuffix(s, "-") && !strings.Contains(s, "=") {
+		key, remove = strings.TrimSuffix(s, "-"), true
+	} else {
+		var ok bool
+		key, value, ok = strings.Cut(s, "=")
+		if !ok {
+			return "", "", false, fmt.Errorf("%w: %q must be key=value or key-", ErrInvalid, s)
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return "", "", false, fmt.Errorf("%w: bad value %q: %s", ErrInvalid, value, strings.Join(errs, "; "))
+		}
+	}
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return "", "", false, fmt.Errorf("%w: bad key %q: %s", ErrInvalid, key, strings.Join(errs, "; "))
+	}
+	return key, value, remove, nil
+}
+
+// ParseLabels parses and checks label changes of the form "key=value", or
+// "key-" to remove a label.
+func (a *Allowlist) ParseLabels(changes []string) ([]Label, error) {
+	if len(changes) == 0 {
+		return nil, fmt.Errorf("%w: no labels", ErrInvalid)
+	}
+	labels := make([]Label, 0, len(changes))
+	for _, c := range changes {
+		key, value, remove, err := parseKeyValue(c)
+		if err != nil {
+			return nil, err
+		}
+		if a == nil || !allowed(a.Labels, key, value, remove) {
+			return nil, fmt.Errorf("%w: label %q", ErrNotAllowed, c)
+		}
+		labels = append(labels, Label{Key: key, Value: value, Remove: remove})
+	}
+	return labels, nil
+}
+
+// ParseTaints parses and checks taint changes of the form "key=value:Effect",
+// "key:Effect" for a taint without a value, or "key:Effect-" to remove a taint.
+func (a *Allowlist) ParseTaints(changes []string) ([]Taint, error) {
+	if len(changes) == 0 {
+		return nil, fmt.Errorf("%w: no taints", ErrInvalid)
+	}
+	taints := make([]Taint, 0, len(changes))
+	for _, c := range changes {
+		remove := strings.HasSuffix(c, "-")
+		kv, effect, ok := strings.Cut(strings.TrimSuffix(c, "-"), ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q must be key=value:Effect, key:Effect or key:Effect-", ErrInvalid, c)
+		}
+		t := Taint{Effect: corev1.TaintEffect(effect), Remove: remove}
+		switch t.Effect {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return nil, fmt.Errorf("%w: bad taint effect %q", ErrInvalid, effect)
+		}
+		if remove {
+			kv += "-"
+		} else if !strings.Contains(kv, "=") {
+			// Taints may have an empty value.
+			kv += "="
+		}
+		var err error
+		t.Key, t.Value, _, err = parseKeyValue(kv)
+		if err != nil {
+			return nil, err
+		}
+		if a == nil || !allowed(a.Taints, t.Key, t.Value, remove) {
+			return nil, fmt.Errorf("%w: taint %q", ErrNotAllowed, c)
+		}
+		taints = append(taints, t)
+	}
+	return taints, nil
+}
@@ -0,0 +1,201 @@
+package node
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testAllowlist = &Allowlist{
+	Labels: map[string][]string{
+		"mlab/maintenance": {"true", "false"},
+		"mlab/stage":       {},
+	},
+	Taints: map[string][]string{
+		"mlab/maintenance": {"true"},
+		"mlab/drain":       {},
+	},
+}
+
+func Test_LoadAllowlist(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			content: `{"labels": {"mlab/maintenance": ["true"]}, "taints": {"mlab/maintenance": []}}`,
+		},
+		{
+			name:    "failure-bad-json",
+			content: `{"labels": `,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-key",
+			content: `{"labels": {"a/b/c": []}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-value",
+			content: `{"taints": {"mlab/maintenance": ["not valid"]}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "allowlist.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("failed to write allowlist: %v", err)
+			}
+			_, err := LoadAllowlist(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadAllowlist(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	a, err := LoadAllowlist("")
+	if a != nil || err != nil {
+		t.Errorf("LoadAllowlist(\"\") = %v, %v; want nil, nil", a, err)
+	}
+}
+
+func Test_ParseLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist *Allowlist
+		changes   []string
+		expect    []string
+		wantErr   error
+	}{
+		{
+			name:      "success",
+			allowlist: testAllowlist,
+			changes:   []string{"mlab/maintenance=true", "mlab/stage=stage3", "mlab/stage-"},
+			expect:    []string{"mlab/maintenance=true", "mlab/stage=stage3", "mlab/stage-"},
+		},
+		{
+			name:      "failure-value-not-allowed",
+			allowlist: testAllowlist,
+			changes:   []string{"mlab/maintenance=maybe"},
+			wantErr:   ErrNotAllowed,
+		},
+		{
+			name:      "failure-key-not-allowed",
+			allowlist: testAllowlist,
+			changes:   []string{"mlab/type=virtual"},
+			wantErr:   ErrNotAllowed,
+		},
+		{
+			name:    "failure-nil-allowlist",
+			changes: []string{"mlab/maintenance=true"},
+			wantErr: ErrNotAllowed,
+		},
+		{
+			name:      "failure-no-labels",
+			allowlist: testAllowlist,
+			wantErr:   ErrInvalid,
+		},
+		{
+			name:      "failure-no-value",
+			allowlist: testAllowlist,
+			changes:   []string{"mlab/maintenance"},
+			wantErr:   ErrInvalid,
+		},
+		{
+			name:      "failure-bad-value",
+			allowlist: testAllowlist,
+			changes:   []string{"mlab/stage=not valid"},
+			wantErr:   ErrInvalid,
+		},
+		{
+			name:      "failure-bad-key",
+			allowlist: testAllowlist,
+			changes:   []string{"a/b/c=true"},
+			wantErr:   ErrInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels, err := tt.allowlist.ParseLabels(tt.changes)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseLabels(): error = %v, want %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, l := range labels {
+				got = append(got, l.String())
+			}
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("ParseLabels() = %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
+
+func Test_ParseTaints(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes []string
+		expect  []string
+		wantErr error
+	}{
+		{
+			name:    "success",
+			changes: []string{"mlab/maintenance=true:NoSchedule", "mlab/maintenance:NoExecute-"},
+			expect:  []string{"mlab/maintenance=true:NoSchedule", "mlab/maintenance:NoExecute-"},
+		},
+		{
+			name:    "success-no-value",
+			changes: []string{"mlab/drain:NoExecute"},
+			expect:  []string{"mlab/drain:NoExecute"},
+		},
+		{
+			name:    "failure-empty-value-not-allowed",
+			changes: []string{"mlab/maintenance:NoSchedule"},
+			wantErr: ErrNotAllowed,
+		},
+		{
+			name:    "failure-value-not-allowed",
+			changes: []string{"mlab/maintenance=false:NoSchedule"},
+			wantErr: ErrNotAllowed,
+		},
+		{
+			name:    "failure-key-not-allowed",
+			changes: []string{"mlab/stage=true:NoSchedule"},
+			wantErr: ErrNotAllowed,
+		},
+		{
+			name:    "failure-no-effect",
+			changes: []string{"mlab/maintenance=true"},
+			wantErr: ErrInvalid,
+		},
+		{
+			name:    "failure-bad-effect",
+			changes: []string{"mlab/maintenance=true:Sometimes"},
+			wantErr: ErrInvalid,
+		},
+		{
+			name:    "failure-no-taints",
+			wantErr: ErrInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taints, err := testAllowlist.ParseTaints(tt.changes)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseTaints(): error = %v, want %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, t := range taints {
+				got = append(got, t.String())
+			}
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("ParseTaints() = %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
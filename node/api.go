@@ -0,0 +1,275 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// defaultPollInterval is how often a drain retries evictions blocked by a
+// PodDisruptionBudget and checks whether evicted pods are gone.
+const defaultPollInterval = 2 * time.Second
+
+// APIManager implements the Manager interface by managing nodes directly
+// through the Kubernetes API, instead of running kubectl.
+type APIManager struct {
+	Client kubernetes.Interface
+	// DrainTimeout is how long Delete waits for the pods of a node to be
+	// evicted before deleting it anyway. Zero deletes nodes without draining
+	// them.
+	DrainTimeout time.Duration
+	// Allowlist lists the labels and taints machines may change on their
+	// nodes. A nil Allowlist allows no changes.
+	Allowlist *Allowlist
+
+	pollInterval time.Duration
+}
+
+// classify wraps Kubernetes API errors in ErrNotFound, ErrForbidden or
+// ErrConflict.
+func classify(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case apierrors.IsNotFound(err):
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	case apierrors.IsForbidden(err):
+		return fmt.Errorf("%w: %v", ErrForbidden, err)
+	case apierrors.IsConflict(err):
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	return err
+}
+
+// patch applies a JSON merge patch to the target node.
+func (m *APIManager) patch(ctx context.Context, target string, p map[string]interface{}) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = m.Client.CoreV1().Nodes().Patch(ctx, target, types.MergePatchType, b, metav1.PatchOptions{})
+	return classify(err)
+}
+
+// setUnschedulable sets the spec.unschedulable field of the target node.
+func (m *APIManager) setUnschedulable(ctx context.Context, target string, unschedulable bool) error {
+	return m.patch(ctx, target, map[string]interface{}{
+		"spec": map[string]interface{}{"unschedulable": unschedulable},
+	})
+}
+
+// Cordon marks a node as unschedulable.
+func (m *APIManager) Cordon(ctx context.Context, target string) error {
+	return m.setUnschedulable(ctx, target, true)
+}
+
+// Uncordon marks a node as schedulable again.
+func (m *APIManager) Uncordon(ctx context.Context, target string) error {
+	return m.setUnschedulable(ctx, target, false)
+}
+
+// Label sets or removes the labels of a node. Changes have the form
+// "key=value", or "key-" to remove a label, and must be allowed by
+// m.Allowlist.
+func (m *APIManager) Label(ctx context.Context, target string, changes []string) error {
+	labels, err := m.Allowlist.ParseLabels(changes)
+	if err != nil {
+		return err
+	}
+	// In a merge patch, a null value removes the key.
+	values := map[string]interface{}{}
+	for _, l := range labels {
+		values[l.Key] = l.Value
+		if l.Remove {
+			values[l.Key] = nil
+		}
+	}
+	return m.patch(ctx, target, map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": values},
+	})
+}
+
+// Taint sets or removes the taints of a node. Changes have the form
+// "key=value:Effect", or "key:Effect-" to remove a taint, and must be allowed
+// by m.Allowlist. Removing a taint the node does not have is not an error.
+func (m *APIManager) Taint(ctx context.Context, target string, changes []string) error {
+	taints, err := m.Allowlist.ParseTaints(changes)
+	if err != nil {
+		return err
+	}
+	nodes := m.Client.CoreV1().Nodes()
+	// Taints are a list, which merge patches replace as a whole, so update
+	// the node and retry if it changed in the meantime.
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		n, err := nodes.Get(ctx, target, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		n.Spec.Taints = applyTaints(n.Spec.Taints, taints)
+		_, err = nodes.Update(ctx, n, metav1.UpdateOptions{})
+		return err
+	})
+	return classify(err)
+}
+
+// applyTaints returns current with changes applied. Like `kubectl taint
+// --overwrite`, a taint replaces any taint with the same key and effect.
+func applyTaints(current []corev1.Taint, changes []Taint) []corev1.Taint {
+	for _, c := range changes {
+		result := make([]corev1.Taint, 0, len(current)+1)
+		for _, t := range current {
+			if t.Key != c.Key || t.Effect != c.Effect {
+				result = append(result, t)
+			}
+		}
+		if !c.Remove {
+			result = append(result, corev1.Taint{Key: c.Key, Value: c.Value, Effect: c.Effect})
+		}
+		current = result
+	}
+	return current
+}
+
+// evictable returns whether a drain should evict pod. Like `kubectl drain
+// --ignore-daemonsets`, it skips DaemonSet pods, which would be recreated on
+// the node right away, mirror pods, which cannot be evicted, and pods that
+// are not running anymore.
+func evictable(pod *corev1.Pod) bool {
+	if _, ok := pod.Annotations[corev1.MirrorPodAnnotationKey]; ok {
+		return false
+	}
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+	if c := metav1.GetControllerOf(pod); c != nil && c.Kind == "DaemonSet" {
+		return false
+	}
+	return true
+}
+
+// waitForDeletion waits until pod is gone, or has been replaced by a new pod
+// with the same name.
+func (m *APIManager) waitForDeletion(ctx context.Context, pod *corev1.Pod) error {
+	for {
+		p, err := m.Client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			return nil
+		case err != nil:
+			return err
+		case p.UID != pod.UID:
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(m.pollInterval):
+		}
+	}
+}
+
+// drain cordons the target node and evicts its pods, respecting their
+// PodDisruptionBudgets. It returns the result of the drain.
+func (m *APIManager) drain(ctx context.Context, target string) string {
+	start := time.Now()
+	result := drainSuccess
+	defer func() { recordDrain(target, result, start) }()
+
+	ctx, cancel := context.WithTimeout(ctx, m.DrainTimeout)
+	defer cancel()
+
+	err := m.setUnschedulable(ctx, target, true)
+	if err == nil {
+		err = m.evictAll(ctx, target)
+	}
+	if err != nil {
+		slog.Warn("drain failed", "node", target, "error", err)
+		result = drainError
+		if errors.Is(err, context.DeadlineExceeded) {
+			result = drainTimeout
+		}
+	}
+	return result
+}
+
+// evictAll evicts the evictable pods of the target node and waits until they
+// are gone. Evictions blocked by a PodDisruptionBudget are retried until ctx
+// is done.
+func (m *APIManager) evictAll(ctx context.Context, target string) error {
+	pods, err := m.Client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", target).String(),
+	})
+	if err != nil {
+		return err
+	}
+	var pending, evicted []*corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName == target && evictable(pod) {
+			pending = append(pending, pod)
+		}
+	}
+	for len(pending) > 0 {
+		var blocked []*corev1.Pod
+		for _, pod := range pending {
+			eviction := &policyv1.Eviction{
+				ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+			}
+			err := m.Client.PolicyV1().Evictions(pod.Namespace).Evict(ctx, eviction)
+			switch {
+			case err == nil, apierrors.IsNotFound(err):
+				evicted = append(evicted, pod)
+			case apierrors.IsTooManyRequests(err):
+				blocked = append(blocked, pod)
+			default:
+				return fmt.Errorf("could not evict pod %s/%s: %w", pod.Namespace, pod.Name, err)
+			}
+		}
+		if pending = blocked; len(pending) == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("could not evict %d pods: %w", len(pending), ctx.Err())
+		case <-time.After(m.pollInterval):
+		}
+	}
+	for _, pod := range evicted {
+		if err := m.waitForDeletion(ctx, pod); err != nil {
+			return fmt.Errorf("pod %s/%s was not deleted: %w", pod.Namespace, pod.Name, err)
+		}
+	}
+	return nil
+}
+
+// Delete deletes a node from the cluster. If m.DrainTimeout is set, the node is
+// drained first. The node is deleted even if draining it fails or times out.
+func (m *APIManager) Delete(ctx context.Context, target string) error {
+	if m.DrainTimeout > 0 {
+		m.drain(ctx, target)
+	}
+	err := m.Client.CoreV1().Nodes().Delete(ctx, target, metav1.DeleteOptions{})
+	return classify(err)
+}
+
+// NewAPIManager returns an *APIManager using the given Kubernetes client, which
+// drains nodes for at most drainTimeout before deleting them.
+func NewAPIManager(client kubernetes.Interface, drainTimeout time.Duration) *APIManager {
+	return &APIManager{
+		Client:       client,
+		DrainTimeout: drainTimeout,
+		pollInterval: defaultPollInterval,
+	}
+}
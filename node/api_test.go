@@ -0,0 +1,286 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testNode = "mlab4-abc0t.mlab-sandbox.measurement-lab.org"
+
+func testPod(name string, nodeName string, mutate func(p *corev1.Pod)) *corev1.Pod {
+	p := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)},
+		Spec:       corev1.PodSpec{NodeName: nodeName},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if mutate != nil {
+		mutate(p)
+	}
+	return p
+}
+
+// evictionReactor makes evictions delete their pod, as the API server would.
+// Pods in blocked are rejected as if by a PodDisruptionBudget.
+func evictionReactor(client *fake.Clientset, blocked map[string]bool) k8stesting.ReactionFunc {
+	return func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		e := action.(k8stesting.CreateAction).GetObject().(*policyv1.Eviction)
+		if blocked[e.Name] {
+			return true, nil, apierrors.NewTooManyRequests("cannot evict pod due to disruption budget", 1)
+		}
+		err := client.Tracker().Delete(schema.GroupVersionResource{Version: "v1", Resource: "pods"}, e.Namespace, e.Name)
+		return true, nil, err
+	}
+}
+
+func Test_APIManager_Delete(t *testing.T) {
+	tests := []struct {
+		name      string
+		objects   []runtime.Object
+		blocked   map[string]bool
+		timeout   time.Duration
+		remaining []string
+		result    string
+		wantErr   error
+	}{
+		{
+			name: "success",
+			objects: []runtime.Object{
+				&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNode}},
+				testPod("web", testNode, nil),
+				testPod("other-node", "mlab1-abc0t.mlab-sandbox.measurement-lab.org", nil),
+				testPod("daemon", testNode, func(p *corev1.Pod) {
+					p.OwnerReferences = []metav1.OwnerReference{
+						{Kind: "DaemonSet", Name: "ds", Controller: &[]bool{true}[0]},
+					}
+				}),
+				testPod("mirror", testNode, func(p *corev1.Pod) {
+					p.Annotations = map[string]string{corev1.MirrorPodAnnotationKey: "x"}
+				}),
+				testPod("done", testNode, func(p *corev1.Pod) {
+					p.Status.Phase = corev1.PodSucceeded
+				}),
+			},
+			timeout:   time.Minute,
+			remaining: []string{"daemon", "done", "mirror", "other-node"},
+			result:    drainSuccess,
+		},
+		{
+			name: "drain-timeout-deletes-anyway",
+			objects: []runtime.Object{
+				&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNode}},
+				testPod("web", testNode, nil),
+				testPod("protected", testNode, nil),
+			},
+			blocked:   map[string]bool{"protected": true},
+			timeout:   50 * time.Millisecond,
+			remaining: []string{"protected"},
+			result:    drainTimeout,
+		},
+		{
+			name:    "failure-node-not-found",
+			timeout: time.Minute,
+			result:  drainError,
+			wantErr: ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(metrics.NodeDrains.WithLabelValues(tt.result))
+			client := fake.NewSimpleClientset(tt.objects...)
+			client.PrependReactor("create", "pods", evictionReactor(client, tt.blocked))
+			m := NewAPIManager(client, tt.timeout)
+			m.pollInterval = time.Millisecond
+
+			err := m.Delete(context.Background(), testNode)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Delete(): error = %v, want %v", err, tt.wantErr)
+			}
+
+			ctx := context.Background()
+			if _, err := client.CoreV1().Nodes().Get(ctx, testNode, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+				t.Errorf("Delete(): node still exists: %v", err)
+			}
+			pods, err := client.CoreV1().Pods("default").List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("List(): %v", err)
+			}
+			var remaining []string
+			for _, p := range pods.Items {
+				remaining = append(remaining, p.Name)
+			}
+			sort.Strings(remaining)
+			if !reflect.DeepEqual(remaining, tt.remaining) {
+				t.Errorf("Delete(): remaining pods %v, want %v", remaining, tt.remaining)
+			}
+			after := testutil.ToFloat64(metrics.NodeDrains.WithLabelValues(tt.result))
+			if after != before+1 {
+				t.Errorf("node_drains_total{result=%q} = %v, want %v", tt.result, after, before+1)
+			}
+		})
+	}
+}
+
+func Test_APIManager_Actions(t *testing.T) {
+	tests := []struct {
+		name    string
+		run     func(m *APIManager) error
+		expect  func(n *corev1.Node) bool
+		wantErr error
+	}{
+		{
+			name: "cordon",
+			run:  func(m *APIManager) error { return m.Cordon(context.Background(), testNode) },
+			expect: func(n *corev1.Node) bool {
+				return n.Spec.Unschedulable
+			},
+		},
+		{
+			name: "uncordon",
+			run:  func(m *APIManager) error { return m.Uncordon(context.Background(), testNode) },
+			expect: func(n *corev1.Node) bool {
+				return !n.Spec.Unschedulable
+			},
+		},
+		{
+			name: "label",
+			run: func(m *APIManager) error {
+				return m.Label(context.Background(), testNode, []string{"mlab/maintenance=true", "mlab/stage-"})
+			},
+			expect: func(n *corev1.Node) bool {
+				return reflect.DeepEqual(n.Labels, map[string]string{
+					"mlab/maintenance": "true",
+					"mlab/type":        "physical",
+				})
+			},
+		},
+		{
+			name: "taint",
+			run: func(m *APIManager) error {
+				return m.Taint(context.Background(), testNode, []string{"mlab/maintenance=true:NoSchedule"})
+			},
+			expect: func(n *corev1.Node) bool {
+				return reflect.DeepEqual(n.Spec.Taints, []corev1.Taint{
+					{Key: "mlab/maintenance", Value: "true", Effect: corev1.TaintEffectNoExecute},
+					{Key: "mlab/maintenance", Value: "true", Effect: corev1.TaintEffectNoSchedule},
+				})
+			},
+		},
+		{
+			name: "taint-remove",
+			run: func(m *APIManager) error {
+				return m.Taint(context.Background(), testNode, []string{"mlab/maintenance:NoExecute-"})
+			},
+			expect: func(n *corev1.Node) bool {
+				return len(n.Spec.Taints) == 0
+			},
+		},
+		{
+			name: "label-not-allowed",
+			run: func(m *APIManager) error {
+				return m.Label(context.Background(), testNode, []string{"mlab/type=virtual"})
+			},
+			wantErr: ErrNotAllowed,
+		},
+		{
+			name: "cordon-not-found",
+			run: func(m *APIManager) error {
+				return m.Cordon(context.Background(), "mlab1-abc0t.mlab-sandbox.measurement-lab.org")
+			},
+			wantErr: ErrNotFound,
+		},
+		{
+			name: "taint-not-found",
+			run: func(m *APIManager) error {
+				return m.Taint(context.Background(), "mlab1-abc0t.mlab-sandbox.measurement-lab.org", []string{"mlab/maintenance=true:NoSchedule"})
+			},
+			wantErr: ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   testNode,
+					Labels: map[string]string{"mlab/stage": "stage3", "mlab/type": "physical"},
+				},
+				Spec: corev1.NodeSpec{
+					Unschedulable: true,
+					Taints: []corev1.Taint{
+						{Key: "mlab/maintenance", Value: "true", Effect: corev1.TaintEffectNoExecute},
+					},
+				},
+			})
+			m := NewAPIManager(client, 0)
+			m.Allowlist = testAllowlist
+
+			err := tt.run(m)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			n, err := client.CoreV1().Nodes().Get(context.Background(), testNode, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get(): %v", err)
+			}
+			if !tt.expect(n) {
+				t.Errorf("%s: unexpected node %+v", tt.name, n)
+			}
+		})
+	}
+}
+
+func Test_classify(t *testing.T) {
+	gr := schema.GroupResource{Resource: "nodes"}
+	tests := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{
+			name:    "not-found",
+			err:     apierrors.NewNotFound(gr, testNode),
+			wantErr: ErrNotFound,
+		},
+		{
+			name:    "forbidden",
+			err:     apierrors.NewForbidden(gr, testNode, errors.New("no")),
+			wantErr: ErrForbidden,
+		},
+		{
+			name:    "conflict",
+			err:     apierrors.NewConflict(gr, testNode, errors.New("modified")),
+			wantErr: ErrConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := classify(tt.err); !errors.Is(err, tt.wantErr) {
+				t.Errorf("classify() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if err := classify(nil); err != nil {
+		t.Errorf("classify(nil) = %v, want nil", err)
+	}
+}
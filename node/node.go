@@ -7,49 +7,216 @@
 package node
 
 import (
-	"log"
-	"os/exec"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/internal/exec"
+	"github.com/m-lab/epoxy-extensions/metrics"
+)
+
+// Drain results, as recorded in metrics and logs.
+const (
+	drainSuccess = "success"
+	drainTimeout = "timeout"
+	drainError   = "error"
+)
+
+// drainGrace is how much longer than its own timeout `kubectl drain` may run
+// before it is killed.
+const drainGrace = time.Minute
+
+// Errors returned by Managers, wrapping the error of the backend.
+var (
+	ErrNotFound  = errors.New("node not found")
+	ErrForbidden = errors.New("forbidden")
+	ErrConflict  = errors.New("conflict")
 )
 
-// Commander is an interface that is used to wrap os/exec.Command() for testing purposes.
-type Commander interface {
-	Run(args ...string) ([]byte, error)
+// Manager mediates operations for a given node. Operations are canceled when
+// their context is done.
+type Manager interface {
+	// Delete deletes a node from the cluster, draining it first if
+	// configured.
+	Delete(ctx context.Context, target string) error
+	// Cordon marks a node as unschedulable.
+	Cordon(ctx context.Context, target string) error
+	// Uncordon marks a node as schedulable again.
+	Uncordon(ctx context.Context, target string) error
+	// Label sets or removes the labels of a node. Changes have the form
+	// "key=value", or "key-" to remove a label.
+	Label(ctx context.Context, target string, changes []string) error
+	// Taint sets or removes the taints of a node. Changes have the form
+	// "key=value:Effect", or "key:Effect-" to remove a taint.
+	Taint(ctx context.Context, target string, changes []string) error
 }
 
-// Command implements the Commander interface.
-type Command struct {
-	Path string
+// recordDrain reports the result of a drain started at start.
+func recordDrain(target string, result string, start time.Time) {
+	metrics.NodeDrains.WithLabelValues(result).Inc()
+	metrics.NodeDrainDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	slog.Info("drain finished", "node", target, "result", result, "duration", time.Since(start).Round(time.Millisecond))
 }
 
-func (c *Command) Run(args ...string) ([]byte, error) {
-	cmd := exec.Command(c.Path, args...)
-	return cmd.Output()
+// KubectlManager implements the Manager interface by running kubectl.
+type KubectlManager struct {
+	// Runner runs kubectl.
+	Runner exec.Runner
+	// DrainTimeout is how long Delete waits for the pods of a node to be
+	// evicted before deleting it anyway. Zero deletes nodes without draining
+	// them.
+	DrainTimeout time.Duration
+	// Allowlist lists the labels and taints machines may change on their
+	// nodes. A nil Allowlist allows no changes.
+	Allowlist *Allowlist
+	// Kubeconfig is the path of the kubeconfig file of the cluster. If
+	// empty, kubectl uses its default.
+	Kubeconfig string
 }
 
-// Manager mediates operations for a given node.
-type Manager struct {
-	Command Commander
+// kubectl runs kubectl with args, recording the latency of the call as the
+// operation named by the first argument.
+func (m *KubectlManager) kubectl(ctx context.Context, args ...string) ([]byte, error) {
+	operation := args[0]
+	if m.Kubeconfig != "" {
+		args = append(args[:len(args):len(args)], "--kubeconfig", m.Kubeconfig)
+	}
+	start := time.Now()
+	output, err := m.Runner.Run(ctx, args...)
+	metrics.ObserveBackendCall("kubectl", operation, start, err)
+	return output, err
 }
 
-// Delete deletes a node from the cluster.
-func (m *Manager) Delete(target string) error {
-	args := []string{
-		"delete", "node", target,
+// run runs kubectl with args and logs its output at debug level.
+func (m *KubectlManager) run(ctx context.Context, args ...string) error {
+	output, err := m.kubectl(ctx, args...)
+	slog.Debug("kubectl output", "args", args, "output", strings.TrimSpace(string(output)))
+	return classifyOutput(err)
+}
+
+// classifyOutput wraps the error of a kubectl command that exited with an
+// error in ErrNotFound, ErrForbidden or ErrConflict, based on the API error it
+// printed.
+func classifyOutput(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code <= 0 {
+		return err
+	}
+	stderr := strings.TrimSpace(string(exitErr.Stderr))
+	switch {
+	case strings.Contains(stderr, "(NotFound)"):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case strings.Contains(stderr, "(Forbidden)"):
+		return fmt.Errorf("%w: %w", ErrForbidden, err)
+	case strings.Contains(stderr, "(Conflict)"):
+		return fmt.Errorf("%w: %w", ErrConflict, err)
 	}
+	return err
+}
 
-	// Delete the node
-	output, err := m.Command.Run(args...)
-	log.Println(string(output))
+// Cordon marks a node as unschedulable.
+func (m *KubectlManager) Cordon(ctx context.Context, target string) error {
+	return m.run(ctx, "cordon", target)
+}
+
+// Uncordon marks a node as schedulable again.
+func (m *KubectlManager) Uncordon(ctx context.Context, target string) error {
+	return m.run(ctx, "uncordon", target)
+}
+
+// Label sets or removes the labels of a node. Changes have the form
+// "key=value", or "key-" to remove a label, and must be allowed by
+// m.Allowlist.
+func (m *KubectlManager) Label(ctx context.Context, target string, changes []string) error {
+	labels, err := m.Allowlist.ParseLabels(changes)
+	if err != nil {
+		return err
+	}
+	args := []string{"label", "node", target, "--overwrite"}
+	for _, l := range labels {
+		args = append(args, l.String())
+	}
+	return m.run(ctx, args...)
+}
+
+// Taint sets or removes the taints of a node. Changes have the form
+// "key=value:Effect", or "key:Effect-" to remove a taint, and must be allowed
+// by m.Allowlist.
+func (m *KubectlManager) Taint(ctx context.Context, target string, changes []string) error {
+	taints, err := m.Allowlist.ParseTaints(changes)
 	if err != nil {
 		return err
 	}
+	args := []string{"taint", "node", target, "--overwrite"}
+	for _, t := range taints {
+		args = append(args, t.String())
+	}
+	return m.run(ctx, args...)
+}
+
+// drain cordons the target node and evicts its pods, respecting their
+// PodDisruptionBudgets. It returns the result of the drain.
+func (m *KubectlManager) drain(ctx context.Context, target string) string {
+	start := time.Now()
+	result := drainSuccess
+	defer func() { recordDrain(target, result, start) }()
+
+	output, err := m.kubectl(ctx, "cordon", target)
+	slog.Debug("kubectl output", "node", target, "phase", "cordon", "output", strings.TrimSpace(string(output)))
+	if err != nil {
+		slog.Warn("cordon failed", "node", target, "error", err)
+		result = drainError
+		return result
+	}
+
+	args := []string{
+		"drain", target,
+		"--ignore-daemonsets",
+		"--delete-emptydir-data",
+		"--timeout=" + m.DrainTimeout.String(),
+	}
+	// kubectl gives up after its own timeout, so it only needs to be killed
+	// if it hangs.
+	drainCtx, cancel := context.WithTimeout(ctx, m.DrainTimeout+drainGrace)
+	defer cancel()
+	output, err = m.kubectl(drainCtx, args...)
+	slog.Debug("kubectl output", "node", target, "phase", "drain", "output", strings.TrimSpace(string(output)))
+	if err != nil {
+		slog.Warn("drain failed", "node", target, "error", err)
+		result = drainError
+		// kubectl does not exit with a specific code when the drain times
+		// out, so assume it did if it ran for the whole timeout.
+		if time.Since(start) >= m.DrainTimeout || strings.Contains(string(output), "timed out") ||
+			errors.Is(err, context.DeadlineExceeded) {
+			result = drainTimeout
+		}
+	}
+	return result
+}
+
+// Delete deletes a node from the cluster. If m.DrainTimeout is set, the node is
+// drained first. The node is deleted even if draining it fails or times out.
+func (m *KubectlManager) Delete(ctx context.Context, target string) error {
+	if m.DrainTimeout > 0 {
+		m.drain(ctx, target)
+	}
 
-	return nil
+	args := []string{
+		"delete", "node", target,
+	}
+
+	// Delete the node
+	return m.run(ctx, args...)
 }
 
-// NewManager returns a *node.Manager
-func NewManager(cmd *Command) *Manager {
-	return &Manager{
-		Command: cmd,
+// NewManager returns a *node.KubectlManager running kubectl with runner, which
+// drains nodes for at most drainTimeout before deleting them.
+func NewManager(runner exec.Runner, drainTimeout time.Duration) *KubectlManager {
+	return &KubectlManager{
+		Runner:       runner,
+		DrainTimeout: drainTimeout,
 	}
 }
@@ -1,8 +1,16 @@
 package node
 
 import (
-	"strings"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/internal/exec"
+	"github.com/m-lab/epoxy-extensions/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func Test_Delete(t *testing.T) {
@@ -27,11 +35,11 @@ func Test_Delete(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &Command{
+			c := &exec.Command{
 				Path: tt.command,
 			}
-			m := NewManager(c)
-			err := m.Delete(tt.hostname)
+			m := NewManager(c, 0)
+			err := m.Delete(context.Background(), tt.hostname)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Delete(): error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -39,41 +47,228 @@ func Test_Delete(t *testing.T) {
 	}
 }
 
-func Test_Command(t *testing.T) {
+// fakeKubectl fails the commands whose first argument is in fail.
+type fakeKubectl struct {
+	fail  map[string]bool
+	sleep time.Duration
+}
+
+func (f *fakeKubectl) run(args []string) ([]byte, error) {
+	if args[0] == "drain" {
+		time.Sleep(f.sleep)
+	}
+	if f.fail[args[0]] {
+		return nil, exec.Failure(1, "error: "+args[0]+" failed")
+	}
+	return []byte("ok"), nil
+}
+
+// commands returns the first argument of each run of f.
+func commands(f *exec.Fake) []string {
+	var runs []string
+	for _, args := range f.Runs() {
+		runs = append(runs, args[0])
+	}
+	return runs
+}
+
+func Test_DeleteDrain(t *testing.T) {
 	tests := []struct {
 		name    string
-		prog    string
-		args    []string
-		expect  string
+		fail    map[string]bool
+		sleep   time.Duration
+		timeout time.Duration
+		runs    []string
+		result  string
 		wantErr bool
 	}{
 		{
-			name:    "success",
-			prog:    "date",
-			args:    []string{"--date=@1679083030", "--utc", "+%FT%T"},
-			expect:  "2023-03-17T19:57:10",
-			wantErr: false,
+			name:   "success",
+			runs:   []string{"cordon", "drain", "delete"},
+			result: drainSuccess,
 		},
 		{
-			name:    "failure",
-			prog:    "nosuchfile",
-			args:    []string{"lol", ";-)"},
+			name:   "drain-error-deletes-anyway",
+			fail:   map[string]bool{"drain": true},
+			runs:   []string{"cordon", "drain", "delete"},
+			result: drainError,
+		},
+		{
+			name:    "drain-timeout-deletes-anyway",
+			fail:    map[string]bool{"drain": true},
+			sleep:   20 * time.Millisecond,
+			timeout: 10 * time.Millisecond,
+			runs:    []string{"cordon", "drain", "delete"},
+			result:  drainTimeout,
+		},
+		{
+			name:    "cordon-error-skips-drain",
+			fail:    map[string]bool{"cordon": true, "delete": true},
+			runs:    []string{"cordon", "delete"},
+			result:  drainError,
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			dc := &Command{
-				Path: tt.prog,
+			before := testutil.ToFloat64(metrics.NodeDrains.WithLabelValues(tt.result))
+			k := &fakeKubectl{fail: tt.fail, sleep: tt.sleep}
+			c := &exec.Fake{Func: k.run}
+			m := &KubectlManager{Runner: c, DrainTimeout: time.Minute}
+			if tt.timeout > 0 {
+				m.DrainTimeout = tt.timeout
 			}
-			output, err := dc.Run(tt.args...)
-			result := strings.TrimSpace(string(output))
+			err := m.Delete(context.Background(), "mlab4-abc0t.mlab-sandbox.measurement-lab.org")
 			if (err != nil) != tt.wantErr {
-				t.Errorf("Command(): error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("Delete(): error = %v, wantErr %v", err, tt.wantErr)
 			}
-			if result != tt.expect {
-				t.Errorf("Command(): expected '%s', got '%s'", tt.expect, result)
+			if runs := commands(c); !reflect.DeepEqual(runs, tt.runs) {
+				t.Errorf("Delete(): ran %v, want %v", runs, tt.runs)
+			}
+			after := testutil.ToFloat64(metrics.NodeDrains.WithLabelValues(tt.result))
+			if after != before+1 {
+				t.Errorf("node_drains_total{result=%q} = %v, want %v", tt.result, after, before+1)
 			}
 		})
 	}
 }
+
+func Test_Actions(t *testing.T) {
+	target := "mlab4-abc0t.mlab-sandbox.measurement-lab.org"
+	tests := []struct {
+		name    string
+		run     func(m *KubectlManager) error
+		expect  []string
+		wantErr bool
+	}{
+		{
+			name:   "cordon",
+			run:    func(m *KubectlManager) error { return m.Cordon(context.Background(), target) },
+			expect: []string{"cordon", target},
+		},
+		{
+			name:   "uncordon",
+			run:    func(m *KubectlManager) error { return m.Uncordon(context.Background(), target) },
+			expect: []string{"uncordon", target},
+		},
+		{
+			name: "label",
+			run: func(m *KubectlManager) error {
+				return m.Label(context.Background(), target, []string{"mlab/maintenance=true", "mlab/stage-"})
+			},
+			expect: []string{"label", "node", target, "--overwrite", "mlab/maintenance=true", "mlab/stage-"},
+		},
+		{
+			name: "taint",
+			run: func(m *KubectlManager) error {
+				return m.Taint(context.Background(), target, []string{"mlab/maintenance=true:NoSchedule"})
+			},
+			expect: []string{"taint", "node", target, "--overwrite", "mlab/maintenance=true:NoSchedule"},
+		},
+		{
+			name: "label-not-allowed",
+			run: func(m *KubectlManager) error {
+				return m.Label(context.Background(), target, []string{"mlab/type=virtual"})
+			},
+			wantErr: true,
+		},
+		{
+			name: "taint-invalid",
+			run: func(m *KubectlManager) error {
+				return m.Taint(context.Background(), target, []string{"mlab/maintenance=true"})
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &exec.Fake{}
+			m := &KubectlManager{Runner: c, Allowlist: testAllowlist}
+			err := tt.run(m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			runs := c.Runs()
+			if tt.wantErr {
+				if len(runs) != 0 {
+					t.Errorf("%s: ran %v for a rejected change", tt.name, runs)
+				}
+				return
+			}
+			if len(runs) != 1 || !reflect.DeepEqual(runs[0], tt.expect) {
+				t.Errorf("%s: ran %v, want %v", tt.name, runs, tt.expect)
+			}
+		})
+	}
+}
+
+func Test_Kubeconfig(t *testing.T) {
+	target := "mlab4-abc0t.mlab-sandbox.measurement-lab.org"
+	c := &exec.Fake{}
+	m := &KubectlManager{Runner: c, DrainTimeout: time.Minute, Kubeconfig: "/etc/kubeconfig/sandbox.conf"}
+	if err := m.Delete(context.Background(), target); err != nil {
+		t.Fatalf("Delete(): unexpected error: %v", err)
+	}
+	runs := c.Runs()
+	if got := commands(c); !reflect.DeepEqual(got, []string{"cordon", "drain", "delete"}) {
+		t.Fatalf("Delete(): ran %v", runs)
+	}
+	for _, args := range runs {
+		flags := args[len(args)-2:]
+		if !reflect.DeepEqual(flags, []string{"--kubeconfig", "/etc/kubeconfig/sandbox.conf"}) {
+			t.Errorf("kubectl %v: want the --kubeconfig flag", args)
+		}
+	}
+}
+
+func Test_classifyOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{
+			name:    "not-found",
+			err:     exec.Failure(1, `Error from server (NotFound): nodes "mlab4" not found`),
+			wantErr: ErrNotFound,
+		},
+		{
+			name:    "forbidden",
+			err:     exec.Failure(1, `Error from server (Forbidden): nodes "mlab4" is forbidden`),
+			wantErr: ErrForbidden,
+		},
+		{
+			name:    "conflict",
+			err:     exec.Failure(1, `Error from server (Conflict): the object has been modified`),
+			wantErr: ErrConflict,
+		},
+		{
+			name: "other",
+			err:  exec.Failure(1, `error: unknown flag`),
+		},
+		{
+			name: "killed",
+			err:  &exec.ExitError{Code: -1, Stderr: []byte(`Error from server (NotFound)`), Err: context.DeadlineExceeded},
+		},
+		{
+			name: "not-exit-error",
+			err:  fmt.Errorf("exec: not found"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyOutput(tt.err)
+			if err == nil {
+				t.Fatalf("classifyOutput() = nil, want an error")
+			}
+			for _, e := range []error{ErrNotFound, ErrForbidden, ErrConflict} {
+				if errors.Is(err, e) != (e == tt.wantErr) {
+					t.Errorf("classifyOutput() = %v, want %v", err, tt.wantErr)
+				}
+			}
+		})
+	}
+	if err := classifyOutput(nil); err != nil {
+		t.Errorf("classifyOutput(nil) = %v, want nil", err)
+	}
+}
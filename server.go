@@ -1,22 +1,96 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/m-lab/epoxy-extensions/bmc"
+	"github.com/m-lab/epoxy-extensions/cluster"
 	"github.com/m-lab/epoxy-extensions/handler"
+	"github.com/m-lab/epoxy-extensions/internal/exec"
+	"github.com/m-lab/epoxy-extensions/logging"
 	"github.com/m-lab/epoxy-extensions/metrics"
 	"github.com/m-lab/epoxy-extensions/node"
+	"github.com/m-lab/epoxy-extensions/tlsconfig"
 	"github.com/m-lab/epoxy-extensions/token"
+	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version string
+
 var (
-	fBinDir        string
-	fListenAddress string
+	fBMCBackend        string
+	fBMCMapping        string
+	fBMCVerify         bool
+	fBMCVerifyInsecure bool
+	fBMCVerifyTimeout  time.Duration
+	fBMCFile           string
+	fBMCFileKey        string
+	fVaultAddress      string
+	fVaultTokenFile    string
+	fVaultMount        string
+	fVaultPrefix       string
+
+	fOperators     string
+	fAuthConfig    string
+	fIdentityCheck string
+	fRateLimits    string
+	fReplay        string
+	fReplayTTL     time.Duration
+
+	fTokenMaxUptime time.Duration
+	fBMCMaxUptime   time.Duration
+	fNodeMaxUptime  time.Duration
+	fClockSkew      time.Duration
+
+	fBinDir         string
+	fCommandTimeout time.Duration
+	fDrainTimeout   time.Duration
+	fNodeBackend    string
+	fNodeAllowlist  string
+	fKubeconfig     string
+	fClusters       string
+	fListenAddress  string
+	fMetricsAddress string
+
+	fTLSCert              string
+	fTLSKey               string
+	fTLSClientCA          string
+	fTLSRequireClientCert bool
+	fTLSReloadInterval    time.Duration
+	fTokenBackend         string
+	fTokenPolicy          string
+	fTokenReuse           bool
+	fTokenSweep           time.Duration
+
+	fLogFormat string
+	fLogLevel  slog.Level
+
+	fReadHeaderTimeout time.Duration
+	fReadTimeout       time.Duration
+	fWriteTimeout      time.Duration
+	fIdleTimeout       time.Duration
+	fMaxHeaderBytes    int
+	fShutdownDelay     time.Duration
+	fShutdownTimeout   time.Duration
 )
 
 // rootHandler implements the simplest possible handler for root requests,
@@ -28,43 +102,473 @@ func rootHandler(resp http.ResponseWriter, req *http.Request) {
 }
 
 func init() {
+	flag.StringVar(&fBMCBackend, "bmc-backend", "gcd",
+		fmt.Sprintf("Where to store BMC credentials, one of %v.", bmc.Backends()))
+	flag.StringVar(&fBMCMapping, "bmc-mapping", "",
+		"Path to a JSON file configuring the BMC hostname, model and username of machines. If empty, all machines use the default mapping.")
+	flag.BoolVar(&fBMCVerify, "bmc-verify", false,
+		"Log into the Redfish service of a BMC with the supplied credentials before storing them.")
+	flag.BoolVar(&fBMCVerifyInsecure, "bmc-verify-insecure", false,
+		"Accept untrusted TLS certificates, such as the self-signed certificates of most BMCs, when verifying credentials.")
+	flag.DurationVar(&fBMCVerifyTimeout, "bmc-verify-timeout", 10*time.Second,
+		"How long to wait for a BMC when verifying credentials.")
+	flag.StringVar(&fBMCFile, "bmc-file", "",
+		"Path to the encrypted credentials file of the 'file' BMC backend.")
+	flag.StringVar(&fBMCFileKey, "bmc-file-key", "",
+		"Path to a file containing the base64 encoded 32 byte key of the 'file' BMC backend.")
+	flag.StringVar(&fVaultAddress, "vault-address", "",
+		"Address of the Vault server used by the 'vault' BMC backend.")
+	flag.StringVar(&fVaultTokenFile, "vault-token-file", "",
+		"Path to a file containing the Vault token. If empty, the VAULT_TOKEN environment variable is used.")
+	flag.StringVar(&fVaultMount, "vault-mount", "secret",
+		"Mount path of the Vault KV version 2 secrets engine.")
+	flag.StringVar(&fVaultPrefix, "vault-prefix", "reboot-api",
+		"Path prefix of the BMC credentials in Vault.")
+	flag.StringVar(&fAuthConfig, "auth-config", "",
+		"Path to a JSON file configuring the authenticators each extension requires. If empty, extension requests are not authenticated.")
+	flag.StringVar(&fRateLimits, "rate-limits", "",
+		"Path to a JSON file configuring the per-host and per-source-address rate limits of each extension. If empty, extension requests are not rate limited.")
+	flag.StringVar(&fReplay, "replay-protection", "",
+		"Refuse extension requests whose nonce was already redeemed: 'optional' accepts requests without a nonce, 'required' refuses them. If empty, replays are not checked.")
+	flag.DurationVar(&fReplayTTL, "replay-ttl", handler.DefaultReplayTTL,
+		"How long nonces are remembered for extensions whose max uptime is zero.")
+	flag.StringVar(&fIdentityCheck, "identity-check", "",
+		"Check the identity claimed by extension requests against DNS: 'forward' requires the hostname to resolve to the claimed addresses, 'reverse' additionally requires the addresses to resolve back to the hostname. If empty, identities are not checked.")
+	flag.DurationVar(&fTokenMaxUptime, "token-max-uptime", handler.DefaultMaxUptime,
+		"How long after a machine booted its token requests are accepted. Zero accepts requests however long ago the machine booted.")
+	flag.DurationVar(&fBMCMaxUptime, "bmc-max-uptime", handler.DefaultMaxUptime,
+		"How long after a machine booted its BMC requests are accepted. Zero accepts requests however long ago the machine booted.")
+	flag.DurationVar(&fNodeMaxUptime, "node-max-uptime", handler.DefaultMaxUptime,
+		"How long after a machine booted its node requests are accepted. Zero accepts requests however long ago the machine booted.")
+	flag.DurationVar(&fClockSkew, "clock-skew", handler.DefaultClockSkew,
+		"Tolerance for differences between the clocks of the ePoxy server and of this server when checking the last boot time of machines.")
+	flag.StringVar(&fOperators, "operator-tokens", "",
+		"Path to a JSON file mapping operator names to the bearer tokens of the operator API. If empty, the operator API rejects all requests.")
 	flag.StringVar(&fBinDir, "bin-dir", "/usr/bin",
 		"Absolute path to directory where required binaries are found.")
+	flag.DurationVar(&fCommandTimeout, "command-timeout", 2*time.Minute,
+		"How long a kubeadm or kubectl command may run before it is killed. Drains are limited by -node-drain-timeout instead. Zero means no limit.")
+	flag.DurationVar(&fDrainTimeout, "node-drain-timeout", 5*time.Minute,
+		"How long to wait for the pods of a node to be evicted before deleting it anyway. Zero deletes nodes without draining them.")
+	flag.StringVar(&fNodeBackend, "node-backend", "kubectl",
+		"How to manage nodes: 'kubectl' runs the kubectl binary, 'api' uses the Kubernetes API directly.")
+	flag.StringVar(&fNodeAllowlist, "node-allowlist", "",
+		"Path to a JSON file listing the labels and taints machines may set on their nodes. If empty, no changes are allowed.")
+	flag.StringVar(&fKubeconfig, "kubeconfig", "",
+		"Path to a kubeconfig file. If empty, the in-cluster configuration is used.")
+	flag.StringVar(&fClusters, "clusters", "",
+		"Path to a JSON file listing the clusters to serve and the projects and sites of their machines. If empty, a single cluster configured by -kubeconfig and -token-policy serves all machines.")
 	flag.StringVar(&fListenAddress, "listen-address", ":8800",
 		"Address on which to listen for requests.")
+	flag.StringVar(&fMetricsAddress, "metrics-address", "",
+		"Address on which to serve the health and metrics endpoints over plaintext HTTP. If empty, they are served on -listen-address.")
+	flag.StringVar(&fTLSCert, "tls-cert", "",
+		"Path to the PEM encoded TLS certificate of the server. If empty, requests are served over plaintext HTTP.")
+	flag.StringVar(&fTLSKey, "tls-key", "",
+		"Path to the PEM encoded private key of -tls-cert.")
+	flag.StringVar(&fTLSClientCA, "tls-client-ca", "",
+		"Path to PEM encoded CA certificates used to verify client certificates. If empty, client certificates are not requested.")
+	flag.BoolVar(&fTLSRequireClientCert, "tls-require-client-cert", false,
+		"Reject connections without a client certificate verified by -tls-client-ca.")
+	flag.DurationVar(&fTLSReloadInterval, "tls-reload-interval", time.Minute,
+		"How often to check the TLS files for changes and reload them.")
+	flag.StringVar(&fTokenBackend, "token-backend", "kubeadm",
+		"How to create bootstrap tokens: 'kubeadm' runs the kubeadm binary, 'api' uses the Kubernetes API directly.")
+	flag.StringVar(&fTokenPolicy, "token-policy", "",
+		"Path to a JSON file configuring the TTL, usages and groups of bootstrap tokens. If empty, all tokens use the default policy.")
+	flag.BoolVar(&fTokenReuse, "token-reuse", false,
+		"Hand out a host's existing bootstrap token while it is still valid, instead of revoking it and creating a new one.")
+	flag.DurationVar(&fTokenSweep, "token-sweep-interval", 10*time.Minute,
+		"How often to revoke expired and superseded bootstrap tokens. Zero disables the sweeper.")
+	flag.DurationVar(&fReadHeaderTimeout, "read-header-timeout", 10*time.Second,
+		"How long to wait for the headers of a request.")
+	flag.DurationVar(&fReadTimeout, "read-timeout", 30*time.Second,
+		"How long to wait for a whole request, including its body.")
+	flag.DurationVar(&fWriteTimeout, "write-timeout", 10*time.Minute,
+		"How long handling a request and writing its response may take. Must exceed -node-drain-timeout.")
+	flag.DurationVar(&fIdleTimeout, "idle-timeout", 2*time.Minute,
+		"How long to keep idle connections open.")
+	flag.IntVar(&fMaxHeaderBytes, "max-header-bytes", 64<<10,
+		"Maximum size of the headers of a request.")
+	flag.DurationVar(&fShutdownDelay, "shutdown-delay", 5*time.Second,
+		"How long to keep serving requests after SIGTERM, while readiness checks fail, before shutting down.")
+	flag.DurationVar(&fShutdownTimeout, "shutdown-timeout", 10*time.Minute,
+		"How long to wait for in-flight requests to finish when shutting down.")
+	flag.StringVar(&fLogFormat, "log-format", "text",
+		"Format of the logs: 'text' or 'json'.")
+	flag.TextVar(&fLogLevel, "log-level", slog.LevelInfo,
+		"Minimum level of the logs: 'debug', 'info', 'warn' or 'error'. Debug logs include the output of kubectl.")
+}
+
+// newKubernetesClient returns a Kubernetes client configured by the kubeconfig
+// file, or the in-cluster configuration if kubeconfig is empty.
+func newKubernetesClient(kubeconfig string) kubernetes.Interface {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	rtx.Must(err, "Failed to load Kubernetes client configuration")
+	client, err := kubernetes.NewForConfig(config)
+	rtx.Must(err, "Failed to create Kubernetes client")
+	return client
+}
+
+// newCommand returns an *exec.Command running the named program from the
+// -bin-dir directory.
+func newCommand(name string) *exec.Command {
+	return &exec.Command{
+		Path:    filepath.Join(fBinDir, name),
+		Timeout: fCommandTimeout,
+	}
+}
+
+// newTokenManager returns a token.Manager for the backend named by the
+// -token-backend flag, creating tokens in the cluster of the kubeconfig file
+// according to the token policies at policyPath.
+func newTokenManager(kubeconfig string, policyPath string) token.Manager {
+	policies, err := token.LoadPolicies(policyPath)
+	rtx.Must(err, "Failed to load token policies from %s", policyPath)
+
+	switch fTokenBackend {
+	case "kubeadm":
+		return &token.TokenManager{
+			Runner:     newCommand("kubeadm"),
+			Policies:   policies,
+			Reuse:      fTokenReuse,
+			Kubeconfig: kubeconfig,
+		}
+	case "api":
+		return token.NewAPIManager(newKubernetesClient(kubeconfig), policies, fTokenReuse)
+	default:
+		log.Fatalf("Unknown token backend: %s", fTokenBackend)
+	}
+	return nil
+}
+
+// newPasswordStore returns a bmc.PasswordStore for the backend named by the
+// -bmc-backend flag.
+func newPasswordStore() bmc.PasswordStore {
+	vaultToken := os.Getenv("VAULT_TOKEN")
+	if fVaultTokenFile != "" {
+		b, err := os.ReadFile(fVaultTokenFile)
+		rtx.Must(err, "Failed to read Vault token from %s", fVaultTokenFile)
+		vaultToken = strings.TrimSpace(string(b))
+	}
+	mappings, err := bmc.LoadMappings(fBMCMapping)
+	rtx.Must(err, "Failed to load BMC mappings from %s", fBMCMapping)
+
+	var verifier bmc.Verifier
+	if fBMCVerify {
+		verifier = bmc.NewRedfishVerifier(fBMCVerifyTimeout, fBMCVerifyInsecure)
+	}
+
+	store, err := bmc.NewStore(fBMCBackend, bmc.Config{
+		Verifier:     verifier,
+		FilePath:     fBMCFile,
+		FileKeyPath:  fBMCFileKey,
+		VaultAddress: fVaultAddress,
+		VaultToken:   vaultToken,
+		VaultMount:   fVaultMount,
+		VaultPrefix:  fVaultPrefix,
+	}, mappings)
+	rtx.Must(err, "Failed to create BMC password store")
+	return store
+}
+
+// newNodeManager returns a node.Manager for the backend named by the
+// -node-backend flag, managing the nodes of the cluster of the kubeconfig
+// file.
+func newNodeManager(kubeconfig string, allowlist *node.Allowlist) node.Manager {
+	switch fNodeBackend {
+	case "kubectl":
+		nodeManager := node.NewManager(newCommand("kubectl"), fDrainTimeout)
+		nodeManager.Allowlist = allowlist
+		nodeManager.Kubeconfig = kubeconfig
+		return nodeManager
+	case "api":
+		nodeManager := node.NewAPIManager(newKubernetesClient(kubeconfig), fDrainTimeout)
+		nodeManager.Allowlist = allowlist
+		return nodeManager
+	default:
+		log.Fatalf("Unknown node backend: %s", fNodeBackend)
+	}
+	return nil
+}
+
+// newRegistry returns the cluster registry configured by the -clusters flag.
+// Without it, a single cluster configured by the -kubeconfig and -token-policy
+// flags serves all machines.
+func newRegistry() *cluster.Registry {
+	allowlist, err := node.LoadAllowlist(fNodeAllowlist)
+	rtx.Must(err, "Failed to load node allowlist from %s", fNodeAllowlist)
+	configs, err := cluster.LoadConfigs(fClusters)
+	rtx.Must(err, "Failed to load clusters from %s", fClusters)
+
+	registry := cluster.NewRegistry()
+	if configs == nil {
+		registry.Default = &cluster.Cluster{
+			Name:   "default",
+			Tokens: newTokenManager(fKubeconfig, fTokenPolicy),
+			Nodes:  newNodeManager(fKubeconfig, allowlist),
+		}
+		return registry
+	}
+	for _, c := range configs.Clusters {
+		kubeconfig, policyPath := c.Kubeconfig, c.TokenPolicy
+		if kubeconfig == "" {
+			kubeconfig = fKubeconfig
+		}
+		if policyPath == "" {
+			policyPath = fTokenPolicy
+		}
+		err := registry.Add(&cluster.Cluster{
+			Name:   c.Name,
+			Tokens: newTokenManager(kubeconfig, policyPath),
+			Nodes:  newNodeManager(kubeconfig, allowlist),
+		}, c.Projects, c.Sites)
+		rtx.Must(err, "Failed to add cluster %s", c.Name)
+		slog.Info("serving cluster", "cluster", c.Name, "projects", c.Projects, "sites", c.Sites)
+	}
+	return registry
+}
+
+// newIdentityVerifier returns the *handler.IdentityVerifier selected by the
+// -identity-check flag, or nil if identities are not checked.
+func newIdentityVerifier() *handler.IdentityVerifier {
+	switch fIdentityCheck {
+	case "":
+		return nil
+	case "forward":
+		return &handler.IdentityVerifier{}
+	case "reverse":
+		return &handler.IdentityVerifier{Reverse: true}
+	default:
+		log.Fatalf("Unknown identity check: %s", fIdentityCheck)
+	}
+	return nil
+}
+
+// newReplayOption returns the option selected by the -replay-protection flag,
+// or nil if replays are not checked. All extensions share its store.
+func newReplayOption() handler.Option {
+	switch fReplay {
+	case "":
+		return nil
+	case "optional", "required":
+		return handler.WithReplayProtection(handler.NewMemorySeenStore(), fReplay == "required")
+	default:
+		log.Fatalf("Unknown replay protection: %s", fReplay)
+	}
+	return nil
+}
+
+// extensionOptions returns the options of the handlers of the named extension,
+// which accept requests for maxUptime after machines booted.
+func extensionOptions(extension string, maxUptime time.Duration, auth *handler.AuthConfig, identity *handler.IdentityVerifier, limits handler.RateLimits, replay handler.Option) []handler.Option {
+	opts := []handler.Option{
+		handler.WithMaxUptime(maxUptime),
+		handler.WithClockSkew(fClockSkew),
+		handler.WithAuthenticators(auth.Authenticators(extension)...),
+	}
+	opts = append(opts, limits.Options(extension)...)
+	if identity != nil {
+		opts = append(opts, handler.WithIdentityVerifier(identity))
+	}
+	if replay != nil {
+		opts = append(opts, replay, handler.WithReplayTTL(fReplayTTL))
+	}
+	return opts
+}
+
+// readiness is the handler of readiness checks, which fail once the server
+// shuts down, so that Kubernetes stops routing requests to it.
+type readiness struct {
+	shuttingDown atomic.Bool
+}
+
+func (r *readiness) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if r.shuttingDown.Load() {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(resp, "shutting down")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	fmt.Fprintf(resp, "ready")
+}
+
+// newServer returns an http.Server for handler on addr, with the timeouts and
+// header size limit set by flags.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: fReadHeaderTimeout,
+		ReadTimeout:       fReadTimeout,
+		WriteTimeout:      fWriteTimeout,
+		IdleTimeout:       fIdleTimeout,
+		MaxHeaderBytes:    fMaxHeaderBytes,
+	}
+}
+
+// shutdown fails readiness checks, waits -shutdown-delay for Kubernetes to stop
+// routing requests to the server, and then stops srv, waiting up to
+// -shutdown-timeout for in-flight requests, like node drains, to finish. The
+// metrics server, if any, is stopped last so that the shutdown can be
+// monitored.
+func shutdown(ready *readiness, srv *http.Server, metricsSrv *http.Server) {
+	ready.shuttingDown.Store(true)
+	slog.Info("shutting down", "delay", fShutdownDelay, "timeout", fShutdownTimeout)
+	time.Sleep(fShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), fShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("failed to wait for in-flight requests", "error", err)
+	}
+	if metricsSrv != nil {
+		metricsSrv.Shutdown(ctx)
+	}
+	slog.Info("shut down")
+}
+
+// instrument wraps the handler of an extension with its request duration and
+// in-flight metrics, and with request IDs and logging.
+func instrument(extension string, duration *prometheus.HistogramVec, h http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerInFlight(metrics.RequestsInFlight.WithLabelValues(extension),
+		promhttp.InstrumentHandlerDuration(duration, logging.Middleware(h)))
+}
+
+// buildVersion returns the version set at build time with
+// -ldflags "-X main.version=...", or the VCS revision recorded by the Go
+// toolchain.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return info.Main.Version
 }
 
 func main() {
 	flag.Parse()
 
-	log.SetFlags(log.LUTC | log.LstdFlags | log.Lshortfile)
+	logger, err := logging.New(os.Stderr, fLogFormat, fLogLevel)
+	rtx.Must(err, "Failed to create logger")
+	slog.SetDefault(logger)
+
+	// Shut down gracefully on SIGTERM, e.g. when Kubernetes stops the pod, or
+	// on an interrupt.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	metrics.BuildInfo.WithLabelValues(buildVersion(), runtime.Version()).Set(1)
+
+	registry := newRegistry()
+	for _, c := range registry.Clusters() {
+		if s, ok := c.Tokens.(token.Sweeper); ok && fTokenSweep > 0 {
+			go token.RunSweeper(ctx, s, fTokenSweep)
+		}
+	}
+	tokenManager := registry.Tokens()
+	bmcPasswordStore := newPasswordStore()
+	nodeManager := registry.Nodes()
+
+	auth, err := handler.LoadAuthConfig(fAuthConfig)
+	rtx.Must(err, "Failed to load auth config from %s", fAuthConfig)
+	if auth == nil {
+		slog.Warn("no -auth-config given, extension requests are not authenticated")
+	}
+	identity := newIdentityVerifier()
+	limits, err := handler.LoadRateLimits(fRateLimits)
+	rtx.Must(err, "Failed to load rate limits from %s", fRateLimits)
+	replay := newReplayOption()
+	tokenOpts := extensionOptions("token", fTokenMaxUptime, auth, identity, limits, replay)
+	bmcOpts := extensionOptions("bmc", fBMCMaxUptime, auth, identity, limits, replay)
+	nodeOpts := extensionOptions("node", fNodeMaxUptime, auth, identity, limits, replay)
+
+	if fDrainTimeout > 0 && fWriteTimeout > 0 && fWriteTimeout <= fDrainTimeout {
+		slog.Warn("-write-timeout does not exceed -node-drain-timeout, node deletions may time out",
+			"write_timeout", fWriteTimeout, "drain_timeout", fDrainTimeout)
+	}
 
-	tc := &token.TokenCommand{}
-	tokenManager := token.New(fBinDir, tc)
-	bmcPasswordStore := bmc.New()
-	nodeCommand := &node.Command{
-		Path: fBinDir + "/kubectl",
+	ready := &readiness{}
+	mux := http.NewServeMux()
+	// The health and metrics endpoints may be served on a separate plaintext
+	// listener, e.g. for Prometheus to keep scraping them when the extensions
+	// require TLS.
+	metricsMux := mux
+	if fMetricsAddress != "" {
+		metricsMux = http.NewServeMux()
 	}
-	nodeManager := node.NewManager(nodeCommand)
+	metricsMux.HandleFunc("/", rootHandler)
+	metricsMux.Handle("/ready", ready)
+	metricsMux.Handle("/metrics", promhttp.Handler())
 
-	http.HandleFunc("/", rootHandler)
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/v1/allocate_k8s_token",
-		promhttp.InstrumentHandlerDuration(metrics.TokenRequestDuration,
-			handler.NewTokenHandler("v1", tokenManager)))
+	mux.Handle("/v1/allocate_k8s_token",
+		instrument("token", metrics.TokenRequestDuration,
+			handler.NewTokenHandler("v1", tokenManager, tokenOpts...)))
 
-	http.HandleFunc("/v2/allocate_k8s_token",
-		promhttp.InstrumentHandlerDuration(metrics.TokenRequestDuration,
-			handler.NewTokenHandler("v2", tokenManager)))
+	mux.Handle("/v2/allocate_k8s_token",
+		instrument("token", metrics.TokenRequestDuration,
+			handler.NewTokenHandler("v2", tokenManager, tokenOpts...)))
 
-	http.HandleFunc("/v1/bmc_store_password",
-		promhttp.InstrumentHandlerDuration(metrics.BMCRequestDuration,
-			handler.NewBmcHandler(bmcPasswordStore)))
+	mux.Handle("/v3/allocate_k8s_token",
+		instrument("token", metrics.TokenRequestDuration,
+			handler.NewTokenHandler("v3", tokenManager, tokenOpts...)))
 
-	http.HandleFunc("/v1/node/delete",
-		promhttp.InstrumentHandlerDuration(metrics.NodeRequestDuration,
-			handler.NewNodeHandler(nodeManager, "delete")))
+	mux.Handle("/v1/bmc_store_password",
+		instrument("bmc", metrics.BMCRequestDuration,
+			handler.NewBmcHandler(bmcPasswordStore, bmcOpts...)))
 
-	log.Printf("Listening on interface: %s", fListenAddress)
-	log.Fatal(http.ListenAndServe(fListenAddress, nil))
+	operators, err := handler.LoadOperators(fOperators)
+	rtx.Must(err, "Failed to load operators from %s", fOperators)
+	for _, action := range []string{"list", "history", "rollback"} {
+		mux.Handle("/v1/operator/bmc/"+action,
+			instrument("operator", metrics.OperatorRequestDuration,
+				handler.NewOperatorHandler(bmcPasswordStore, operators, action)))
+	}
+
+	for _, action := range []string{"delete", "cordon", "uncordon", "label", "taint"} {
+		mux.Handle("/v1/node/"+action,
+			instrument("node", metrics.NodeRequestDuration,
+				handler.NewNodeHandler(nodeManager, action, nodeOpts...)))
+	}
+
+	var metricsSrv *http.Server
+	if fMetricsAddress != "" {
+		metricsSrv = newServer(fMetricsAddress, metricsMux)
+		go func() {
+			slog.Info("serving metrics", "address", fMetricsAddress)
+			if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	srv := newServer(fListenAddress, mux)
+	errs := make(chan error, 1)
+	if fTLSCert == "" {
+		slog.Info("listening", "address", fListenAddress)
+		go func() { errs <- srv.ListenAndServe() }()
+	} else {
+		reloader, err := tlsconfig.NewReloader(fTLSCert, fTLSKey, fTLSClientCA, fTLSRequireClientCert)
+		rtx.Must(err, "Failed to load TLS files")
+		go reloader.Run(ctx, fTLSReloadInterval)
+		srv.TLSConfig = reloader.Config()
+		slog.Info("listening with TLS", "address", fListenAddress)
+		go func() { errs <- srv.ListenAndServeTLS("", "") }()
+	}
+
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	// A second signal stops the server immediately.
+	stop()
+	shutdown(ready, srv, metricsSrv)
 }
@@ -0,0 +1,159 @@
+// Package tlsconfig provides the TLS configuration of the extension server,
+// whose certificate, key and client CAs are reloaded when their files change.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/metrics"
+)
+
+// Reloader holds a TLS certificate and key pair, and optionally a pool of CAs
+// to verify client certificates, loaded from files and reloaded when the files
+// change.
+type Reloader struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	// RequireClientCert rejects connections without a client certificate
+	// verified by the client CAs. Otherwise, client certificates are
+	// verified if given.
+	RequireClientCert bool
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  []time.Time
+}
+
+// NewReloader returns a Reloader for the given files, which have been loaded
+// once. clientCAFile may be empty to not verify client certificates.
+func NewReloader(certFile, keyFile, clientCAFile string, requireClientCert bool) (*Reloader, error) {
+	if clientCAFile == "" && requireClientCert {
+		return nil, fmt.Errorf("requiring client certificates needs a client CA file")
+	}
+	r := &Reloader{
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		ClientCAFile:      clientCAFile,
+		RequireClientCert: requireClientCert,
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files returns the files to load.
+func (r *Reloader) files() []string {
+	files := []string{r.CertFile, r.KeyFile}
+	if r.ClientCAFile != "" {
+		files = append(files, r.ClientCAFile)
+	}
+	return files
+}
+
+// Reload loads the files again if any of them changed since they were last
+// loaded, and returns whether they did. If loading fails, the previously
+// loaded files are kept.
+func (r *Reloader) Reload() (bool, error) {
+	var modTimes []time.Time
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+		modTimes = append(modTimes, fi.ModTime())
+	}
+	r.mu.RLock()
+	unchanged := reflect.DeepEqual(modTimes, r.modTimes)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	var pool *x509.CertPool
+	if r.ClientCAFile != "" {
+		b, err := os.ReadFile(r.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return false, fmt.Errorf("no certificates found in %s", r.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = modTimes
+	return true, nil
+}
+
+// Run reloads the files every interval until ctx is done.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		reloaded, err := r.Reload()
+		switch {
+		case err != nil:
+			slog.Error("failed to reload TLS files, keeping the previous ones", "error", err)
+			metrics.TLSReloads.WithLabelValues("error").Inc()
+		case reloaded:
+			slog.Info("reloaded TLS files", "files", r.files())
+			metrics.TLSReloads.WithLabelValues("success").Inc()
+		}
+	}
+}
+
+// Config returns a *tls.Config serving the current certificate and verifying
+// client certificates with the current client CAs, if any.
+func (r *Reloader) Config() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+	}
+	if r.ClientCAFile == "" {
+		return base
+	}
+	config := base.Clone()
+	// The client CAs are part of the configuration itself, so return a new
+	// configuration with the current CAs for each connection.
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		r.mu.RLock()
+		c.ClientCAs = r.clientCAs
+		r.mu.RUnlock()
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.RequireClientCert {
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return c, nil
+	}
+	return config
+}
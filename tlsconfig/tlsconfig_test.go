@@ -0,0 +1,315 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key, signed by a parent testCert or by
+// itself.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate(): %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate(): %v", err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key to cert.pem and key.pem in dir, with
+// the given modification time.
+func (c *testCert) write(t *testing.T, dir string, modTime time.Time) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey(): %v", err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), modTime)
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), modTime)
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func writeFile(t *testing.T, path string, content []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("failed to set modification time of %s: %v", path, err)
+	}
+}
+
+func Test_NewReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := newTestCert(t, "server", nil).write(t, dir, time.Now())
+	badFile := filepath.Join(dir, "bad.pem")
+	writeFile(t, badFile, []byte("not a certificate"), time.Now())
+
+	tests := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		caFile   string
+		require  bool
+		wantErr  bool
+	}{
+		{
+			name:     "success",
+			certFile: certFile,
+			keyFile:  keyFile,
+		},
+		{
+			name:     "success-client-ca",
+			certFile: certFile,
+			keyFile:  keyFile,
+			caFile:   certFile,
+			require:  true,
+		},
+		{
+			name:     "failure-missing-file",
+			certFile: filepath.Join(dir, "missing.pem"),
+			keyFile:  keyFile,
+			wantErr:  true,
+		},
+		{
+			name:     "failure-bad-key",
+			certFile: certFile,
+			keyFile:  badFile,
+			wantErr:  true,
+		},
+		{
+			name:     "failure-bad-client-ca",
+			certFile: certFile,
+			keyFile:  keyFile,
+			caFile:   badFile,
+			wantErr:  true,
+		},
+		{
+			name:     "failure-require-without-ca",
+			certFile: certFile,
+			keyFile:  keyFile,
+			require:  true,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReloader(tt.certFile, tt.keyFile, tt.caFile, tt.require)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewReloader(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_Reload(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Minute)
+	first := newTestCert(t, "first", nil)
+	certFile, keyFile := first.write(t, dir, start)
+	r, err := NewReloader(certFile, keyFile, "", false)
+	if err != nil {
+		t.Fatalf("NewReloader(): %v", err)
+	}
+	getCert := func() *x509.Certificate {
+		t.Helper()
+		c, err := r.Config().GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetCertificate(): %v", err)
+		}
+		cert, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatalf("ParseCertificate(): %v", err)
+		}
+		return cert
+	}
+
+	if reloaded, err := r.Reload(); reloaded || err != nil {
+		t.Errorf("Reload() of unchanged files = %v, %v; want false, nil", reloaded, err)
+	}
+
+	newTestCert(t, "second", nil).write(t, dir, start.Add(time.Second))
+	if reloaded, err := r.Reload(); !reloaded || err != nil {
+		t.Fatalf("Reload() of changed files = %v, %v; want true, nil", reloaded, err)
+	}
+	if name := getCert().Subject.CommonName; name != "second" {
+		t.Errorf("GetCertificate() = %q, want the reloaded certificate", name)
+	}
+
+	writeFile(t, keyFile, []byte("garbage"), start.Add(2*time.Second))
+	if reloaded, err := r.Reload(); reloaded || err == nil {
+		t.Errorf("Reload() of a bad key = %v, %v; want false and an error", reloaded, err)
+	}
+	if name := getCert().Subject.CommonName; name != "second" {
+		t.Errorf("GetCertificate() = %q, want the previous certificate", name)
+	}
+}
+
+func Test_Run(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Minute)
+	certFile, keyFile := newTestCert(t, "first", nil).write(t, dir, start)
+	r, err := NewReloader(certFile, keyFile, "", false)
+	if err != nil {
+		t.Fatalf("NewReloader(): %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	newTestCert(t, "second", nil).write(t, dir, start.Add(time.Second))
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c, _ := r.Config().GetCertificate(nil)
+		cert, _ := x509.ParseCertificate(c.Certificate[0])
+		if cert.Subject.CommonName == "second" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Run() did not reload the certificate")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func Test_Config(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), time.Now())
+	certFile, keyFile := newTestCert(t, "server", ca).write(t, dir, time.Now())
+	client := newTestCert(t, "epoxy.example.com", ca)
+	other := newTestCert(t, "epoxy.example.com", newTestCert(t, "other-ca", nil))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name       string
+		caFile     string
+		require    bool
+		clientCert *testCert
+		verified   string
+		wantErr    bool
+	}{
+		{
+			name: "success-tls",
+		},
+		{
+			name:       "success-mtls",
+			caFile:     caFile,
+			require:    true,
+			clientCert: client,
+			verified:   "epoxy.example.com",
+		},
+		{
+			name:   "success-optional-client-cert",
+			caFile: caFile,
+		},
+		{
+			name:    "failure-missing-client-cert",
+			caFile:  caFile,
+			require: true,
+			wantErr: true,
+		},
+		{
+			name:       "failure-untrusted-client-cert",
+			caFile:     caFile,
+			require:    true,
+			clientCert: other,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReloader(certFile, keyFile, tt.caFile, tt.require)
+			if err != nil {
+				t.Fatalf("NewReloader(): %v", err)
+			}
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if len(req.TLS.VerifiedChains) > 0 {
+					w.Write([]byte(req.TLS.VerifiedChains[0][0].Subject.CommonName))
+				}
+			}))
+			srv.Listener = tls.NewListener(srv.Listener, r.Config())
+			srv.Start()
+			defer srv.Close()
+
+			clientConfig := &tls.Config{RootCAs: roots, ServerName: "server"}
+			if tt.clientCert != nil {
+				clientConfig.Certificates = []tls.Certificate{tt.clientCert.tlsCertificate()}
+			}
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			resp, err := c.Get("https://" + srv.Listener.Addr().String())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			body := make([]byte, 100)
+			n, _ := resp.Body.Read(body)
+			if got := string(body[:n]); got != tt.verified {
+				t.Errorf("verified client certificate = %q, want %q", got, tt.verified)
+			}
+		})
+	}
+}
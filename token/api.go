@@ -0,0 +1,261 @@
+package token
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/metrics"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	bootstrapapi "k8s.io/cluster-bootstrap/token/api"
+	bootstraputil "k8s.io/cluster-bootstrap/token/util"
+)
+
+// defaultGroup is the extra group assigned to bootstrap tokens by default,
+// matching the default used by `kubeadm token create`.
+const defaultGroup = "system:bootstrappers:kubeadm:default-node-token"
+
+// APIManager implements the Manager and Sweeper interfaces by managing
+// bootstrap token Secrets directly through the Kubernetes API, instead of
+// running kubeadm.
+type APIManager struct {
+	Client   kubernetes.Interface
+	Policies *Policies
+	// Reuse enables handing out a host's existing, still valid token instead
+	// of creating a new one.
+	Reuse bool
+}
+
+// Create returns a token for the requesting host, either by reusing a still
+// valid one, if enabled, or by creating a new bootstrap token Secret.
+// Control-plane joins are not supported, since uploading the control-plane
+// certificates requires access to the certificate files of a control-plane
+// machine. Hosts that may not join the control plane are still refused with
+// ErrControlPlaneNotAllowed, as with TokenManager.
+func (a *APIManager) Create(ctx context.Context, req Request) (Details, error) {
+	if req.ControlPlane {
+		if !a.Policies.ControlPlaneAllowed(req.Hostname) {
+			return Details{}, ErrControlPlaneNotAllowed
+		}
+		return Details{}, ErrControlPlaneUnsupported
+	}
+	policy := a.Policies.Select(req.Hostname, req.RawQuery)
+	desc := description(req.Hostname)
+
+	apiAddress, caHash, err := a.clusterInfo(ctx)
+	if err != nil {
+		return Details{}, err
+	}
+
+	if b := prepare(ctx, a, req.Hostname, policy, a.Reuse); b != nil {
+		return Details{
+			APIAddress:  apiAddress,
+			Token:       b.Token,
+			CAHash:      caHash,
+			Policy:      policy,
+			Expires:     b.Expires,
+			Description: desc,
+		}, nil
+	}
+
+	tok, err := bootstraputil.GenerateBootstrapToken()
+	if err != nil {
+		return Details{}, fmt.Errorf("could not generate bootstrap token: %v", err)
+	}
+	// GenerateBootstrapToken always returns a token matching
+	// BootstrapTokenPattern, i.e. "<id>.<secret>".
+	id, secret, _ := strings.Cut(tok, ".")
+
+	expires := time.Now().Add(policy.TTL.Duration)
+	data := map[string]string{
+		bootstrapapi.BootstrapTokenIDKey:          id,
+		bootstrapapi.BootstrapTokenSecretKey:      secret,
+		bootstrapapi.BootstrapTokenDescriptionKey: desc,
+		bootstrapapi.BootstrapTokenExpirationKey:  expires.UTC().Format(time.RFC3339),
+	}
+	for _, u := range policy.Usages {
+		data[bootstrapapi.BootstrapTokenUsagePrefix+u] = "true"
+	}
+	if len(policy.Groups) > 0 {
+		data[bootstrapapi.BootstrapTokenExtraGroupsKey] = strings.Join(policy.Groups, ",")
+	}
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      bootstraputil.BootstrapTokenSecretName(id),
+			Namespace: metav1.NamespaceSystem,
+		},
+		Type:       bootstrapapi.SecretTypeBootstrapToken,
+		StringData: data,
+	}
+	_, err = a.Client.CoreV1().Secrets(metav1.NamespaceSystem).Create(ctx, s, metav1.CreateOptions{})
+	if err != nil {
+		return Details{}, fmt.Errorf("could not create bootstrap token secret: %v", err)
+	}
+	metrics.TokensCreated.Inc()
+
+	return Details{
+		APIAddress:  apiAddress,
+		Token:       tok,
+		CAHash:      caHash,
+		Policy:      policy,
+		Expires:     expires,
+		Description: desc,
+	}, nil
+}
+
+// list returns all bootstrap tokens stored as Secrets in kube-system.
+func (a *APIManager) list(ctx context.Context) ([]BootstrapToken, error) {
+	secrets, err := a.Client.CoreV1().Secrets(metav1.NamespaceSystem).List(
+		ctx, metav1.ListOptions{
+			FieldSelector: "type=" + string(bootstrapapi.SecretTypeBootstrapToken),
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []BootstrapToken
+	for i := range secrets.Items {
+		s := &secrets.Items[i]
+		// Secrets created by Create() but not yet round-tripped through the
+		// API server only have StringData set.
+		value := func(key string) string {
+			if v, ok := s.Data[key]; ok {
+				return string(v)
+			}
+			return s.StringData[key]
+		}
+		id := value(bootstrapapi.BootstrapTokenIDKey)
+		if s.Type != bootstrapapi.SecretTypeBootstrapToken || id == "" || s.Name != bootstraputil.BootstrapTokenSecretName(id) {
+			continue
+		}
+		b := BootstrapToken{
+			ID:          id,
+			Token:       bootstraputil.TokenFromIDAndSecret(id, value(bootstrapapi.BootstrapTokenSecretKey)),
+			Description: value(bootstrapapi.BootstrapTokenDescriptionKey),
+		}
+		if exp := value(bootstrapapi.BootstrapTokenExpirationKey); exp != "" {
+			b.Expires, err = time.Parse(time.RFC3339, exp)
+			if err != nil {
+				// Treat tokens with a bad expiration as expired, like the
+				// API server's bootstrap authenticator does.
+				b.Expires = time.Unix(0, 0)
+			}
+		}
+		for _, u := range bootstrapapi.KnownTokenUsages {
+			if value(bootstrapapi.BootstrapTokenUsagePrefix+u) == "true" {
+				b.Usages = append(b.Usages, u)
+			}
+		}
+		if g := value(bootstrapapi.BootstrapTokenExtraGroupsKey); g != "" {
+			b.Groups = strings.Split(g, ",")
+		}
+		tokens = append(tokens, b)
+	}
+	return tokens, nil
+}
+
+// delete deletes the bootstrap token Secrets with the given token IDs.
+func (a *APIManager) delete(ctx context.Context, ids ...string) error {
+	for _, id := range ids {
+		err := a.Client.CoreV1().Secrets(metav1.NamespaceSystem).Delete(
+			ctx, bootstraputil.BootstrapTokenSecretName(id), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sweep revokes expired and superseded tokens created by this package.
+func (a *APIManager) Sweep(ctx context.Context) error {
+	return sweep(ctx, a)
+}
+
+// clusterInfo reads the cluster-info ConfigMap from the kube-public namespace
+// and returns the API server address and CA certificate hash it describes, in
+// the same format as printed by `kubeadm token create --print-join-command`.
+func (a *APIManager) clusterInfo(ctx context.Context) (string, string, error) {
+	cm, err := a.Client.CoreV1().ConfigMaps(metav1.NamespacePublic).Get(
+		ctx, bootstrapapi.ConfigMapClusterInfo, metav1.GetOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("could not get cluster-info ConfigMap: %v", err)
+	}
+
+	config, err := clientcmd.Load([]byte(cm.Data[bootstrapapi.KubeConfigKey]))
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse cluster-info kubeconfig: %v", err)
+	}
+	cluster, err := clusterFromConfig(config)
+	if err != nil {
+		return "", "", err
+	}
+
+	u, err := url.Parse(cluster.Server)
+	if err != nil || u.Host == "" {
+		return "", "", fmt.Errorf("bad API server address in cluster-info: %q", cluster.Server)
+	}
+
+	caHash, err := caCertHash(cluster.CertificateAuthorityData)
+	if err != nil {
+		return "", "", err
+	}
+
+	return u.Host, caHash, nil
+}
+
+// clusterFromConfig returns the cluster used by the current context of config,
+// or the only cluster when there is no current context, as is the case for the
+// kubeconfig kubeadm stores in cluster-info.
+func clusterFromConfig(config *clientcmdapi.Config) (*clientcmdapi.Cluster, error) {
+	if ctx, ok := config.Contexts[config.CurrentContext]; ok {
+		if cluster, ok := config.Clusters[ctx.Cluster]; ok {
+			return cluster, nil
+		}
+	}
+	if len(config.Clusters) != 1 {
+		return nil, fmt.Errorf("expected 1 cluster in cluster-info, found %d", len(config.Clusters))
+	}
+	for _, cluster := range config.Clusters {
+		return cluster, nil
+	}
+	return nil, nil
+}
+
+// caCertHash returns the SHA-256 hash of the Subject Public Key Info of the
+// first certificate in the PEM encoded caData, formatted as expected by the
+// kubeadm --discovery-token-ca-cert-hash flag.
+func caCertHash(caData []byte) (string, error) {
+	block, _ := pem.Decode(caData)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("no CA certificate found in cluster-info")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("could not parse CA certificate: %v", err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// NewAPIManager returns an APIManager using the given Kubernetes client. Tokens
+// are created according to policies, which may be nil to use DefaultPolicy for
+// all tokens. If reuse is true, a host's existing token is handed out again
+// while it is still valid.
+func NewAPIManager(client kubernetes.Interface, policies *Policies, reuse bool) Manager {
+	return &APIManager{
+		Client:   client,
+		Policies: policies,
+		Reuse:    reuse,
+	}
+}
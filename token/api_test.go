@@ -0,0 +1,266 @@
+package token
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	bootstrapapi "k8s.io/cluster-bootstrap/token/api"
+)
+
+// testCA returns a PEM encoded self-signed CA certificate and the expected
+// kubeadm CA hash for it.
+func testCA(t *testing.T) ([]byte, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kubernetes"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"sha256:" + hex.EncodeToString(sum[:])
+}
+
+// clusterInfoConfigMap returns a cluster-info ConfigMap like the one created by
+// kubeadm, which contains a kubeconfig with a single unnamed cluster.
+func clusterInfoConfigMap(t *testing.T, server string, caData []byte) *corev1.ConfigMap {
+	config := clientcmdapi.NewConfig()
+	config.Clusters[""] = &clientcmdapi.Cluster{
+		Server:                   server,
+		CertificateAuthorityData: caData,
+	}
+	kubeconfig, err := clientcmd.Write(*config)
+	if err != nil {
+		t.Fatalf("failed to write kubeconfig: %v", err)
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      bootstrapapi.ConfigMapClusterInfo,
+			Namespace: metav1.NamespacePublic,
+		},
+		Data: map[string]string{
+			bootstrapapi.KubeConfigKey: string(kubeconfig),
+		},
+	}
+}
+
+func Test_APIManagerCreate(t *testing.T) {
+	caData, caHash := testCA(t)
+
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		wantErr bool
+	}{
+		{
+			name: "success",
+			objects: []runtime.Object{
+				clusterInfoConfigMap(t, "https://"+testAPIAddress, caData),
+			},
+		},
+		{
+			name:    "failure-missing-cluster-info",
+			wantErr: true,
+		},
+		{
+			name: "failure-bad-ca-data",
+			objects: []runtime.Object{
+				clusterInfoConfigMap(t, "https://"+testAPIAddress, []byte("lol")),
+			},
+			wantErr: true,
+		},
+		{
+			name: "failure-bad-server",
+			objects: []runtime.Object{
+				clusterInfoConfigMap(t, "", caData),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tt.objects...)
+			m := NewAPIManager(client, nil, false)
+
+			d, err := m.Create(context.Background(), Request{Hostname: "test-host"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Create(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if d.APIAddress != testAPIAddress {
+				t.Errorf("Create(): APIAddress = %q, want %q", d.APIAddress, testAPIAddress)
+			}
+			if d.CAHash != caHash {
+				t.Errorf("Create(): CAHash = %q, want %q", d.CAHash, caHash)
+			}
+			if d.Description != "Allow test-host to join the cluster" {
+				t.Errorf("Create(): unexpected Description %q", d.Description)
+			}
+
+			id, secret, _ := strings.Cut(d.Token, ".")
+			s, err := client.CoreV1().Secrets(metav1.NamespaceSystem).Get(
+				context.Background(), "bootstrap-token-"+id, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Create(): secret not found: %v", err)
+			}
+			if s.Type != bootstrapapi.SecretTypeBootstrapToken {
+				t.Errorf("Create(): secret type = %q, want %q", s.Type, bootstrapapi.SecretTypeBootstrapToken)
+			}
+			if s.StringData[bootstrapapi.BootstrapTokenSecretKey] != secret {
+				t.Errorf("Create(): secret does not match token %q", d.Token)
+			}
+			if s.StringData[bootstrapapi.BootstrapTokenDescriptionKey] != d.Description {
+				t.Errorf("Create(): secret description = %q, want %q",
+					s.StringData[bootstrapapi.BootstrapTokenDescriptionKey], d.Description)
+			}
+			for _, key := range []string{
+				bootstrapapi.BootstrapTokenUsageAuthentication,
+				bootstrapapi.BootstrapTokenUsageSigningKey,
+			} {
+				if s.StringData[key] != "true" {
+					t.Errorf("Create(): secret %s = %q, want \"true\"", key, s.StringData[key])
+				}
+			}
+			if s.StringData[bootstrapapi.BootstrapTokenExtraGroupsKey] != defaultGroup {
+				t.Errorf("Create(): secret groups = %q, want %q",
+					s.StringData[bootstrapapi.BootstrapTokenExtraGroupsKey], defaultGroup)
+			}
+		})
+	}
+}
+
+func Test_NewAPIManager(t *testing.T) {
+	m := NewAPIManager(fake.NewSimpleClientset(), nil, false)
+	var i interface{} = m
+	_, ok := i.(Manager)
+	if !ok {
+		t.Errorf("NewAPIManager(): expected type Manager, but got %T", m)
+	}
+}
+
+func Test_APIManagerRevokeAndSweep(t *testing.T) {
+	caData, _ := testCA(t)
+	client := fake.NewSimpleClientset(clusterInfoConfigMap(t, "https://"+testAPIAddress, caData))
+	host := "mlab1-foo01.mlab-sandbox.measurement-lab.org"
+
+	tests := []struct {
+		name  string
+		reuse bool
+		same  bool
+	}{
+		{name: "revoke", reuse: false, same: false},
+		{name: "reuse", reuse: true, same: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewAPIManager(client, nil, tt.reuse).(*APIManager)
+			first, err := m.Create(context.Background(), Request{Hostname: host})
+			if err != nil {
+				t.Fatalf("Create(): unexpected error: %v", err)
+			}
+			second, err := m.Create(context.Background(), Request{Hostname: host})
+			if err != nil {
+				t.Fatalf("Create(): unexpected error: %v", err)
+			}
+			if (first.Token == second.Token) != tt.same {
+				t.Errorf("Create(): first token %q, second token %q, want same %v",
+					first.Token, second.Token, tt.same)
+			}
+			tokens, err := m.list(context.Background())
+			if err != nil {
+				t.Fatalf("list(): unexpected error: %v", err)
+			}
+			if len(tokens) != 1 || tokens[0].Token != second.Token {
+				t.Errorf("list() = %+v, want only %q", tokens, second.Token)
+			}
+			if !sameStrings(tokens[0].Usages, DefaultPolicy.Usages) ||
+				!sameStrings(tokens[0].Groups, DefaultPolicy.Groups) {
+				t.Errorf("list() = %+v, want default usages and groups", tokens[0])
+			}
+		})
+	}
+
+	// Add an expired token, which the sweeper must remove.
+	expired := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bootstrap-token-abcdef",
+			Namespace: metav1.NamespaceSystem,
+		},
+		Type: bootstrapapi.SecretTypeBootstrapToken,
+		Data: map[string][]byte{
+			bootstrapapi.BootstrapTokenIDKey:          []byte("abcdef"),
+			bootstrapapi.BootstrapTokenSecretKey:      []byte("0123456789abcdef"),
+			bootstrapapi.BootstrapTokenDescriptionKey: []byte(description("other-host")),
+			bootstrapapi.BootstrapTokenExpirationKey:  []byte(time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)),
+		},
+	}
+	_, err := client.CoreV1().Secrets(metav1.NamespaceSystem).Create(
+		context.Background(), expired, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create secret: %v", err)
+	}
+	m := NewAPIManager(client, nil, false).(*APIManager)
+	if err := m.Sweep(context.Background()); err != nil {
+		t.Fatalf("Sweep(): unexpected error: %v", err)
+	}
+	tokens, err := m.list(context.Background())
+	if err != nil {
+		t.Fatalf("list(): unexpected error: %v", err)
+	}
+	for _, b := range tokens {
+		if b.ID == "abcdef" {
+			t.Errorf("Sweep(): expired token was not revoked")
+		}
+	}
+	if len(tokens) != 1 {
+		t.Errorf("Sweep(): got %d tokens, want 1", len(tokens))
+	}
+}
+
+func Test_APIManagerControlPlane(t *testing.T) {
+	policies := &Policies{ControlPlaneHosts: []string{"test-host"}}
+	m := NewAPIManager(fake.NewSimpleClientset(), policies, false)
+	_, err := m.Create(context.Background(), Request{Hostname: "test-host", ControlPlane: true})
+	if !errors.Is(err, ErrControlPlaneUnsupported) {
+		t.Errorf("Create(): error = %v, want %v", err, ErrControlPlaneUnsupported)
+	}
+	_, err = m.Create(context.Background(), Request{Hostname: "other-host", ControlPlane: true})
+	if !errors.Is(err, ErrControlPlaneNotAllowed) {
+		t.Errorf("Create(): error = %v, want %v", err, ErrControlPlaneNotAllowed)
+	}
+}
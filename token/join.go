@@ -0,0 +1,132 @@
+package token
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/m-lab/go/host"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	joinAPIVersion = "kubeadm.k8s.io/v1beta3"
+	joinKind       = "JoinConfiguration"
+)
+
+// JoinConfiguration is the subset of the kubeadm JoinConfiguration
+// (kubeadm.k8s.io/v1beta3) returned in v3 allocate_k8s_token responses. It can
+// be passed to `kubeadm join --config` as is.
+type JoinConfiguration struct {
+	APIVersion       string            `json:"apiVersion"`
+	Kind             string            `json:"kind"`
+	Discovery        Discovery         `json:"discovery"`
+	NodeRegistration NodeRegistration  `json:"nodeRegistration"`
+	ControlPlane     *JoinControlPlane `json:"controlPlane,omitempty"`
+}
+
+// JoinControlPlane holds the settings of a node joining the control plane.
+type JoinControlPlane struct {
+	CertificateKey string `json:"certificateKey"`
+}
+
+// Discovery specifies how the joining node discovers the cluster.
+type Discovery struct {
+	BootstrapToken BootstrapTokenDiscovery `json:"bootstrapToken"`
+}
+
+// BootstrapTokenDiscovery configures token based discovery of the cluster.
+type BootstrapTokenDiscovery struct {
+	Token             string   `json:"token"`
+	APIServerEndpoint string   `json:"apiServerEndpoint"`
+	CACertHashes      []string `json:"caCertHashes"`
+}
+
+// NodeRegistration holds the settings used to register the joining node.
+type NodeRegistration struct {
+	Name             string            `json:"name"`
+	KubeletExtraArgs map[string]string `json:"kubeletExtraArgs,omitempty"`
+	Taints           []corev1.Taint    `json:"taints"`
+}
+
+// NodeLabels returns the labels for the node of an M-Lab machine, derived from
+// its hostname.
+func NodeLabels(hostname string) (map[string]string, error) {
+	parts, err := host.Parse(hostname)
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{
+		"mlab/machine": parts.Machine,
+		"mlab/site":    parts.Site,
+		"mlab/metro":   parts.Site[:3],
+	}
+	if parts.Project != "" {
+		labels["mlab/project"] = parts.Project
+	}
+	return labels, nil
+}
+
+// JoinConfiguration returns a kubeadm JoinConfiguration that joins hostname to
+// the cluster using the token. The node is labeled with the labels derived from
+// the hostname and those of the token's policy, and has the taints of the
+// token's policy. If the token has a certificate key, the node joins the
+// control plane.
+func (d Details) JoinConfiguration(hostname string) (*JoinConfiguration, error) {
+	labels, err := NodeLabels(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	extraArgs := map[string]string{}
+	taints := []corev1.Taint{}
+	if d.Policy != nil {
+		for k, v := range d.Policy.Labels {
+			labels[k] = v
+		}
+		for k, v := range d.Policy.KubeletExtraArgs {
+			extraArgs[k] = v
+		}
+		taints = append(taints, d.Policy.Taints...)
+	}
+	extraArgs["node-labels"] = formatLabels(labels)
+
+	var controlPlane *JoinControlPlane
+	if d.CertificateKey != "" {
+		controlPlane = &JoinControlPlane{
+			CertificateKey: d.CertificateKey,
+		}
+	}
+
+	return &JoinConfiguration{
+		APIVersion: joinAPIVersion,
+		Kind:       joinKind,
+		Discovery: Discovery{
+			BootstrapToken: BootstrapTokenDiscovery{
+				Token:             d.Token,
+				APIServerEndpoint: d.APIAddress,
+				CACertHashes:      []string{d.CAHash},
+			},
+		},
+		NodeRegistration: NodeRegistration{
+			Name:             hostname,
+			KubeletExtraArgs: extraArgs,
+			Taints:           taints,
+		},
+		ControlPlane: controlPlane,
+	}, nil
+}
+
+// formatLabels formats labels as expected by the kubelet --node-labels flag,
+// sorted by key so that the output is stable.
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,145 @@
+package token
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_NodeLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		expect   map[string]string
+		wantErr  bool
+	}{
+		{
+			name:     "success-v2",
+			hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+			expect: map[string]string{
+				"mlab/machine": "mlab1",
+				"mlab/site":    "foo01",
+				"mlab/metro":   "foo",
+				"mlab/project": "mlab-sandbox",
+			},
+		},
+		{
+			name:     "success-v1",
+			hostname: "mlab1.foo01.measurement-lab.org",
+			expect: map[string]string{
+				"mlab/machine": "mlab1",
+				"mlab/site":    "foo01",
+				"mlab/metro":   "foo",
+			},
+		},
+		{
+			name:     "failure-bad-hostname",
+			hostname: "lol-foo01.mlab-sandbox.measurement-lab.org",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels, err := NodeLabels(tt.hostname)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NodeLabels(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(labels, tt.expect) {
+				t.Errorf("NodeLabels() = %v, want %v", labels, tt.expect)
+			}
+		})
+	}
+}
+
+func Test_JoinConfiguration(t *testing.T) {
+	hostname := "mlab1-foo01.mlab-sandbox.measurement-lab.org-abcd"
+	taint := corev1.Taint{Key: "mlab/type", Value: "virtual", Effect: corev1.TaintEffectNoSchedule}
+	tests := []struct {
+		name   string
+		policy *Policy
+		expect *JoinConfiguration
+	}{
+		{
+			name:   "default-policy",
+			policy: DefaultPolicy,
+			expect: &JoinConfiguration{
+				APIVersion: "kubeadm.k8s.io/v1beta3",
+				Kind:       "JoinConfiguration",
+				Discovery: Discovery{
+					BootstrapToken: BootstrapTokenDiscovery{
+						Token:             testToken,
+						APIServerEndpoint: testAPIAddress,
+						CACertHashes:      []string{testCAHash},
+					},
+				},
+				NodeRegistration: NodeRegistration{
+					Name: hostname,
+					KubeletExtraArgs: map[string]string{
+						"node-labels": "mlab/machine=mlab1,mlab/metro=foo,mlab/project=mlab-sandbox,mlab/site=foo01",
+					},
+					Taints: []corev1.Taint{},
+				},
+			},
+		},
+		{
+			name: "policy-labels-and-taints",
+			policy: &Policy{
+				Name:             "virtual",
+				Labels:           map[string]string{"mlab/type": "virtual", "mlab/site": "override"},
+				Taints:           []corev1.Taint{taint},
+				KubeletExtraArgs: map[string]string{"max-pods": "50"},
+			},
+			expect: &JoinConfiguration{
+				APIVersion: "kubeadm.k8s.io/v1beta3",
+				Kind:       "JoinConfiguration",
+				Discovery: Discovery{
+					BootstrapToken: BootstrapTokenDiscovery{
+						Token:             testToken,
+						APIServerEndpoint: testAPIAddress,
+						CACertHashes:      []string{testCAHash},
+					},
+				},
+				NodeRegistration: NodeRegistration{
+					Name: hostname,
+					KubeletExtraArgs: map[string]string{
+						"max-pods":    "50",
+						"node-labels": "mlab/machine=mlab1,mlab/metro=foo,mlab/project=mlab-sandbox,mlab/site=override,mlab/type=virtual",
+					},
+					Taints: []corev1.Taint{taint},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Details{
+				APIAddress: testAPIAddress,
+				Token:      testToken,
+				CAHash:     testCAHash,
+				Policy:     tt.policy,
+			}
+			config, err := d.JoinConfiguration(hostname)
+			if err != nil {
+				t.Fatalf("JoinConfiguration(): unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(config, tt.expect) {
+				t.Errorf("JoinConfiguration() = %+v, want %+v", config, tt.expect)
+			}
+		})
+	}
+
+	d := Details{Token: testToken, CertificateKey: "abc123"}
+	config, err := d.JoinConfiguration(hostname)
+	if err != nil {
+		t.Fatalf("JoinConfiguration(): unexpected error: %v", err)
+	}
+	if config.ControlPlane == nil || config.ControlPlane.CertificateKey != "abc123" {
+		t.Errorf("JoinConfiguration(): ControlPlane = %+v, want certificate key", config.ControlPlane)
+	}
+
+	_, err = Details{}.JoinConfiguration("lol")
+	if err == nil {
+		t.Errorf("JoinConfiguration(): expected error for bad hostname")
+	}
+}
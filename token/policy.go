@@ -0,0 +1,210 @@
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/internal/machine"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	bootstraputil "k8s.io/cluster-bootstrap/token/util"
+)
+
+// DefaultPolicy is used for requests that match no configured rule. It has the
+// same properties as a token created by `kubeadm token create --ttl 5m`.
+var DefaultPolicy = &Policy{
+	Name:   "default",
+	TTL:    Duration{5 * time.Minute},
+	Usages: []string{"signing", "authentication"},
+	Groups: []string{defaultGroup},
+}
+
+// Duration is a time.Duration that is represented in JSON as a string such as
+// "5m" or "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Policy describes the properties of the tokens created for a class of
+// requests, and of the nodes joining the cluster with those tokens.
+type Policy struct {
+	Name   string   `json:"name"`
+	TTL    Duration `json:"ttl"`
+	Usages []string `json:"usages"`
+	Groups []string `json:"groups"`
+
+	// Labels, Taints and KubeletExtraArgs are only used in the kubeadm
+	// JoinConfiguration of v3 responses.
+	Labels           map[string]string `json:"labels,omitempty"`
+	Taints           []corev1.Taint    `json:"taints,omitempty"`
+	KubeletExtraArgs map[string]string `json:"kubelet_extra_args,omitempty"`
+}
+
+// validate checks that the policy describes a valid bootstrap token and node.
+func (p *Policy) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("policy has no name")
+	}
+	if p.TTL.Duration <= 0 {
+		return fmt.Errorf("policy %q: ttl must be positive", p.Name)
+	}
+	// ValidateUsages accepts an empty list, but a token without usages can
+	// neither authenticate nor sign.
+	if len(p.Usages) == 0 {
+		return fmt.Errorf("policy %q: usages must not be empty", p.Name)
+	}
+	if err := bootstraputil.ValidateUsages(p.Usages); err != nil {
+		return fmt.Errorf("policy %q: %v", p.Name, err)
+	}
+	for _, g := range p.Groups {
+		if err := bootstraputil.ValidateBootstrapGroupName(g); err != nil {
+			return fmt.Errorf("policy %q: %v", p.Name, err)
+		}
+	}
+	for k, v := range p.Labels {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return fmt.Errorf("policy %q: bad label key %q: %s", p.Name, k, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+			return fmt.Errorf("policy %q: bad label value %q: %s", p.Name, v, strings.Join(errs, "; "))
+		}
+	}
+	for _, t := range p.Taints {
+		if errs := validation.IsQualifiedName(t.Key); len(errs) > 0 {
+			return fmt.Errorf("policy %q: bad taint key %q: %s", p.Name, t.Key, strings.Join(errs, "; "))
+		}
+		switch t.Effect {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return fmt.Errorf("policy %q: bad taint effect %q", p.Name, t.Effect)
+		}
+	}
+	if _, ok := p.KubeletExtraArgs["node-labels"]; ok {
+		return fmt.Errorf("policy %q: node-labels must be set with labels, not kubelet_extra_args", p.Name)
+	}
+	return nil
+}
+
+// Rule selects a Policy for requests matching all of its non-empty criteria.
+type Rule struct {
+	// Matcher matches requests by the site and hostname of the requesting
+	// machine.
+	machine.Matcher
+	// Query matches requests whose ePoxy RawQuery contains all of the given
+	// parameters with the given values.
+	Query  map[string]string `json:"query,omitempty"`
+	Policy *Policy           `json:"policy"`
+}
+
+// matches returns whether the rule applies to a request for hostname with the
+// given RawQuery.
+func (r *Rule) matches(hostname string, rawQuery string) bool {
+	if !r.Matcher.Matches(hostname) {
+		return false
+	}
+	if len(r.Query) > 0 {
+		values, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return false
+		}
+		for k, v := range r.Query {
+			if values.Get(k) != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Policies is the token policy configuration. Rules are evaluated in order, and
+// the first matching rule determines the Policy for a request. Policies must
+// not be modified once in use.
+type Policies struct {
+	Default *Policy `json:"default,omitempty"`
+	Rules   []*Rule `json:"rules,omitempty"`
+	// ControlPlaneHosts lists the hostnames of the machines allowed to join
+	// the control plane.
+	ControlPlaneHosts []string `json:"control_plane_hosts,omitempty"`
+}
+
+// ControlPlaneAllowed returns whether hostname may join the control plane. It
+// is safe to call ControlPlaneAllowed on a nil *Policies, which allows no
+// hosts.
+func (p *Policies) ControlPlaneAllowed(hostname string) bool {
+	return p != nil && slices.Contains(p.ControlPlaneHosts, hostname)
+}
+
+// Select returns the Policy for a request for hostname with the given RawQuery.
+// It is safe to call Select on a nil *Policies, which always returns
+// DefaultPolicy.
+func (p *Policies) Select(hostname string, rawQuery string) *Policy {
+	if p == nil {
+		return DefaultPolicy
+	}
+	for _, r := range p.Rules {
+		if r.matches(hostname, rawQuery) {
+			return r.Policy
+		}
+	}
+	if p.Default != nil {
+		return p.Default
+	}
+	return DefaultPolicy
+}
+
+// LoadPolicies reads a JSON token policy configuration from path. An empty path
+// returns a nil *Policies, which selects DefaultPolicy for all requests.
+func LoadPolicies(path string) (*Policies, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policies{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("could not parse token policies: %v", err)
+	}
+	if p.Default != nil {
+		if err := p.Default.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for i, r := range p.Rules {
+		if r.Policy == nil {
+			return nil, fmt.Errorf("rule %d has no policy", i)
+		}
+		if err := r.Policy.validate(); err != nil {
+			return nil, err
+		}
+		if err := r.Compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	return p, nil
+}
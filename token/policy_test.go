@@ -0,0 +1,246 @@
+package token
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPolicies = `{
+  "default": {
+    "name": "physical",
+    "ttl": "5m",
+    "usages": ["signing", "authentication"],
+    "groups": ["system:bootstrappers:kubeadm:default-node-token"]
+  },
+  "rules": [
+    {
+      "query": {"type": "virtual"},
+      "policy": {
+        "name": "query",
+        "ttl": "15m",
+        "usages": ["authentication"],
+        "groups": ["system:bootstrappers:query"]
+      }
+    },
+    {
+      "sites": ["abc0t", "xyz0t"],
+      "policy": {
+        "name": "virtual",
+        "ttl": "10m",
+        "usages": ["signing", "authentication"],
+        "groups": ["system:bootstrappers:virtual"]
+      }
+    },
+    {
+      "machine_pattern": "^mlab4-",
+      "policy": {
+        "name": "mlab4",
+        "ttl": "1h",
+        "usages": ["signing", "authentication"],
+        "groups": []
+      }
+    }
+  ]
+}`
+
+func writePolicies(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "policies.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write policies: %v", err)
+	}
+	return path
+}
+
+func Test_LoadPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			content: testPolicies,
+		},
+		{
+			name:    "failure-bad-json",
+			content: `{"rules": [`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-missing-policy",
+			content: `{"rules": [{"sites": ["abc01"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-ttl",
+			content: `{"default": {"name": "d", "ttl": "forever", "usages": ["signing"]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-zero-ttl",
+			content: `{"default": {"name": "d", "ttl": "0s", "usages": ["signing"]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-no-name",
+			content: `{"default": {"ttl": "5m", "usages": ["signing"]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-usage",
+			content: `{"default": {"name": "d", "ttl": "5m", "usages": ["lol"]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-no-usages",
+			content: `{"default": {"name": "d", "ttl": "5m", "usages": []}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-missing-usages",
+			content: `{"default": {"name": "d", "ttl": "5m"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-group",
+			content: `{"rules": [{"policy": {"name": "d", "ttl": "5m", "usages": ["signing"], "groups": ["system:masters"]}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "success-labels-and-taints",
+			content: `{"default": {"name": "d", "ttl": "5m", "usages": ["signing"], "labels": {"mlab/type": "virtual"}, "taints": [{"key": "mlab/type", "value": "virtual", "effect": "NoSchedule"}], "kubelet_extra_args": {"max-pods": "50"}}}`,
+		},
+		{
+			name:    "failure-bad-label-key",
+			content: `{"default": {"name": "d", "ttl": "5m", "usages": ["signing"], "labels": {"a/b/c": "virtual"}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-label-value",
+			content: `{"default": {"name": "d", "ttl": "5m", "usages": ["signing"], "labels": {"mlab/type": "not valid"}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-taint-key",
+			content: `{"default": {"name": "d", "ttl": "5m", "usages": ["signing"], "taints": [{"key": "", "effect": "NoSchedule"}]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-taint-effect",
+			content: `{"default": {"name": "d", "ttl": "5m", "usages": ["signing"], "taints": [{"key": "mlab/type", "effect": "Sometimes"}]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-node-labels-extra-arg",
+			content: `{"default": {"name": "d", "ttl": "5m", "usages": ["signing"], "kubelet_extra_args": {"node-labels": "a=b"}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-machine-pattern",
+			content: `{"rules": [{"machine_pattern": "(", "policy": {"name": "d", "ttl": "5m", "usages": ["signing"]}}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadPolicies(writePolicies(t, tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadPolicies(): error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	p, err := LoadPolicies("")
+	if p != nil || err != nil {
+		t.Errorf("LoadPolicies(\"\") = %v, %v; want nil, nil", p, err)
+	}
+	_, err = LoadPolicies("/does/not/exist.json")
+	if err == nil {
+		t.Errorf("LoadPolicies(): expected error for missing file")
+	}
+}
+
+func Test_Select(t *testing.T) {
+	p, err := LoadPolicies(writePolicies(t, testPolicies))
+	if err != nil {
+		t.Fatalf("LoadPolicies(): %v", err)
+	}
+	tests := []struct {
+		name     string
+		hostname string
+		rawQuery string
+		expect   string
+		ttl      time.Duration
+	}{
+		{
+			name:     "default",
+			hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+			expect:   "physical",
+			ttl:      5 * time.Minute,
+		},
+		{
+			name:     "site",
+			hostname: "mlab1-abc0t.mlab-sandbox.measurement-lab.org",
+			expect:   "virtual",
+			ttl:      10 * time.Minute,
+		},
+		{
+			name:     "machine-pattern",
+			hostname: "mlab4-foo01.mlab-sandbox.measurement-lab.org",
+			expect:   "mlab4",
+			ttl:      time.Hour,
+		},
+		{
+			name:     "query-takes-precedence",
+			hostname: "mlab4-abc0t.mlab-sandbox.measurement-lab.org",
+			rawQuery: "type=virtual&z=lol",
+			expect:   "query",
+			ttl:      15 * time.Minute,
+		},
+		{
+			name:     "query-no-match",
+			hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+			rawQuery: "type=physical",
+			expect:   "physical",
+			ttl:      5 * time.Minute,
+		},
+		{
+			name:     "unparseable-hostname",
+			hostname: "lol",
+			expect:   "physical",
+			ttl:      5 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Select(tt.hostname, tt.rawQuery)
+			if got.Name != tt.expect {
+				t.Errorf("Select() = %q, want %q", got.Name, tt.expect)
+			}
+			if got.TTL.Duration != tt.ttl {
+				t.Errorf("Select() TTL = %v, want %v", got.TTL, tt.ttl)
+			}
+		})
+	}
+
+	var nilPolicies *Policies
+	if got := nilPolicies.Select("mlab1-foo01.mlab-sandbox.measurement-lab.org", ""); got != DefaultPolicy {
+		t.Errorf("Select() on nil Policies = %v, want DefaultPolicy", got)
+	}
+}
+
+func Test_ControlPlaneAllowed(t *testing.T) {
+	p := &Policies{ControlPlaneHosts: []string{"mlab1-foo01.mlab-sandbox.measurement-lab.org"}}
+	if !p.ControlPlaneAllowed("mlab1-foo01.mlab-sandbox.measurement-lab.org") {
+		t.Errorf("ControlPlaneAllowed() = false for a listed host")
+	}
+	if p.ControlPlaneAllowed("mlab2-foo01.mlab-sandbox.measurement-lab.org") {
+		t.Errorf("ControlPlaneAllowed() = true for an unlisted host")
+	}
+	var nilPolicies *Policies
+	if nilPolicies.ControlPlaneAllowed("mlab1-foo01.mlab-sandbox.measurement-lab.org") {
+		t.Errorf("ControlPlaneAllowed() = true on nil Policies")
+	}
+}
@@ -0,0 +1,205 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/metrics"
+)
+
+// Reasons for revoking a token, used as the "reason" label of
+// metrics.TokensRevoked.
+const (
+	revokeReplaced   = "replaced"
+	revokeExpired    = "expired"
+	revokeSuperseded = "superseded"
+)
+
+// descPrefix and descSuffix surround the hostname in the description of every
+// token created by this package. The description is the only link between a
+// bootstrap token and the host it was issued to.
+const (
+	descPrefix = "Allow "
+	descSuffix = " to join the cluster"
+)
+
+// description returns the description for a token issued to hostname.
+func description(hostname string) string {
+	return descPrefix + hostname + descSuffix
+}
+
+// descriptionHost returns the hostname from the description of a token issued
+// by this package, or false if the token was not issued by this package.
+func descriptionHost(desc string) (string, bool) {
+	if !strings.HasPrefix(desc, descPrefix) || !strings.HasSuffix(desc, descSuffix) {
+		return "", false
+	}
+	h := strings.TrimSuffix(strings.TrimPrefix(desc, descPrefix), descSuffix)
+	return h, h != ""
+}
+
+// BootstrapToken describes an existing bootstrap token in the cluster.
+type BootstrapToken struct {
+	ID          string
+	Token       string
+	Description string
+	// Expires is the zero time for tokens that never expire.
+	Expires time.Time
+	Usages  []string
+	Groups  []string
+}
+
+// expired returns whether the token has expired at time now.
+func (b *BootstrapToken) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && !b.Expires.After(now)
+}
+
+// reusable returns whether the token can be handed out again for policy at
+// time now. A token is only reused while it has at least half of the policy TTL
+// left, so that the host has a reasonable amount of time to join the cluster.
+func (b *BootstrapToken) reusable(policy *Policy, now time.Time) bool {
+	if b.Expires.IsZero() || b.Expires.Before(now.Add(policy.TTL.Duration/2)) {
+		return false
+	}
+	return sameStrings(b.Usages, policy.Usages) && sameStrings(b.Groups, policy.Groups)
+}
+
+// store provides access to the bootstrap tokens of a cluster, and allows the
+// token reuse and cleanup logic to be shared between Manager implementations.
+type store interface {
+	list(ctx context.Context) ([]BootstrapToken, error)
+	delete(ctx context.Context, ids ...string) error
+}
+
+// prepare revokes the existing tokens issued to hostname before a token is
+// handed out. If reuse is true, one still valid token matching policy is kept
+// and returned instead of being revoked. Errors are logged but not returned,
+// since failing to clean up should not prevent a machine from joining.
+func prepare(ctx context.Context, s store, hostname string, policy *Policy, reuse bool) *BootstrapToken {
+	tokens, err := s.list(ctx)
+	if err != nil {
+		slog.Warn("could not list tokens", "hostname", hostname, "error", err)
+		return nil
+	}
+
+	now := time.Now()
+	var kept *BootstrapToken
+	var revoke []string
+	for i := range tokens {
+		b := &tokens[i]
+		if h, ok := descriptionHost(b.Description); !ok || h != hostname {
+			continue
+		}
+		if reuse && b.reusable(policy, now) && (kept == nil || b.Expires.After(kept.Expires)) {
+			if kept != nil {
+				revoke = append(revoke, kept.ID)
+			}
+			kept = b
+			continue
+		}
+		revoke = append(revoke, b.ID)
+	}
+
+	if len(revoke) > 0 {
+		if err := s.delete(ctx, revoke...); err != nil {
+			slog.Warn("could not revoke tokens", "token_ids", revoke, "hostname", hostname, "error", err)
+		} else {
+			metrics.TokensRevoked.WithLabelValues(revokeReplaced).Add(float64(len(revoke)))
+		}
+	}
+	if kept != nil {
+		metrics.TokensReused.Inc()
+	}
+	return kept
+}
+
+// sweep revokes tokens issued by this package that have expired or have been
+// superseded by a newer token issued to the same host.
+func sweep(ctx context.Context, s store) error {
+	tokens, err := s.list(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list tokens: %v", err)
+	}
+
+	now := time.Now()
+	newest := map[string]*BootstrapToken{}
+	var expired, superseded []string
+	for i := range tokens {
+		b := &tokens[i]
+		h, ok := descriptionHost(b.Description)
+		if !ok {
+			continue
+		}
+		if b.expired(now) {
+			expired = append(expired, b.ID)
+			continue
+		}
+		n, found := newest[h]
+		switch {
+		case !found:
+			newest[h] = b
+		case n.Expires.IsZero() || (!b.Expires.IsZero() && b.Expires.Before(n.Expires)):
+			superseded = append(superseded, b.ID)
+		default:
+			superseded = append(superseded, n.ID)
+			newest[h] = b
+		}
+	}
+
+	for reason, ids := range map[string][]string{
+		revokeExpired:    expired,
+		revokeSuperseded: superseded,
+	} {
+		if len(ids) == 0 {
+			continue
+		}
+		if err := s.delete(ctx, ids...); err != nil {
+			return fmt.Errorf("could not revoke %s tokens: %v", reason, err)
+		}
+		metrics.TokensRevoked.WithLabelValues(reason).Add(float64(len(ids)))
+	}
+	return nil
+}
+
+// Sweeper is implemented by Managers that can revoke expired and orphaned
+// tokens created by this package.
+type Sweeper interface {
+	Sweep(ctx context.Context) error
+}
+
+// RunSweeper calls s.Sweep() every interval until ctx is canceled.
+func RunSweeper(ctx context.Context, s Sweeper, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Sweep(ctx); err != nil {
+				slog.Warn("token sweep failed", "error", err)
+			}
+		}
+	}
+}
+
+// sameStrings returns whether a and b contain the same strings, in any order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as := append([]string(nil), a...)
+	bs := append([]string(nil), b...)
+	sort.Strings(as)
+	sort.Strings(bs)
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,224 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore implements the store and Sweeper interfaces with a slice of tokens.
+type fakeStore struct {
+	mu      sync.Mutex
+	tokens  []BootstrapToken
+	listErr bool
+	delErr  bool
+	sweeps  int
+}
+
+func (f *fakeStore) list(ctx context.Context) ([]BootstrapToken, error) {
+	if f.listErr {
+		return nil, fmt.Errorf("list failed")
+	}
+	return append([]BootstrapToken(nil), f.tokens...), nil
+}
+
+func (f *fakeStore) delete(ctx context.Context, ids ...string) error {
+	if f.delErr {
+		return fmt.Errorf("delete failed")
+	}
+	for _, id := range ids {
+		for i := range f.tokens {
+			if f.tokens[i].ID == id {
+				f.tokens = append(f.tokens[:i], f.tokens[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) Sweep(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sweeps++
+	return sweep(ctx, f)
+}
+
+func (f *fakeStore) ids() []string {
+	var ids []string
+	for _, b := range f.tokens {
+		ids = append(ids, b.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func testTokens(now time.Time) []BootstrapToken {
+	return []BootstrapToken{
+		{
+			ID:          "aaaaaa",
+			Description: description("host-a"),
+			Expires:     now.Add(-time.Minute),
+		},
+		{
+			ID:          "bbbbbb",
+			Description: description("host-a"),
+			Expires:     now.Add(2 * time.Minute),
+			Usages:      []string{"authentication", "signing"},
+			Groups:      []string{defaultGroup},
+		},
+		{
+			ID:          "cccccc",
+			Description: description("host-a"),
+			Expires:     now.Add(4 * time.Minute),
+			Usages:      []string{"authentication", "signing"},
+			Groups:      []string{defaultGroup},
+		},
+		{
+			ID:          "dddddd",
+			Description: description("host-b"),
+			Expires:     now.Add(time.Minute),
+		},
+		{
+			// Not created by this package.
+			ID:          "eeeeee",
+			Description: "some other token",
+			Expires:     now.Add(-time.Minute),
+		},
+		{
+			// Never expires.
+			ID:          "ffffff",
+			Description: description("host-c"),
+		},
+	}
+}
+
+func Test_prepare(t *testing.T) {
+	tests := []struct {
+		name      string
+		hostname  string
+		reuse     bool
+		listErr   bool
+		delErr    bool
+		wantKept  string
+		remaining []string
+	}{
+		{
+			name:      "revoke-all",
+			hostname:  "host-a",
+			remaining: []string{"dddddd", "eeeeee", "ffffff"},
+		},
+		{
+			name:      "reuse-newest",
+			hostname:  "host-a",
+			reuse:     true,
+			wantKept:  "cccccc",
+			remaining: []string{"cccccc", "dddddd", "eeeeee", "ffffff"},
+		},
+		{
+			// The token of host-b expires before half of the TTL.
+			name:      "reuse-none-valid",
+			hostname:  "host-b",
+			reuse:     true,
+			remaining: []string{"aaaaaa", "bbbbbb", "cccccc", "eeeeee", "ffffff"},
+		},
+		{
+			name:      "reuse-never-expires",
+			hostname:  "host-c",
+			reuse:     true,
+			remaining: []string{"aaaaaa", "bbbbbb", "cccccc", "dddddd", "eeeeee"},
+		},
+		{
+			name:      "list-error",
+			hostname:  "host-a",
+			listErr:   true,
+			remaining: []string{"aaaaaa", "bbbbbb", "cccccc", "dddddd", "eeeeee", "ffffff"},
+		},
+		{
+			name:      "delete-error",
+			hostname:  "host-a",
+			delErr:    true,
+			remaining: []string{"aaaaaa", "bbbbbb", "cccccc", "dddddd", "eeeeee", "ffffff"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeStore{
+				tokens:  testTokens(time.Now()),
+				listErr: tt.listErr,
+				delErr:  tt.delErr,
+			}
+			kept := prepare(context.Background(), f, tt.hostname, DefaultPolicy, tt.reuse)
+			if (kept == nil) != (tt.wantKept == "") || (kept != nil && kept.ID != tt.wantKept) {
+				t.Errorf("prepare() kept %+v, want %q", kept, tt.wantKept)
+			}
+			if !reflect.DeepEqual(f.ids(), tt.remaining) {
+				t.Errorf("prepare() remaining = %v, want %v", f.ids(), tt.remaining)
+			}
+		})
+	}
+}
+
+func Test_sweep(t *testing.T) {
+	f := &fakeStore{tokens: testTokens(time.Now())}
+	if err := sweep(context.Background(), f); err != nil {
+		t.Fatalf("sweep(): unexpected error: %v", err)
+	}
+	expect := []string{"cccccc", "dddddd", "eeeeee", "ffffff"}
+	if !reflect.DeepEqual(f.ids(), expect) {
+		t.Errorf("sweep() remaining = %v, want %v", f.ids(), expect)
+	}
+
+	f = &fakeStore{tokens: testTokens(time.Now()), listErr: true}
+	if err := sweep(context.Background(), f); err == nil {
+		t.Errorf("sweep(): expected list error")
+	}
+	f = &fakeStore{tokens: testTokens(time.Now()), delErr: true}
+	if err := sweep(context.Background(), f); err == nil {
+		t.Errorf("sweep(): expected delete error")
+	}
+}
+
+func Test_RunSweeper(t *testing.T) {
+	f := &fakeStore{tokens: testTokens(time.Now())}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunSweeper(ctx, f, time.Millisecond)
+		close(done)
+	}()
+	for {
+		f.mu.Lock()
+		n := f.sweeps
+		f.mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func Test_descriptionHost(t *testing.T) {
+	tests := []struct {
+		desc   string
+		expect string
+		ok     bool
+	}{
+		{desc: description("mlab1-foo01.mlab-sandbox.measurement-lab.org"), expect: "mlab1-foo01.mlab-sandbox.measurement-lab.org", ok: true},
+		{desc: description(""), ok: false},
+		{desc: "Allow mlab1-foo01.mlab-sandbox.measurement-lab.org to leave", ok: false},
+		{desc: "", ok: false},
+	}
+	for _, tt := range tests {
+		h, ok := descriptionHost(tt.desc)
+		if h != tt.expect || ok != tt.ok {
+			t.Errorf("descriptionHost(%q) = %q, %v; want %q, %v", tt.desc, h, ok, tt.expect, tt.ok)
+		}
+	}
+}
@@ -4,92 +4,313 @@
 package token
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
+	"io"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/internal/exec"
+	"github.com/m-lab/epoxy-extensions/metrics"
 )
 
 var commandArgs []string = []string{
-	"token", "create", "--ttl", "5m", "--print-join-command",
+	"token", "create", "--print-join-command",
 }
 
-// Commander is an interface that is used to wrap os/exec.Command() for testing purposes.
-type Commander interface {
-	Command(prog string, args ...string) ([]byte, error)
-}
+// certificateKeyRe matches the certificate keys printed by
+// `kubeadm certs certificate-key`, which are 32 hex encoded bytes.
+var certificateKeyRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// certsTTL is how long kubeadm keeps the uploaded control-plane certificates
+// in the kubeadm-certs Secret.
+const certsTTL = 2 * time.Hour
 
-// TokenCommand implements the Commander interface.
-type TokenCommand struct{}
+var (
+	// ErrControlPlaneNotAllowed is returned when a host that is not a
+	// control-plane candidate requests to join the control plane.
+	ErrControlPlaneNotAllowed = errors.New("host is not allowed to join the control plane")
+	// ErrControlPlaneUnsupported is returned by Managers that cannot prepare
+	// control-plane joins.
+	ErrControlPlaneUnsupported = errors.New("control-plane joins are not supported")
+)
 
-func (tc *TokenCommand) Command(prog string, args ...string) ([]byte, error) {
-	cmd := exec.Command(prog, args...)
-	return cmd.Output()
+// Request describes the host a token is requested for.
+type Request struct {
+	Hostname string
+	// RawQuery is the raw query string the host sent to ePoxy.
+	RawQuery string
+	// ControlPlane requests a token for joining the control plane, in which
+	// case the control-plane certificates are uploaded to the cluster and
+	// the key to decrypt them is returned with the token.
+	ControlPlane bool
 }
 
-// Manager defines the interface for working with tokens.
+// Manager defines the interface for working with tokens. Implementations must
+// be safe for concurrent use, since a single Manager serves every request.
 type Manager interface {
-	Create(target string) error // Generate a new token.
-	Response(version string) ([]byte, error)
+	// Create returns the details of a token for the requesting host. Any
+	// other tokens previously issued to the host are revoked. Calls to the
+	// cluster are canceled when ctx is done.
+	Create(ctx context.Context, req Request) (Details, error)
 }
 
-// TokenManager implements the Manager interface.
+// TokenManager implements the Manager and Sweeper interfaces using kubeadm.
 type TokenManager struct {
-	Command   string
-	Commander Commander
-	Details   Details
+	// Runner runs kubeadm.
+	Runner   exec.Runner
+	Policies *Policies
+	// Reuse enables handing out a host's existing, still valid token instead
+	// of creating a new one.
+	Reuse bool
+	// Kubeconfig is the path of the kubeconfig file of the cluster. If
+	// empty, kubeadm uses its default.
+	Kubeconfig string
+
+	// The API address and CA hash of the cluster, as printed by the last
+	// successful `kubeadm token create --print-join-command`. These are
+	// needed to reuse a token, since `kubeadm token list` does not print them.
+	mu         sync.Mutex
+	apiAddress string
+	caHash     string
+
+	// The key of the control-plane certificates last uploaded to the
+	// kubeadm-certs Secret, and when they were uploaded. certMu serializes
+	// uploads, since each one replaces the Secret and invalidates the key
+	// of the previous one.
+	certMu       sync.Mutex
+	certKey      string
+	certUploaded time.Time
 }
 
 // Details represents data used in responses to allocate_k8s_token extension
-// requests. For v1, only Token will be populated/returned, and for v2 all
-// fields should have values and will be returned as JSON.
+// requests. For v1, only Token will be populated/returned, and for v2 the
+// APIAddress, Token, CAHash, CertificateKey and Policy fields will be returned
+// as JSON. CertificateKey is only set for control-plane joins. A
+// Details value belongs to a single request and is never shared between
+// requests.
 type Details struct {
-	APIAddress string `json:"api_address"`
-	Token      string `json:"token"`
-	CAHash     string `json:"ca_hash"`
+	APIAddress     string    `json:"api_address"`
+	Token          string    `json:"token"`
+	CAHash         string    `json:"ca_hash"`
+	CertificateKey string    `json:"certificate_key,omitempty"`
+	Policy         *Policy   `json:"policy,omitempty"`
+	Expires        time.Time `json:"-"`
+	Description    string    `json:"-"`
+}
+
+// Response returns an appropriate response body for the token, based on the
+// API version.
+func (d Details) Response(version string) ([]byte, error) {
+	if version == "v1" {
+		return []byte(d.Token), nil
+	}
+	return json.Marshal(d)
+}
+
+// Create returns a token for the requesting host. For control-plane joins, it
+// also uploads the control-plane certificates and returns their key.
+func (t *TokenManager) Create(ctx context.Context, req Request) (Details, error) {
+	if req.ControlPlane && !t.Policies.ControlPlaneAllowed(req.Hostname) {
+		return Details{}, ErrControlPlaneNotAllowed
+	}
+	d, err := t.create(ctx, req)
+	if err != nil || !req.ControlPlane {
+		return d, err
+	}
+	d.CertificateKey, err = t.uploadCerts(ctx)
+	if err != nil {
+		return Details{}, err
+	}
+	return d, nil
 }
 
-// Create generates a new k8s token.
-func (t *TokenManager) Create(target string) error {
-	// Append the --description flag to the slice of arguments, since it is only
-	// after the request has been handled that we know which host the request is for.
-	desc := fmt.Sprintf("Allow %s to join the cluster", target)
-	args := append(commandArgs, "--description", desc)
+// create returns a token for the requesting host, either by reusing a still
+// valid one, if enabled, or by creating a new k8s token.
+func (t *TokenManager) create(ctx context.Context, req Request) (Details, error) {
+	policy := t.Policies.Select(req.Hostname, req.RawQuery)
+	desc := description(req.Hostname)
+
+	apiAddress, caHash := t.joinInfo()
+	if b := prepare(ctx, t, req.Hostname, policy, t.Reuse && apiAddress != ""); b != nil {
+		return Details{
+			APIAddress:  apiAddress,
+			Token:       b.Token,
+			CAHash:      caHash,
+			Policy:      policy,
+			Expires:     b.Expires,
+			Description: desc,
+		}, nil
+	}
+
+	// Append the policy and --description flags to a copy of the arguments,
+	// since it is only after the request has been handled that we know which
+	// host the request is for.
+	args := make([]string, 0, len(commandArgs)+8)
+	args = append(args, commandArgs...)
+	args = append(args, "--ttl", policy.TTL.String())
+	args = append(args, "--usages", strings.Join(policy.Usages, ","))
+	if len(policy.Groups) > 0 {
+		args = append(args, "--groups", strings.Join(policy.Groups, ","))
+	}
+	args = append(args, "--description", desc)
 
 	// Allocate the token for the given hostname.
-	output, err := t.Commander.Command(t.Command, args...)
+	expires := time.Now().Add(policy.TTL.Duration)
+	output, err := t.kubeadm(ctx, "token create", t.withKubeconfig(args)...)
 	if err != nil {
-		return err
+		return Details{}, err
 	}
 	fields := strings.Fields(string(output))
 	// The join command should have 7 fields, and we count on this to return the
 	// right values. A sample join command:
 	// kubeadm join <api address> --token <token> --discovery-token-ca-cert-hash <hash>
 	if len(fields) != 7 {
-		return fmt.Errorf("bad join command: %s", string(output))
+		return Details{}, fmt.Errorf("bad join command: %s", string(output))
 	}
-	t.Details.APIAddress = fields[2]
-	t.Details.Token = fields[4]
-	t.Details.CAHash = fields[6]
+	metrics.TokensCreated.Inc()
+
+	t.mu.Lock()
+	t.apiAddress = fields[2]
+	t.caHash = fields[6]
+	t.mu.Unlock()
 
-	return nil
+	return Details{
+		APIAddress:  fields[2],
+		Token:       fields[4],
+		CAHash:      fields[6],
+		Policy:      policy,
+		Expires:     expires,
+		Description: desc,
+	}, nil
 }
 
-// Response returns an appropriate response body for the incoming request, based
-// on the API version.
-func (t *TokenManager) Response(version string) ([]byte, error) {
-	if version == "v1" {
-		return []byte(t.Details.Token), nil
+// uploadCerts returns the key of the control-plane certificates in the
+// kubeadm-certs Secret. The key of the last upload is reused while the Secret
+// has at least half of its TTL left, so that joins already in progress are not
+// broken by a new upload. Otherwise, uploadCerts generates a new certificate
+// key and uploads the control-plane certificates, encrypted with that key.
+func (t *TokenManager) uploadCerts(ctx context.Context) (string, error) {
+	t.certMu.Lock()
+	defer t.certMu.Unlock()
+	if t.certKey != "" && time.Since(t.certUploaded) < certsTTL/2 {
+		return t.certKey, nil
 	}
-	return json.Marshal(t.Details)
+
+	output, err := t.kubeadm(ctx, "certs certificate-key", "certs", "certificate-key")
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(output))
+	if !certificateKeyRe.MatchString(key) {
+		return "", fmt.Errorf("bad certificate key: %s", key)
+	}
+	uploaded := time.Now()
+	_, err = t.kubeadm(ctx, "upload-certs", t.withKubeconfig([]string{
+		"init", "phase", "upload-certs", "--upload-certs", "--certificate-key", key})...)
+	if err != nil {
+		// The upload may have replaced the Secret before failing, so the
+		// previous key can no longer be trusted.
+		t.certKey = ""
+		return "", err
+	}
+	t.certKey = key
+	t.certUploaded = uploaded
+	return key, nil
+}
+
+// kubeadm runs kubeadm with args, recording the latency of the call as the
+// given operation.
+func (t *TokenManager) kubeadm(ctx context.Context, operation string, args ...string) ([]byte, error) {
+	start := time.Now()
+	output, err := t.Runner.Run(ctx, args...)
+	metrics.ObserveBackendCall("kubeadm", operation, start, err)
+	return output, err
+}
+
+// withKubeconfig returns args with the --kubeconfig flag of t.Kubeconfig
+// appended, if set.
+func (t *TokenManager) withKubeconfig(args []string) []string {
+	if t.Kubeconfig == "" {
+		return args
+	}
+	return append(args, "--kubeconfig", t.Kubeconfig)
+}
+
+// joinInfo returns the API address and CA hash of the cluster, if known.
+func (t *TokenManager) joinInfo() (string, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.apiAddress, t.caHash
+}
+
+// kubeadmToken is a token as printed by `kubeadm token list -o json`.
+type kubeadmToken struct {
+	Token       string    `json:"token"`
+	Description string    `json:"description"`
+	Expires     time.Time `json:"expires"`
+	Usages      []string  `json:"usages"`
+	Groups      []string  `json:"groups"`
+}
+
+// list returns all bootstrap tokens known to kubeadm.
+func (t *TokenManager) list(ctx context.Context) ([]BootstrapToken, error) {
+	output, err := t.kubeadm(ctx, "token list", t.withKubeconfig([]string{"token", "list", "-o", "json"})...)
+	if err != nil {
+		return nil, err
+	}
+
+	// kubeadm prints one JSON object per token, not a JSON array.
+	var tokens []BootstrapToken
+	dec := json.NewDecoder(bytes.NewReader(output))
+	for {
+		var k kubeadmToken
+		err := dec.Decode(&k)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad token list: %v", err)
+		}
+		id, _, _ := strings.Cut(k.Token, ".")
+		tokens = append(tokens, BootstrapToken{
+			ID:          id,
+			Token:       k.Token,
+			Description: k.Description,
+			Expires:     k.Expires,
+			Usages:      k.Usages,
+			Groups:      k.Groups,
+		})
+	}
+	return tokens, nil
+}
+
+// delete deletes the tokens with the given IDs.
+func (t *TokenManager) delete(ctx context.Context, ids ...string) error {
+	args := append([]string{"token", "delete"}, ids...)
+	_, err := t.kubeadm(ctx, "token delete", t.withKubeconfig(args)...)
+	return err
+}
+
+// Sweep revokes expired and superseded tokens created by this package.
+func (t *TokenManager) Sweep(ctx context.Context) error {
+	return sweep(ctx, t)
 }
 
-// New returns a TokenManager.
-func New(bindir string, commander Commander) Manager {
+// New returns a TokenManager running kubeadm with runner. Tokens are created
+// according to policies, which may be nil to use DefaultPolicy for all tokens.
+// If reuse is true, a host's existing token is handed out again while it is
+// still valid.
+func New(runner exec.Runner, policies *Policies, reuse bool) Manager {
 	return &TokenManager{
-		Command:   bindir + "/kubeadm",
-		Commander: commander,
-		Details:   Details{},
+		Runner:   runner,
+		Policies: policies,
+		Reuse:    reuse,
 	}
 
 }
@@ -1,9 +1,18 @@
 package token
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/m-lab/epoxy-extensions/internal/exec"
+	"github.com/m-lab/epoxy-extensions/internal/machine"
 )
 
 var (
@@ -14,12 +23,19 @@ var (
 
 type fakeTokenCommand struct {
 	result string
+	list   string
 }
 
-func (c *fakeTokenCommand) Command(prog string, args ...string) ([]byte, error) {
+func (c *fakeTokenCommand) run(args []string) ([]byte, error) {
 	if c.result == "" {
 		return nil, fmt.Errorf("command failed")
 	}
+	switch args[1] {
+	case "list":
+		return []byte(c.list), nil
+	case "delete":
+		return nil, nil
+	}
 	return []byte(c.result), nil
 }
 
@@ -30,6 +46,7 @@ func Test_Response(t *testing.T) {
 	tests := []struct {
 		name    string
 		expect  string
+		policy  *Policy
 		version string
 		wantErr bool
 	}{
@@ -45,19 +62,28 @@ func Test_Response(t *testing.T) {
 			version: "v2",
 			wantErr: false,
 		},
+		{
+			name:   "success-v2-with-policy",
+			policy: DefaultPolicy,
+			expect: `{"api_address":"` + testAPIAddress + `","token":"` + testToken + `","ca_hash":"` + testCAHash +
+				`","policy":{"name":"default","ttl":"5m0s","usages":["signing","authentication"],"groups":["` + defaultGroup + `"]}}`,
+			version: "v2",
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			g := &TokenManager{
-				Details: Details{
-					APIAddress: testAPIAddress,
-					CAHash:     testCAHash,
-					Token:      testToken,
-				},
+			d := Details{
+				APIAddress:  testAPIAddress,
+				CAHash:      testCAHash,
+				Token:       testToken,
+				Policy:      tt.policy,
+				Expires:     time.Now().Add(5 * time.Minute),
+				Description: "Allow test-host to join the cluster",
 			}
 
-			resp, err := g.Response(tt.version)
+			resp, err := d.Response(tt.version)
 			r := string(resp)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Response(): error = %v, wantErr %v", err, tt.wantErr)
@@ -79,9 +105,11 @@ func Test_Create(t *testing.T) {
 		{
 			name: "success",
 			expect: Details{
-				APIAddress: "api.example.com:6443",
-				CAHash:     "sha256:hash",
-				Token:      "testtoken",
+				APIAddress:  "api.example.com:6443",
+				CAHash:      "sha256:hash",
+				Token:       "testtoken",
+				Policy:      DefaultPolicy,
+				Description: "Allow test-host to join the cluster",
 			},
 			result:  "kubeadm join api.example.com:6443 --token testtoken --discovery-token-ca-cert-hash sha256:hash",
 			wantErr: false,
@@ -100,64 +128,416 @@ func Test_Create(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			g := &TokenManager{
-				Commander: &fakeTokenCommand{
+				Runner: &exec.Fake{Func: (&fakeTokenCommand{
 					result: tt.result,
-				},
+				}).run},
 			}
-			err := g.Create("test-host")
+			start := time.Now()
+			d, err := g.Create(context.Background(), Request{Hostname: "test-host"})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Create(): error = %v, wantErr %v", err, tt.wantErr)
 			}
-			if g.Details != tt.expect {
-				t.Errorf("Create() = %q, want %q", g.Details, tt.expect)
+			if !tt.wantErr {
+				ttl := DefaultPolicy.TTL.Duration
+				if d.Expires.Before(start.Add(ttl)) || d.Expires.After(time.Now().Add(ttl)) {
+					t.Errorf("Create(): unexpected expiry %v", d.Expires)
+				}
+				// Expiry was checked above; ignore it in the comparison.
+				d.Expires = time.Time{}
+			}
+			if d != tt.expect {
+				t.Errorf("Create() = %+v, want %+v", d, tt.expect)
 			}
 		})
 	}
 }
 
-func Test_TokenCommand(t *testing.T) {
+// recordingTokenCommand records the arguments of the last command it ran.
+type recordingTokenCommand struct {
+	args []string
+}
+
+func (c *recordingTokenCommand) run(args []string) ([]byte, error) {
+	if args[1] != "create" {
+		return nil, nil
+	}
+	c.args = args
+	return []byte("kubeadm join " + testAPIAddress + " --token " + testToken +
+		" --discovery-token-ca-cert-hash " + testCAHash), nil
+}
+
+func Test_CreatePolicyArgs(t *testing.T) {
+	policies := &Policies{
+		Rules: []*Rule{
+			{
+				Matcher: machine.Matcher{Sites: []string{"abc0t"}},
+				Policy: &Policy{
+					Name:   "virtual",
+					TTL:    Duration{10 * time.Minute},
+					Usages: []string{"authentication"},
+					Groups: []string{"system:bootstrappers:virtual"},
+				},
+			},
+		},
+	}
 	tests := []struct {
-		name    string
-		prog    string
-		args    []string
-		expect  string
-		wantErr bool
+		name     string
+		hostname string
+		expect   []string
 	}{
 		{
-			name:    "success",
-			prog:    "date",
-			args:    []string{"--date=@1679083030", "--utc", "+%FT%T"},
-			expect:  "2023-03-17T19:57:10",
-			wantErr: false,
+			name:     "default-policy",
+			hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org",
+			expect: []string{
+				"token", "create", "--print-join-command", "--ttl", "5m0s",
+				"--usages", "signing,authentication", "--groups", defaultGroup,
+				"--description", "Allow mlab1-foo01.mlab-sandbox.measurement-lab.org to join the cluster",
+			},
 		},
 		{
-			name:    "failure",
-			prog:    "nosuchfile",
-			args:    []string{"lol", ";-)"},
-			wantErr: true,
+			name:     "rule-policy",
+			hostname: "mlab1-abc0t.mlab-sandbox.measurement-lab.org",
+			expect: []string{
+				"token", "create", "--print-join-command", "--ttl", "10m0s",
+				"--usages", "authentication", "--groups", "system:bootstrappers:virtual",
+				"--description", "Allow mlab1-abc0t.mlab-sandbox.measurement-lab.org to join the cluster",
+			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tc := &TokenCommand{}
-			output, err := tc.Command(tt.prog, tt.args...)
-			result := strings.TrimSpace(string(output))
-			if (err != nil) != tt.wantErr {
-				t.Errorf("TokenCommand(): error = %v, wantErr %v", err, tt.wantErr)
+			rc := &recordingTokenCommand{}
+			g := New(&exec.Fake{Func: rc.run}, policies, false)
+			d, err := g.Create(context.Background(), Request{Hostname: tt.hostname})
+			if err != nil {
+				t.Fatalf("Create(): unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(rc.args, tt.expect) {
+				t.Errorf("Create(): args = %q, want %q", rc.args, tt.expect)
 			}
-			if result != tt.expect {
-				t.Errorf("TokenCommand(): expected '%s', got '%s'", tt.expect, result)
+			if d.Policy != policies.Select(tt.hostname, "") {
+				t.Errorf("Create(): unexpected policy %v", d.Policy)
 			}
 		})
 	}
 }
 
+// fakeHostTokenCommand returns a join command whose token is derived from the
+// --description argument, so that results can be matched to their target.
+type fakeHostTokenCommand struct{}
+
+func (c *fakeHostTokenCommand) run(args []string) ([]byte, error) {
+	if args[1] != "create" {
+		return nil, nil
+	}
+	desc := args[len(args)-1]
+	host := strings.Fields(desc)[1]
+	return []byte("kubeadm join " + testAPIAddress + " --token " + host +
+		" --discovery-token-ca-cert-hash " + testCAHash), nil
+}
+
+func Test_CreateConcurrent(t *testing.T) {
+	g := New(&exec.Fake{Func: (&fakeHostTokenCommand{}).run}, nil, false)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			host := fmt.Sprintf("host-%d", i)
+			d, err := g.Create(context.Background(), Request{Hostname: host})
+			if err != nil {
+				t.Errorf("Create(): unexpected error: %v", err)
+				return
+			}
+			if d.Token != host {
+				t.Errorf("Create(): got token %q for host %q", d.Token, host)
+			}
+			if d.Description != fmt.Sprintf("Allow %s to join the cluster", host) {
+				t.Errorf("Create(): got description %q for host %q", d.Description, host)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
 func Test_New(t *testing.T) {
-	tc := &TokenCommand{}
-	m := New("/fake/bin", tc)
+	m := New(&exec.Fake{}, nil, false)
 	var i interface{} = m
 	_, ok := i.(Manager)
 	if !ok {
 		t.Errorf("New(): expected type Manager, but got %T", m)
 	}
 }
+
+// fakeKubeadm emulates the create, list and delete token commands of kubeadm.
+type fakeKubeadm struct {
+	mu        sync.Mutex
+	tokens    []kubeadmToken
+	deleted   []string
+	n         int
+	certKey   string
+	uploadErr bool
+	uploaded  []string
+}
+
+func (k *fakeKubeadm) run(args []string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch args[1] {
+	case "create":
+		k.n++
+		tok := fmt.Sprintf("%06d.0123456789abcdef", k.n)
+		ttl, _ := time.ParseDuration(args[4])
+		k.tokens = append(k.tokens, kubeadmToken{
+			Token:       tok,
+			Description: args[len(args)-1],
+			Expires:     time.Now().Add(ttl),
+			Usages:      strings.Split(args[6], ","),
+			Groups:      strings.Split(args[8], ","),
+		})
+		return []byte("kubeadm join " + testAPIAddress + " --token " + tok +
+			" --discovery-token-ca-cert-hash " + testCAHash), nil
+	case "list":
+		var out []byte
+		for _, t := range k.tokens {
+			b, _ := json.MarshalIndent(t, "", "    ")
+			out = append(out, b...)
+			out = append(out, '\n')
+		}
+		return out, nil
+	case "certificate-key":
+		return []byte(k.certKey + "\n"), nil
+	case "phase":
+		if k.uploadErr {
+			return nil, fmt.Errorf("upload failed")
+		}
+		k.uploaded = append(k.uploaded, args[len(args)-1])
+		return nil, nil
+	case "delete":
+		for _, id := range args[2:] {
+			for i, t := range k.tokens {
+				if strings.HasPrefix(t.Token, id+".") {
+					k.tokens = append(k.tokens[:i], k.tokens[i+1:]...)
+					k.deleted = append(k.deleted, id)
+					break
+				}
+			}
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown command %v", args)
+}
+
+func Test_CreateRevokeAndReuse(t *testing.T) {
+	// The first token is always created for another host.
+	tests := []struct {
+		name       string
+		reuse      bool
+		wantTokens []string
+		wantDelete []string
+	}{
+		{
+			name:       "revoke",
+			reuse:      false,
+			wantTokens: []string{"000002.0123456789abcdef", "000003.0123456789abcdef", "000004.0123456789abcdef"},
+			wantDelete: []string{"000002", "000003"},
+		},
+		{
+			name:       "reuse",
+			reuse:      true,
+			wantTokens: []string{"000002.0123456789abcdef", "000002.0123456789abcdef", "000002.0123456789abcdef"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &fakeKubeadm{}
+			g := New(&exec.Fake{Func: k.run}, nil, tt.reuse)
+			req := Request{Hostname: "mlab1-foo01.mlab-sandbox.measurement-lab.org"}
+			other := Request{Hostname: "mlab2-foo01.mlab-sandbox.measurement-lab.org"}
+
+			if _, err := g.Create(context.Background(), other); err != nil {
+				t.Fatalf("Create(): unexpected error: %v", err)
+			}
+
+			var got []string
+			for i := 0; i < 3; i++ {
+				d, err := g.Create(context.Background(), req)
+				if err != nil {
+					t.Fatalf("Create(): unexpected error: %v", err)
+				}
+				if d.APIAddress != testAPIAddress || d.CAHash != testCAHash {
+					t.Errorf("Create(): bad join details %+v", d)
+				}
+				got = append(got, d.Token)
+			}
+			if !reflect.DeepEqual(got, tt.wantTokens) {
+				t.Errorf("Create(): tokens = %v, want %v", got, tt.wantTokens)
+			}
+			if !reflect.DeepEqual(k.deleted, tt.wantDelete) {
+				t.Errorf("Create(): deleted = %v, want %v", k.deleted, tt.wantDelete)
+			}
+			// The token of the other host must never be revoked.
+			if k.tokens[0].Token != "000001.0123456789abcdef" {
+				t.Errorf("Create(): token of other host was revoked")
+			}
+		})
+	}
+}
+
+func Test_list(t *testing.T) {
+	k := &fakeKubeadm{
+		tokens: []kubeadmToken{
+			{
+				Token:       testToken,
+				Description: "Allow test-host to join the cluster",
+				Expires:     time.Date(2023, 3, 17, 19, 57, 10, 0, time.UTC),
+				Usages:      []string{"authentication", "signing"},
+				Groups:      []string{defaultGroup},
+			},
+			{
+				Token: "abcdef.0123456789abcdef",
+			},
+		},
+	}
+	g := &TokenManager{Runner: &exec.Fake{Func: k.run}}
+	tokens, err := g.list(context.Background())
+	if err != nil {
+		t.Fatalf("list(): unexpected error: %v", err)
+	}
+	expect := []BootstrapToken{
+		{
+			ID:          "012345",
+			Token:       testToken,
+			Description: "Allow test-host to join the cluster",
+			Expires:     time.Date(2023, 3, 17, 19, 57, 10, 0, time.UTC),
+			Usages:      []string{"authentication", "signing"},
+			Groups:      []string{defaultGroup},
+		},
+		{
+			ID:    "abcdef",
+			Token: "abcdef.0123456789abcdef",
+		},
+	}
+	if !reflect.DeepEqual(tokens, expect) {
+		t.Errorf("list() = %+v, want %+v", tokens, expect)
+	}
+
+	g.Runner = &exec.Fake{Func: (&fakeTokenCommand{result: "lol", list: "{lol"}).run}
+	if _, err := g.list(context.Background()); err == nil {
+		t.Errorf("list(): expected error for bad output")
+	}
+}
+
+func Test_Kubeconfig(t *testing.T) {
+	c := &exec.Fake{Func: (&fakeTokenCommand{
+		result: "kubeadm join api.example.com:6443 --token testtoken --discovery-token-ca-cert-hash sha256:hash",
+	}).run}
+	g := &TokenManager{Runner: c, Kubeconfig: "/etc/kubeconfig/sandbox.conf"}
+	ctx := context.Background()
+	if _, err := g.Create(ctx, Request{Hostname: "test-host"}); err != nil {
+		t.Fatalf("Create(): unexpected error: %v", err)
+	}
+	if _, err := g.list(ctx); err != nil {
+		t.Fatalf("list(): unexpected error: %v", err)
+	}
+	if err := g.delete(ctx, "abcdef"); err != nil {
+		t.Fatalf("delete(): unexpected error: %v", err)
+	}
+	for _, args := range c.Runs() {
+		flags := args[len(args)-2:]
+		if !reflect.DeepEqual(flags, []string{"--kubeconfig", "/etc/kubeconfig/sandbox.conf"}) {
+			t.Errorf("kubeadm %v: want the --kubeconfig flag", args)
+		}
+	}
+}
+
+func Test_CreateControlPlane(t *testing.T) {
+	const (
+		allowed = "mlab1-foo01.mlab-sandbox.measurement-lab.org"
+		key     = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	)
+	policies := &Policies{ControlPlaneHosts: []string{allowed}}
+	tests := []struct {
+		name       string
+		hostname   string
+		certKey    string
+		uploadErr  bool
+		wantErr    error
+		wantAnyErr bool
+	}{
+		{
+			name:     "success",
+			hostname: allowed,
+			certKey:  key,
+		},
+		{
+			name:     "failure-not-allowed",
+			hostname: "mlab2-foo01.mlab-sandbox.measurement-lab.org",
+			certKey:  key,
+			wantErr:  ErrControlPlaneNotAllowed,
+		},
+		{
+			name:       "failure-bad-certificate-key",
+			hostname:   allowed,
+			certKey:    "lol",
+			wantAnyErr: true,
+		},
+		{
+			name:       "failure-upload-certs",
+			hostname:   allowed,
+			certKey:    key,
+			uploadErr:  true,
+			wantAnyErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &fakeKubeadm{certKey: tt.certKey, uploadErr: tt.uploadErr}
+			g := New(&exec.Fake{Func: k.run}, policies, false)
+			d, err := g.Create(context.Background(), Request{Hostname: tt.hostname, ControlPlane: true})
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Create(): error = %v, want %v", err, tt.wantErr)
+			}
+			if (err != nil) != (tt.wantErr != nil || tt.wantAnyErr) {
+				t.Fatalf("Create(): unexpected error = %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if d.CertificateKey != key {
+				t.Errorf("Create(): CertificateKey = %q, want %q", d.CertificateKey, key)
+			}
+			if !reflect.DeepEqual(k.uploaded, []string{key}) {
+				t.Errorf("Create(): uploaded certificates with %v, want %v", k.uploaded, []string{key})
+			}
+		})
+	}
+
+	// Further control-plane joins reuse the uploaded certificates until half
+	// of their TTL has passed.
+	k := &fakeKubeadm{certKey: key}
+	g := New(&exec.Fake{Func: k.run}, policies, false).(*TokenManager)
+	req := Request{Hostname: allowed, ControlPlane: true}
+	for i := 0; i < 2; i++ {
+		if d, err := g.Create(context.Background(), req); err != nil || d.CertificateKey != key {
+			t.Fatalf("Create(): got key %q, error %v", d.CertificateKey, err)
+		}
+	}
+	if len(k.uploaded) != 1 {
+		t.Errorf("Create(): uploaded certificates %d times, want 1", len(k.uploaded))
+	}
+	g.certUploaded = time.Now().Add(-certsTTL / 2)
+	if _, err := g.Create(context.Background(), req); err != nil {
+		t.Fatalf("Create(): unexpected error: %v", err)
+	}
+	if len(k.uploaded) != 2 {
+		t.Errorf("Create(): uploaded certificates %d times, want 2", len(k.uploaded))
+	}
+
+	// Worker joins never upload certificates.
+	k = &fakeKubeadm{certKey: key}
+	d, err := New(&exec.Fake{Func: k.run}, policies, false).Create(context.Background(), Request{Hostname: allowed})
+	if err != nil || d.CertificateKey != "" || len(k.uploaded) != 0 {
+		t.Errorf("Create(): worker join got key %q, uploads %v, error %v", d.CertificateKey, k.uploaded, err)
+	}
+}